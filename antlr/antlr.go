@@ -0,0 +1,942 @@
+/*
+Package antlr converts ANTLR v4 grammars into the grammar trees of
+package peg, so that parsers can be generated from them without
+depending on the ANTLR runtime.
+
+Parser and lexer rules are translated into rules of the same names.
+As a PEG has no separate lexer, the whitespace and comments that the
+lexer rules marked with `-> skip`, or sent to another channel, are
+made explicit: they are collected into a rule `Skip`, which is
+referenced at the start of the first parser rule, and after each
+token within parser rules. Directly left-recursive rules, like
+`expr : expr '*' expr | INT ;`, are rewritten into a repetition,
+matching the same language, e.g. `expr <- INT ('*' expr)*`. A
+non-greedy loop followed by another element, like `.*? '"'`,
+becomes `(!'"' .)* '"'`.
+
+Features that cannot be translated, like actions, semantic
+predicates, rule arguments, lexer modes, and imports, are dropped,
+and reported as notes. Differences in semantics that remain, e.g.
+since ordered choice replaces ANTLR's longest match between lexer
+rules, and its adaptive prediction between alternatives, are not
+reported; the result should be checked, e.g. using "leg lint" and
+"leg test".
+*/
+package antlr
+
+import (
+	"fmt"
+	"github.com/knieriem/peg"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A Note reports a feature of the ANTLR grammar that
+// has not been translated.
+type Note struct {
+	Line int
+	Text string
+}
+
+func (n Note) String() string {
+	return fmt.Sprintf("%d: %s", n.Line, n.Text)
+}
+
+type kind int
+
+const (
+	kRef     kind = iota // reference to a rule
+	kLit                 // literal string, text holding the raw bytes
+	kSet                 // set of bytes
+	kDot                 // any byte
+	kEOF                 // end of input
+	kAlt                 // alternatives
+	kSeq                 // sequence
+	kOpt                 // subs[0]?
+	kStar                // subs[0]*
+	kPlus                // subs[0]+
+	kNot                 // ~subs[0], any byte not matched by it
+	kPeekNot             // !subs[0]
+)
+
+// A node is an element of a rule, as parsed from the ANTLR grammar.
+type node struct {
+	kind kind
+	text string
+	set  *[256]bool
+	subs []*node
+	lazy bool // non-greedy suffix, like *?
+	line int
+}
+
+// A rule is a parser or lexer rule of the ANTLR grammar.
+type rule struct {
+	name string
+	body *node
+	skip bool // lexer rule, whose tokens are skipped, or hidden
+	line int
+}
+
+func isLexerName(name string) bool {
+	return name != "" && 'A' <= name[0] && name[0] <= 'Z'
+}
+
+/*
+Convert adds the rules of the ANTLR v4 grammar contained in text
+to t, and returns notes about the features that have not
+been translated.
+*/
+func Convert(t *peg.Tree, text string) (notes []Note, err error) {
+	p := &parser{}
+	if err = p.scan(text); err != nil {
+		return nil, err
+	}
+	if err = p.grammar(); err != nil {
+		return nil, err
+	}
+	c := &converter{t: t, rules: make(map[string]*rule), notes: p.notes}
+	for _, r := range p.rules {
+		c.rules[r.name] = r
+	}
+	c.convert(p.rules)
+	sort.SliceStable(c.notes, func(i, j int) bool { return c.notes[i].Line < c.notes[j].Line })
+	return c.notes, nil
+}
+
+type converter struct {
+	t        *peg.Tree
+	rules    map[string]*rule
+	skipRule string // name of the rule collecting skipped tokens
+	notes    []Note
+}
+
+func (c *converter) note(line int, format string, a ...interface{}) {
+	c.notes = append(c.notes, Note{line, fmt.Sprintf(format, a...)})
+}
+
+func (c *converter) convert(rules []*rule) {
+	var skipped []*rule
+	first := true
+	for _, r := range rules {
+		if r.skip {
+			skipped = append(skipped, r)
+		}
+	}
+	if len(skipped) != 0 {
+		c.skipRule = "Skip"
+		for c.rules[c.skipRule] != nil {
+			c.skipRule += "_"
+		}
+	}
+	for _, r := range rules {
+		if isLexerName(r.name) {
+			c.emitRule(r.name, r.body, false, false)
+			continue
+		}
+		c.emitRule(r.name, c.unrecurse(r), true, first)
+		first = false
+	}
+	if c.skipRule != "" {
+		body := &node{kind: kAlt}
+		for _, r := range skipped {
+			body.subs = append(body.subs, &node{kind: kRef, text: r.name})
+		}
+		c.emitRule(c.skipRule, &node{kind: kStar, subs: []*node{body}}, false, false)
+	}
+}
+
+// unrecurse rewrites the alternatives of a directly left-recursive
+// rule, like r : r X | Y ; into r : Y (X)* ;
+func (c *converter) unrecurse(r *rule) *node {
+	alts := []*node{r.body}
+	if r.body.kind == kAlt {
+		alts = r.body.subs
+	}
+	var prim, suffix []*node
+	for _, a := range alts {
+		if a.kind == kSeq && len(a.subs) > 1 && a.subs[0].kind == kRef && a.subs[0].text == r.name {
+			suffix = append(suffix, &node{kind: kSeq, subs: a.subs[1:]})
+		} else if a.kind == kRef && a.text == r.name {
+			c.note(r.line, "rule %s: alternative consisting of a reference to the rule itself dropped", r.name)
+		} else {
+			prim = append(prim, a)
+		}
+	}
+	if suffix == nil {
+		return r.body
+	}
+	if prim == nil {
+		c.note(r.line, "rule %s: left recursion without a non-recursive alternative", r.name)
+		return r.body
+	}
+	c.note(r.line, "rule %s: left recursion rewritten into a repetition; precedence and associativity are not preserved", r.name)
+	return &node{kind: kSeq, subs: []*node{
+		alternatives(prim),
+		{kind: kStar, subs: []*node{alternatives(suffix)}},
+	}}
+}
+
+func alternatives(alts []*node) *node {
+	if len(alts) == 1 {
+		return alts[0]
+	}
+	return &node{kind: kAlt, subs: alts}
+}
+
+func (c *converter) emitRule(name string, body *node, parserRule, skipFirst bool) {
+	if parserRule && c.skipRule != "" {
+		body = c.addSkips(body)
+		if skipFirst {
+			body = sequence(&node{kind: kRef, text: c.skipRule}, body)
+		}
+	}
+	c.t.AddRule(name)
+	c.emit(body, parserRule)
+	c.t.AddExpression()
+}
+
+// addSkips appends a reference to the skip rule to each token
+// within the expression of a parser rule.
+func (c *converter) addSkips(n *node) *node {
+	switch n.kind {
+	case kRef:
+		if !isLexerName(n.text) {
+			return n
+		}
+		fallthrough
+	case kLit:
+		return sequence(n, &node{kind: kRef, text: c.skipRule})
+	case kDot, kSet, kEOF:
+		return n
+	}
+	m := *n
+	m.subs = nil
+	for _, sub := range n.subs {
+		sub = c.addSkips(sub)
+		if n.kind == kSeq && sub.kind == kSeq {
+			m.subs = append(m.subs, sub.subs...)
+		} else {
+			m.subs = append(m.subs, sub)
+		}
+	}
+	return &m
+}
+
+// sequence returns the sequence of a and b, merging
+// the elements of b, if it is a sequence itself.
+func sequence(a, b *node) *node {
+	if b.kind == kSeq {
+		return &node{kind: kSeq, subs: append([]*node{a}, b.subs...)}
+	}
+	return &node{kind: kSeq, subs: []*node{a, b}}
+}
+
+// emit pushes the expression of n onto the stack of t.
+func (c *converter) emit(n *node, parserRule bool) {
+	t := c.t
+	switch n.kind {
+	case kRef:
+		if parserRule && isLexerName(n.text) && c.rules[n.text] == nil && n.text != c.skipRule {
+			c.note(n.line, "token %s is not defined by a lexer rule", n.text)
+		}
+		t.AddName(n.text)
+	case kLit:
+		t.AddString(escape(n.text))
+	case kSet:
+		t.AddClass(classText(n.set))
+	case kDot:
+		if parserRule {
+			c.note(n.line, "wildcard within parser rule matches any character, not any token")
+		}
+		t.AddDot()
+	case kEOF:
+		t.AddDot()
+		t.AddPeekNot()
+	case kAlt:
+		for i, sub := range n.subs {
+			c.emit(sub, parserRule)
+			if i > 0 {
+				t.AddAlternate()
+			}
+		}
+	case kSeq:
+		subs := c.resolveLazy(n.subs)
+		if len(subs) == 0 {
+			t.AddString("")
+		}
+		for i, sub := range subs {
+			c.emit(sub, parserRule)
+			if i > 0 {
+				t.AddSequence()
+			}
+		}
+	case kOpt, kStar, kPlus:
+		if n.lazy {
+			c.note(n.line, "non-greedy loop or option not followed by another element; translated as greedy")
+		}
+		c.emit(n.subs[0], parserRule)
+		switch n.kind {
+		case kOpt:
+			t.AddQuery()
+		case kStar:
+			t.AddStar()
+		default:
+			t.AddPlus()
+		}
+	case kNot:
+		if set := n.subs[0].set; set != nil {
+			var inv [256]bool
+			for i, in := range set {
+				inv[i] = !in
+			}
+			t.AddClass(classText(&inv))
+			break
+		}
+		c.emit(n.subs[0], parserRule)
+		t.AddPeekNot()
+		t.AddDot()
+		t.AddSequence()
+	case kPeekNot:
+		c.emit(n.subs[0], parserRule)
+		t.AddPeekNot()
+	}
+}
+
+// resolveLazy replaces non-greedy loops within a sequence, like
+// X*? Y, by greedy ones that stop at the following element: (!Y X)* Y
+func (c *converter) resolveLazy(subs []*node) []*node {
+	var out []*node
+	for i, sub := range subs {
+		if sub.lazy && i+1 < len(subs) && sub.kind != kOpt {
+			stop := &node{kind: kPeekNot, subs: []*node{subs[i+1]}}
+			sub = &node{kind: sub.kind, line: sub.line, subs: []*node{{kind: kSeq, subs: []*node{stop, sub.subs[0]}}}}
+		}
+		out = append(out, sub)
+	}
+	return out
+}
+
+var escapes = map[byte]string{'\t': `\t`, '\n': `\n`, '\r': `\r`}
+
+// escape returns a literal string as it is written between quotes
+// in peg and leg grammars, and in Go strings and runes. Octal escapes
+// are used for quotes and other special characters, as they are
+// understood by all of them.
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			b.WriteString(`\\`)
+		case escapes[c] != "":
+			b.WriteString(escapes[c])
+		case c < ' ' || c >= 0x7F || c == '\'' || c == '"':
+			fmt.Fprintf(&b, "\\%03o", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// classText returns the text of a class, as written between brackets.
+func classText(set *[256]bool) string {
+	char := func(c int) string {
+		switch {
+		case strings.IndexByte(`\]-`, byte(c)) != -1:
+			return `\` + string(rune(c))
+		case escapes[byte(c)] != "":
+			return escapes[byte(c)]
+		case c < ' ' || c >= 0x7F || c == '^':
+			return fmt.Sprintf("\\%03o", c)
+		}
+		return string(rune(c))
+	}
+	var b strings.Builder
+	for c := 0; c < 256; c++ {
+		if !set[c] {
+			continue
+		}
+		lo := c
+		for c+1 < 256 && set[c+1] {
+			c++
+		}
+		b.WriteString(char(lo))
+		if c > lo {
+			if c > lo+1 {
+				b.WriteByte('-')
+			}
+			b.WriteString(char(c))
+		}
+	}
+	return b.String()
+}
+
+type tokKind int
+
+const (
+	tEOF    tokKind = iota
+	tID             // identifier
+	tString         // literal, text holding the decoded bytes
+	tSet            // lexer char set, text holding the raw contents
+	tAction         // { ... }
+	tPred           // { ... }?
+	tPunct          // punctuation, like ':' or '->'
+)
+
+type token struct {
+	kind tokKind
+	text string
+	line int
+}
+
+type parser struct {
+	toks  []token
+	pos   int
+	rules []*rule
+	notes []Note
+}
+
+func (p *parser) note(line int, format string, a ...interface{}) {
+	p.notes = append(p.notes, Note{line, fmt.Sprintf(format, a...)})
+}
+
+var puncts = []string{"->", "+=", "::", "..", ":", ";", "|", "(", ")", "?", "*", "+", "~", ".", "=", ",", "#", "@", "<", ">", "$"}
+
+// scan splits the text of a grammar into tokens.
+func (p *parser) scan(s string) error {
+	line := 1
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f':
+			i++
+		case strings.HasPrefix(s[i:], "//"):
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(s[i:], "/*"):
+			end := strings.Index(s[i+2:], "*/")
+			if end == -1 {
+				return fmt.Errorf("%d: unterminated comment", line)
+			}
+			line += strings.Count(s[i:i+2+end], "\n")
+			i += 2 + end + 2
+		case c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z':
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || 'a' <= s[j] && s[j] <= 'z' || 'A' <= s[j] && s[j] <= 'Z' || '0' <= s[j] && s[j] <= '9') {
+				j++
+			}
+			p.toks = append(p.toks, token{tID, s[i:j], line})
+			i = j
+		case c == '\'':
+			j := i + 1
+			for j < len(s) && s[j] != '\'' && s[j] != '\n' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) || s[j] != '\'' {
+				return fmt.Errorf("%d: unterminated string literal", line)
+			}
+			text, err := unquote(s[i+1 : j])
+			if err != nil {
+				return fmt.Errorf("%d: %v", line, err)
+			}
+			p.toks = append(p.toks, token{tString, text, line})
+			i = j + 1
+		case c == '[':
+			j := i + 1
+			for j < len(s) && s[j] != ']' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return fmt.Errorf("%d: unterminated set", line)
+			}
+			p.toks = append(p.toks, token{tSet, s[i+1 : j], line})
+			line += strings.Count(s[i:j], "\n")
+			i = j + 1
+		case c == '{':
+			j, err := skipAction(s, i)
+			if err != nil {
+				return fmt.Errorf("%d: %v", line, err)
+			}
+			kind := tAction
+			if j < len(s) && s[j] == '?' {
+				kind = tPred
+				j++
+			}
+			p.toks = append(p.toks, token{kind, s[i:j], line})
+			line += strings.Count(s[i:j], "\n")
+			i = j
+		default:
+			found := false
+			for _, punct := range puncts {
+				if strings.HasPrefix(s[i:], punct) {
+					p.toks = append(p.toks, token{tPunct, punct, line})
+					i += len(punct)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("%d: unexpected character %q", line, c)
+			}
+		}
+	}
+	p.toks = append(p.toks, token{tEOF, "", line})
+	return nil
+}
+
+// skipAction returns the index following the action starting at s[i],
+// which may contain nested braces, and quoted strings.
+func skipAction(s string, i int) (int, error) {
+	depth := 0
+	for ; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth == 0 {
+				return i + 1, nil
+			}
+		case '"', '\'':
+			q := s[i]
+			for i++; i < len(s) && s[i] != q && s[i] != '\n'; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+		}
+	}
+	return 0, fmt.Errorf("unterminated action")
+}
+
+// unquote decodes the escape sequences of a literal; characters
+// outside of ASCII are encoded in UTF-8.
+func unquote(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		r, n, err := unescape(s[i+1:])
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(string(r))
+		i += n
+	}
+	return b.String(), nil
+}
+
+// unescape interprets the escape sequence at the start of s, which
+// follows a backslash, and returns the character, and the length
+// of the sequence.
+func unescape(s string) (r rune, n int, err error) {
+	if s == "" {
+		return 0, 0, fmt.Errorf("incomplete escape sequence")
+	}
+	switch s[0] {
+	case 'n':
+		return '\n', 1, nil
+	case 'r':
+		return '\r', 1, nil
+	case 't':
+		return '\t', 1, nil
+	case 'b':
+		return '\b', 1, nil
+	case 'f':
+		return '\f', 1, nil
+	case 'u':
+		hex := ""
+		if strings.HasPrefix(s, "u{") {
+			end := strings.IndexByte(s, '}')
+			if end == -1 {
+				return 0, 0, fmt.Errorf("invalid escape sequence \\%s", s)
+			}
+			hex, n = s[2:end], end+1
+		} else if len(s) >= 5 {
+			hex, n = s[1:5], 5
+		}
+		v, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil || !utf8.ValidRune(rune(v)) {
+			return 0, 0, fmt.Errorf("invalid escape sequence \\%s", s[:n])
+		}
+		return rune(v), n, nil
+	}
+	r, n = utf8.DecodeRuneInString(s)
+	return r, n, nil
+}
+
+func (p *parser) peek() token { return p.toks[p.pos] }
+
+func (p *parser) next() token {
+	tok := p.toks[p.pos]
+	if tok.kind != tEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// is reports whether the next token is a punctuation or keyword s.
+func (p *parser) is(s string) bool {
+	tok := p.peek()
+	return (tok.kind == tPunct || tok.kind == tID) && tok.text == s
+}
+
+func (p *parser) accept(s string) bool {
+	if p.is(s) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(s string) error {
+	if !p.accept(s) {
+		return p.errorf("%q expected", s)
+	}
+	return nil
+}
+
+func (p *parser) errorf(format string, a ...interface{}) error {
+	tok := p.peek()
+	found := tok.text
+	if tok.kind == tEOF {
+		found = "end of file"
+	}
+	return fmt.Errorf("%d: %s, found %q", tok.line, fmt.Sprintf(format, a...), found)
+}
+
+// skipTo advances up to, and including, the next token s.
+func (p *parser) skipTo(s string) {
+	for p.peek().kind != tEOF && !p.accept(s) {
+		p.pos++
+	}
+}
+
+func (p *parser) grammar() error {
+	_ = p.accept("lexer") || p.accept("parser")
+	if err := p.expect("grammar"); err != nil {
+		return err
+	}
+	if p.next().kind != tID {
+		return p.errorf("grammar name expected")
+	}
+	if err := p.expect(";"); err != nil {
+		return err
+	}
+	for p.peek().kind != tEOF {
+		tok := p.peek()
+		switch {
+		case p.is("options") || p.is("tokens") || p.is("channels"):
+			p.pos++
+			if p.next().kind != tAction {
+				return p.errorf("block expected")
+			}
+		case p.accept("import"):
+			p.note(tok.line, "imported grammars are not included")
+			p.skipTo(";")
+		case p.accept("@"):
+			p.note(tok.line, "named action dropped")
+			p.skipAction()
+		case p.accept("mode"):
+			p.note(tok.line, "lexer modes are not supported; the rules of mode %s are translated like the others", p.next().text)
+			p.skipTo(";")
+		default:
+			if err := p.rule(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// skipAction skips the name and the code of an action, like @init {...}.
+func (p *parser) skipAction() {
+	for p.peek().kind == tID || p.is("::") {
+		p.pos++
+	}
+	if p.peek().kind == tAction {
+		p.pos++
+	}
+}
+
+func (p *parser) rule() error {
+	p.accept("fragment")
+	tok := p.next()
+	if tok.kind != tID {
+		return p.errorf("rule name expected")
+	}
+	r := &rule{name: tok.text, line: tok.line}
+	// arguments, return values, local variables, options, and actions
+	for !p.is(":") {
+		switch t := p.peek(); {
+		case t.kind == tEOF:
+			return p.errorf("':' expected")
+		case t.kind == tSet:
+			p.note(t.line, "rule %s: arguments, return values and local variables dropped", r.name)
+		case p.is("@"):
+			p.note(t.line, "rule %s: action dropped", r.name)
+			p.pos++
+			p.skipAction()
+			continue
+		}
+		p.pos++
+	}
+	p.pos++
+	body, err := p.alternatives(r)
+	if err != nil {
+		return err
+	}
+	r.body = body
+	if err := p.expect(";"); err != nil {
+		return err
+	}
+	for p.is("catch") || p.is("finally") {
+		p.note(p.peek().line, "rule %s: exception handler dropped", r.name)
+		for p.pos++; p.peek().kind == tSet || p.peek().kind == tAction; p.pos++ {
+		}
+	}
+	p.rules = append(p.rules, r)
+	return nil
+}
+
+func (p *parser) alternatives(r *rule) (*node, error) {
+	var alts []*node
+	for {
+		a, err := p.alternative(r)
+		if err != nil {
+			return nil, err
+		}
+		alts = append(alts, a)
+		if !p.accept("|") {
+			break
+		}
+	}
+	return alternatives(alts), nil
+}
+
+func (p *parser) alternative(r *rule) (*node, error) {
+	seq := &node{kind: kSeq, line: p.peek().line}
+	for !p.is("|") && !p.is(";") && !p.is(")") && !p.is("#") && !p.is("->") && p.peek().kind != tEOF {
+		n, err := p.element(r)
+		if err != nil {
+			return nil, err
+		}
+		if n != nil {
+			seq.subs = append(seq.subs, n)
+		}
+	}
+	if p.accept("#") {
+		p.next()
+	}
+	if p.accept("->") {
+		p.commands(r)
+	}
+	if len(seq.subs) == 1 {
+		return seq.subs[0], nil
+	}
+	return seq, nil
+}
+
+// commands interprets the commands of a lexer rule, like -> skip.
+func (p *parser) commands(r *rule) {
+	for {
+		tok := p.next()
+		switch tok.text {
+		case "skip", "channel":
+			r.skip = true
+		default:
+			p.note(tok.line, "rule %s: lexer command %s dropped", r.name, tok.text)
+		}
+		if p.accept("(") {
+			p.skipTo(")")
+		}
+		if !p.accept(",") {
+			break
+		}
+	}
+}
+
+func (p *parser) element(r *rule) (*node, error) {
+	tok := p.peek()
+	switch tok.kind {
+	case tAction:
+		p.pos++
+		p.note(tok.line, "rule %s: action dropped", r.name)
+		return nil, nil
+	case tPred:
+		p.pos++
+		p.note(tok.line, "rule %s: semantic predicate dropped", r.name)
+		return nil, nil
+	case tID:
+		if next := p.toks[p.pos+1]; next.kind == tPunct && (next.text == "=" || next.text == "+=") {
+			p.pos += 2 // labels are not needed
+		}
+	}
+	n, err := p.atom(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, suffix := range []struct {
+		text string
+		kind kind
+	}{{"?", kOpt}, {"*", kStar}, {"+", kPlus}} {
+		if p.accept(suffix.text) {
+			n = &node{kind: suffix.kind, subs: []*node{n}, line: tok.line}
+			n.lazy = p.accept("?")
+			break
+		}
+	}
+	return n, nil
+}
+
+func (p *parser) atom(r *rule) (*node, error) {
+	tok := p.next()
+	switch {
+	case tok.kind == tID:
+		if p.accept("<") {
+			p.skipTo(">")
+		}
+		if tok.text == "EOF" {
+			return &node{kind: kEOF, line: tok.line}, nil
+		}
+		return &node{kind: kRef, text: tok.text, line: tok.line}, nil
+	case tok.kind == tString:
+		if p.accept("..") {
+			hi := p.next()
+			if hi.kind != tString {
+				return nil, p.errorf("string literal expected")
+			}
+			lo, _ := utf8.DecodeRuneInString(tok.text)
+			up, _ := utf8.DecodeRuneInString(hi.text)
+			return p.charSet(r, tok.line, [][2]rune{{lo, up}}), nil
+		}
+		return &node{kind: kLit, text: tok.text, line: tok.line}, nil
+	case tok.kind == tSet:
+		ranges, err := setRanges(tok.text)
+		if err != nil {
+			return nil, fmt.Errorf("%d: %v", tok.line, err)
+		}
+		return p.charSet(r, tok.line, ranges), nil
+	case tok.kind == tPunct && tok.text == ".":
+		return &node{kind: kDot, line: tok.line}, nil
+	case tok.kind == tPunct && tok.text == "~":
+		n, err := p.atom(r)
+		if err != nil {
+			return nil, err
+		}
+		if n.kind == kLit && utf8.RuneCountInString(n.text) == 1 {
+			c, _ := utf8.DecodeRuneInString(n.text)
+			n = p.charSet(r, n.line, [][2]rune{{c, c}})
+		} else if n.kind == kAlt {
+			n = p.mergeSets(r, n)
+		}
+		return &node{kind: kNot, subs: []*node{n}, line: tok.line}, nil
+	case tok.kind == tPunct && tok.text == "(":
+		if p.is("options") {
+			p.note(tok.line, "rule %s: options of a subrule dropped", r.name)
+			p.skipTo(":")
+		}
+		n, err := p.alternatives(r)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+	p.pos--
+	return nil, p.errorf("rule element expected")
+}
+
+// mergeSets returns a single set for alternatives that all
+// consist of sets, or single characters, or n otherwise.
+func (p *parser) mergeSets(r *rule, n *node) *node {
+	set := new([256]bool)
+	for _, sub := range n.subs {
+		switch {
+		case sub.kind == kSet:
+			for i, in := range sub.set {
+				set[i] = set[i] || in
+			}
+		case sub.kind == kLit && len(sub.text) == 1:
+			set[sub.text[0]] = true
+		default:
+			return n
+		}
+	}
+	return &node{kind: kSet, set: set, line: n.line}
+}
+
+// charSet returns a set node for character ranges. As rules
+// operate on bytes, characters outside of ASCII are approximated
+// by the set of all non-ASCII bytes.
+func (p *parser) charSet(r *rule, line int, ranges [][2]rune) *node {
+	set := new([256]bool)
+	wide := false
+	for _, rg := range ranges {
+		for c := rg[0]; c <= rg[1]; c++ {
+			if c >= 0x80 {
+				wide = true
+				break
+			}
+			set[c] = true
+		}
+	}
+	if wide {
+		p.note(line, "rule %s: non-ASCII characters of a set approximated by any non-ASCII byte", r.name)
+		for c := 0x80; c < 0x100; c++ {
+			set[c] = true
+		}
+	}
+	return &node{kind: kSet, set: set, line: line}
+}
+
+// setRanges interprets the contents of a lexer char set, like a-z\n.
+func setRanges(s string) (ranges [][2]rune, err error) {
+	char := func(i int) (rune, int, error) {
+		if s[i] == '\\' {
+			if strings.HasPrefix(s[i+1:], "p{") || strings.HasPrefix(s[i+1:], "P{") {
+				end := strings.IndexByte(s[i:], '}')
+				if end == -1 {
+					return 0, 0, fmt.Errorf("invalid property in set")
+				}
+				// Unicode properties are approximated as non-ASCII
+				return 0x80, i + end + 1, nil
+			}
+			r, n, err := unescape(s[i+1:])
+			return r, i + 1 + n, err
+		}
+		r, n := utf8.DecodeRuneInString(s[i:])
+		return r, i + n, nil
+	}
+	for i := 0; i < len(s); {
+		lo, j, err := char(i)
+		if err != nil {
+			return nil, err
+		}
+		hi := lo
+		if j+1 < len(s) && s[j] == '-' {
+			if hi, j, err = char(j + 1); err != nil {
+				return nil, err
+			}
+		}
+		ranges = append(ranges, [2]rune{lo, hi})
+		i = j
+	}
+	return
+}
@@ -0,0 +1,99 @@
+package peg
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+/*
+A Backend generates output from a grammar tree, like a parser in
+some language, or the results of an analysis. Backends are
+registered with RegisterBackend, and selected by their names, e.g.
+using option -lang of the generators. A Backend should not
+modify the tree, apart from compiling it, as Compile does.
+*/
+type Backend interface {
+	// Name returns the name the backend is registered with.
+	Name() string
+
+	// Generate writes the output for the tree to w.
+	Generate(t *Tree, o Options, w io.Writer) error
+}
+
+// Options are passed to Backend.Generate.
+type Options struct {
+	// Flags enabling optimizations, as accepted by Compile.
+	Optimizations string
+
+	// If Parts is not empty, backends able to split their output,
+	// like the one named "go", distribute it across these writers,
+	// as described at CompileParts.
+	Parts []io.Writer
+
+	// If Report is not nil, backends compiling the tree, like the
+	// one named "go", store the report of the compilation there.
+	Report *Report
+}
+
+var backends = make(map[string]Backend)
+
+// RegisterBackend makes a backend available by its name.
+// It panics, if a backend of the same name has already been
+// registered.
+func RegisterBackend(b Backend) {
+	name := b.Name()
+	if _, dup := backends[name]; dup {
+		panic(fmt.Sprintf("peg: backend %q registered twice", name))
+	}
+	backends[name] = b
+}
+
+// LookupBackend returns the backend registered with name.
+func LookupBackend(name string) (b Backend, ok bool) {
+	b, ok = backends[name]
+	return
+}
+
+// BackendNames returns the sorted names of the registered backends.
+func BackendNames() (names []string) {
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// The builtin backends: the Go parser generated by CompileParts,
+// and the recognizers generated by CompileJS.
+type (
+	goBackend struct{}
+	jsBackend struct{ ts bool }
+)
+
+func (goBackend) Name() string { return "go" }
+
+func (goBackend) Generate(t *Tree, o Options, w io.Writer) error {
+	r, err := t.CompileParts(w, o.Parts, o.Optimizations)
+	if o.Report != nil {
+		*o.Report = *r
+	}
+	return err
+}
+
+func (b jsBackend) Name() string {
+	if b.ts {
+		return "ts"
+	}
+	return "js"
+}
+
+func (b jsBackend) Generate(t *Tree, o Options, w io.Writer) error {
+	return t.CompileJS(w, b.ts)
+}
+
+func init() {
+	RegisterBackend(goBackend{})
+	RegisterBackend(jsBackend{ts: false})
+	RegisterBackend(jsBackend{ts: true})
+}
@@ -7,6 +7,7 @@ package main
 import (
 	"bufio"
 	"github.com/knieriem/peg"
+	"log"
 	"os"
 	"runtime"
 )
@@ -29,6 +30,9 @@ func main() {
 	/* Grammar         <- Spacing 'package' Spacing Identifier      { p.Define("package", yytext) }
 	   'type' Spacing Identifier         { p.Define("Peg", yytext) }
 	   'Peg' Spacing Action              { p.Define("userstate", yytext) }
+	   ('type' Spacing 'YYSTYPE' Spacing
+	        GoType                       { p.Define("yystype", yytext) }
+	   )?
 	   commit
 	   Definition+ EndOfFile */
 	t.AddRule("Grammar")
@@ -57,6 +61,19 @@ func main() {
 	t.AddSequence()
 	t.AddAction(` p.Define("userstate", yytext) `)
 	t.AddSequence()
+	t.AddString("type")
+	t.AddName("Spacing")
+	t.AddSequence()
+	t.AddString("YYSTYPE")
+	t.AddSequence()
+	t.AddName("Spacing")
+	t.AddSequence()
+	t.AddName("GoType")
+	t.AddSequence()
+	t.AddAction(` p.Define("yystype", yytext) `)
+	t.AddSequence()
+	t.AddQuery()
+	t.AddSequence()
 	t.AddCommit()
 	t.AddSequence()
 	t.AddName("Definition")
@@ -66,11 +83,11 @@ func main() {
 	t.AddSequence()
 	t.AddExpression()
 
-	/* Definition      <- Identifier                   { p.AddRule(yytext) }
+	/* Definition      <- Identifier                   { p.AddRule(yytext); p.SetRulePos(p.Buffer, begin) }
 	   LEFTARROW Expression         { p.AddExpression() } &(Identifier LEFTARROW / !.) commit */
 	t.AddRule("Definition")
 	t.AddName("Identifier")
-	t.AddAction(" p.AddRule(yytext) ")
+	t.AddAction(" p.AddRule(yytext); p.SetRulePos(p.Buffer, begin) ")
 	t.AddSequence()
 	t.AddName("LEFTARROW")
 	t.AddSequence()
@@ -171,6 +188,8 @@ func main() {
 	t.AddExpression()
 
 	/* Primary         <- 'commit' Spacing             { p.AddCommit() }
+	   / Identifier                   { p.AddVariable(yytext) }
+	       COLON Identifier !LEFTARROW  { p.AddName(yytext) }
 	   / Identifier !LEFTARROW        { p.AddName(yytext) }
 	   / OPEN Expression CLOSE
 	   / Literal                      { p.AddString(yytext) }
@@ -186,6 +205,19 @@ func main() {
 	t.AddAction(" p.AddCommit() ")
 	t.AddSequence()
 	t.AddName("Identifier")
+	t.AddAction(" p.AddVariable(yytext) ")
+	t.AddSequence()
+	t.AddName("COLON")
+	t.AddSequence()
+	t.AddName("Identifier")
+	t.AddSequence()
+	t.AddName("LEFTARROW")
+	t.AddPeekNot()
+	t.AddSequence()
+	t.AddAction(" p.AddName(yytext) ")
+	t.AddSequence()
+	t.AddAlternate()
+	t.AddName("Identifier")
 	t.AddName("LEFTARROW")
 	t.AddPeekNot()
 	t.AddSequence()
@@ -250,6 +282,25 @@ func main() {
 	t.AddAlternate()
 	t.AddExpression()
 
+	/* GoType          <- < '*'? IdentStart (IdentCont / '.')* > Spacing */
+	t.AddRule("GoType")
+	t.AddBegin()
+	t.AddString("*")
+	t.AddQuery()
+	t.AddSequence()
+	t.AddName("IdentStart")
+	t.AddSequence()
+	t.AddName("IdentCont")
+	t.AddString(".")
+	t.AddAlternate()
+	t.AddStar()
+	t.AddSequence()
+	t.AddEnd()
+	t.AddSequence()
+	t.AddName("Spacing")
+	t.AddSequence()
+	t.AddExpression()
+
 	/* Literal         <- ['] < (!['] Char )* > ['] Spacing
 	   / ["] < (!["] Char )* > ["] Spacing */
 	t.AddRule("Literal")
@@ -358,6 +409,13 @@ func main() {
 	t.AddSequence()
 	t.AddExpression()
 
+	/* COLON           <- ':' Spacing */
+	t.AddRule("COLON")
+	t.AddString(":")
+	t.AddName("Spacing")
+	t.AddSequence()
+	t.AddExpression()
+
 	/* SLASH           <- '/' Spacing */
 	t.AddRule("SLASH")
 	t.AddString("/")
@@ -497,6 +555,10 @@ func main() {
 	t.AddExpression()
 
 	w := bufio.NewWriter(os.Stdout)
-	t.Compile(w, "all")
+	r, err := t.Compile(w, "all")
+	r.WriteText(os.Stderr, false)
+	if err != nil {
+		log.Fatal(err)
+	}
 	w.Flush()
 }
@@ -0,0 +1,100 @@
+package peg
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Version is the version of the parser generator. It is stamped
+// into generated files, and should be incremented whenever the
+// generated code changes for an unchanged grammar.
+const Version = "1"
+
+// CheckGenerated compares freshly generated parser code with the
+// contents of an existing file, like a checked-in bootstrap parser.
+// If both differ, the returned error tells the first line that
+// does not match.
+func CheckGenerated(file string, generated []byte) (err error) {
+	old, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	if bytes.Equal(old, generated) {
+		return
+	}
+	line := 1
+	for i := 0; i < len(old) && i < len(generated); i++ {
+		if old[i] != generated[i] {
+			break
+		}
+		if old[i] == '\n' {
+			line++
+		}
+	}
+	return fmt.Errorf("generated code differs from %s, starting at line %d", file, line)
+}
+
+/*
+Hash returns a hash of the grammar contained in the tree, which must
+not have been compiled yet, and of the options affecting the generated
+code. Since it is computed from the canonical form of the grammar,
+as written by WriteGrammar, changes to comments or layout don't
+affect the result.
+*/
+func (t *Tree) Hash(optiFlags string) string {
+	h := sha256.New()
+	var names []string
+	for name := range t.defines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "%s=%q\n", name, t.defines[name])
+	}
+	fmt.Fprintf(h, "inline=%v switch=%v O=%q\n", t.inline, t._switch, optiFlags)
+	t.WriteGrammar(h, true)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// stamp returns the first line of generated files, containing
+// the generator version and the grammar hash.
+func stamp(hash string) string {
+	return fmt.Sprintf("// Code generated by peg version %s from grammar %s; DO NOT EDIT.\n\n", Version, hash)
+}
+
+/*
+Verify reports whether file, which has been generated earlier from
+the grammar contained in the tree, using the same options, is up to
+date. Only the stamp in the first line of the file is examined, so
+this is much cheaper than a comparison with the freshly generated
+code. If file is stale, the returned error tells why. Like Hash,
+Verify must be called before the tree is compiled.
+*/
+func (t *Tree) Verify(file, optiFlags string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && line == "" {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	var version, hash string
+	_, err = fmt.Sscanf(strings.TrimSuffix(line, "; DO NOT EDIT.\n"), "// Code generated by peg version %s from grammar %s", &version, &hash)
+	switch {
+	case err != nil:
+		return fmt.Errorf("%s: no version stamp found", file)
+	case version != Version:
+		return fmt.Errorf("%s is stale: generated by version %s, current version is %s", file, version, Version)
+	case hash != t.Hash(optiFlags):
+		return fmt.Errorf("%s is stale: grammar or options have changed", file)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package peg
+
+import (
+	"fmt"
+)
+
+/*
+A CharacterClass is a set of bytes, as described by a character
+class of a grammar, like [a-z_]. Importers, and linters, may get
+classes using ParseClass, and compare, or print them.
+*/
+type CharacterClass [32]uint8
+
+func (c *CharacterClass) copy() (class *CharacterClass) {
+	class = new(CharacterClass)
+	copy(class[0:], c[0:])
+	return
+}
+func (c *CharacterClass) add(character uint8)      { c[character>>3] |= (1 << (character & 7)) }
+func (c *CharacterClass) has(character uint8) bool { return c[character>>3]&(1<<(character&7)) != 0 }
+func (c *CharacterClass) complement() {
+	for i := range *c {
+		c[i] = ^c[i]
+	}
+}
+func (c *CharacterClass) union(class *CharacterClass) {
+	for index, value := range *class {
+		c[index] |= value
+	}
+}
+func (c *CharacterClass) intersection(class *CharacterClass) {
+	for index, value := range *class {
+		c[index] &= value
+	}
+}
+func (c *CharacterClass) contains(class *CharacterClass) bool {
+	for index, value := range *class {
+		if value&^c[index] != 0 {
+			return false
+		}
+	}
+	return true
+}
+func (c *CharacterClass) len() (length int) {
+	for character := 0; character < 256; character++ {
+		if c.has(uint8(character)) {
+			length++
+		}
+	}
+	return
+}
+
+// Contains reports whether the byte b is a member of the class.
+func (c *CharacterClass) Contains(b byte) bool { return c.has(b) }
+
+// Iterate calls f for each range of consecutive members of the class,
+// from the lowest byte to the highest one, passing the first and the
+// last member of the range, which are the same for a single byte.
+func (c *CharacterClass) Iterate(f func(from, to byte)) {
+	for character := 0; character < 256; {
+		if !c.has(uint8(character)) {
+			character++
+			continue
+		}
+		from := character
+		for character < 256 && c.has(uint8(character)) {
+			character++
+		}
+		f(uint8(from), uint8(character-1))
+	}
+}
+
+/*
+String returns the text of the class, as written between brackets
+in a grammar, so that ParseClass returns the same set again. Ranges
+of more than two bytes are written as such. Bytes that are special
+within a class, like ']', '-', and a leading '^', and control and
+non-ASCII bytes, are escaped.
+*/
+func (c *CharacterClass) String() (class string) {
+	escape := func(c uint8) string {
+		s := ""
+		switch c {
+		case '\a':
+			s = `\a` /* bel */
+		case '\b':
+			s = `\b` /* bs */
+		case '\f':
+			s = `\f` /* ff */
+		case '\n':
+			s = `\n` /* nl */
+		case '\r':
+			s = `\r` /* cr */
+		case '\t':
+			s = `\t` /* ht */
+		case '\v':
+			s = `\v` /* vt */
+		case '\'':
+			s = `\'` /* ' */
+		case '"':
+			s = `\"` /* " */
+		case '[':
+			s = `\[` /* [ */
+		case ']':
+			s = `\]` /* ] */
+		case '\\':
+			s = `\\` /* \ */
+		case '-':
+			s = `\-` /* - */
+		default:
+			switch {
+			case c < 32 || c >= 0x80:
+				s = fmt.Sprintf("\\%03o", c)
+			default:
+				s = fmt.Sprintf("%c", c)
+			}
+		}
+		return s
+	}
+	c.Iterate(func(from, to byte) {
+		if from == '^' && class == "" {
+			// would negate the class
+			class = `\136`
+		} else {
+			class += escape(from)
+		}
+		switch {
+		case from == to:
+		case to == from+1:
+			class += escape(to)
+		default:
+			class += "-" + escape(to)
+		}
+	})
+	return
+}
+
+// ParseClass returns the set of characters described by the
+// text of a class, as written between brackets.
+func ParseClass(text string) *CharacterClass {
+	c := new(CharacterClass)
+	inverse := false
+	if text != "" && text[0] == '^' {
+		inverse = true
+		text = text[1:]
+	}
+	// next returns the possibly escaped character at text[i:],
+	// and the index following it
+	next := func(i int) (byte, int) {
+		if text[i] == '\\' && i+1 < len(text) {
+			b, n := unescapeByte(text[i+1:])
+			return b, i + 1 + n
+		}
+		return text[i], i + 1
+	}
+	for i := 0; i < len(text); {
+		var lo, hi byte
+		lo, i = next(i)
+		if i+1 < len(text) && text[i] == '-' {
+			hi, i = next(i + 1)
+			for j := int(lo); j <= int(hi); j++ {
+				c.add(byte(j))
+			}
+			continue
+		}
+		c.add(lo)
+	}
+	if inverse {
+		c.complement()
+	}
+	return c
+}
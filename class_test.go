@@ -0,0 +1,40 @@
+package peg
+
+import "testing"
+
+func TestClassRoundTrip(t *testing.T) {
+	full := new(CharacterClass)
+	full.complement()
+	for _, test := range []struct {
+		name  string
+		class *CharacterClass
+	}{
+		{"empty", new(CharacterClass)},
+		{"full", full},
+		{"letters", ParseClass("a-zA-Z_")},
+		{"leading caret", ParseClass(`\^a`)},
+		{"caret range", ParseClass(`\^-a`)},
+		{"caret later", ParseClass(`a^`)},
+		{"bracket", ParseClass(`\]`)},
+		{"brackets", ParseClass(`\[\]`)},
+		{"dash", ParseClass(`\-`)},
+		{"dash and letters", ParseClass(`a\-z`)},
+		{"backslash", ParseClass(`\\`)},
+		{"specials", ParseClass(`\]\-\\^`)},
+		{"quotes", ParseClass(`'"`)},
+		{"control", ParseClass(`\000-\037\177`)},
+		{"range to 255", ParseClass(`\200-\377`)},
+		{"pair at 255", ParseClass(`\376\377`)},
+		{"single 255", ParseClass(`\377`)},
+		{"range from 0", ParseClass(`\000-a`)},
+		{"negated", ParseClass(`^a-z`)},
+		{"negated specials", ParseClass(`^\]\-\\`)},
+		{"negated range to 255", ParseClass(`^\200-\377`)},
+		{"negated empty", ParseClass(`^`)},
+	} {
+		s := test.class.String()
+		if c := ParseClass(s); *c != *test.class {
+			t.Errorf("%s: ParseClass(%q) differs from the class", test.name, s)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+/*
+Package cli implements the command line interface shared by the peg
+and leg commands, which only differ in the syntax of the grammars
+they read. The interface consists of several subcommands:
+
+	gen	generate a parser (default, if no subcommand is given)
+	fmt	print a grammar in a canonical layout
+	export	print a grammar in the syntax of another parser generator
+	convert	print a peg grammar in leg syntax, or a leg grammar in peg syntax
+	lint	report problems of a grammar
+	viz	print the rule graph of a grammar in Graphviz dot format
+	test	match input files against a grammar
+	import	convert an ANTLR v4 grammar
+	reduce	minimize a grammar and an input reproducing a problem
+*/
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"github.com/knieriem/peg"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// A Parser adds the rules of a grammar text to t.
+type Parser func(t *peg.Tree, grammar string) error
+
+// A Syntax describes the grammar language of a command.
+type Syntax struct {
+	Name  string // name of the command, like "peg"
+	Leg   bool   // grammars are written in leg syntax
+	Parse Parser
+}
+
+type command struct {
+	name, args, help string
+	run              func(s *Syntax, c *command, args []string)
+	flags            *flag.FlagSet
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{name: "gen", args: "FILE", help: "generate a parser", run: gen},
+		{name: "fmt", args: "FILE", help: "print a grammar in a canonical layout", run: format},
+		{name: "export", args: "FILE", help: "print a grammar in the syntax of another parser generator", run: export},
+		{name: "convert", args: "FILE", help: "print a peg grammar in leg syntax, or a leg grammar in peg syntax", run: convert},
+		{name: "lint", args: "FILE...", help: "report problems of grammars", run: lint},
+		{name: "viz", args: "FILE", help: "print the rule graph in Graphviz dot format", run: viz},
+		{name: "test", args: "FILE INPUT...", help: "match input files against a grammar", run: test},
+		{name: "import", args: "FILE.g4", help: "convert an ANTLR v4 grammar", run: importGrammar},
+		{name: "reduce", args: "-test COMMAND FILE INPUT", help: "minimize a grammar and an input reproducing a problem", run: reduce},
+	}
+}
+
+// options common to all subcommands
+var (
+	inline, _switch bool
+	verbose         bool
+	flags           flagList
+	report          = reportFormat("text")
+)
+
+// A flagList collects the flags set by options -D, to be tested
+// by %if sections of a grammar.
+type flagList []string
+
+func (l *flagList) String() string { return strings.Join(*l, ",") }
+
+func (l *flagList) Set(s string) error {
+	if name := strings.TrimSuffix(strings.TrimSuffix(s, "=0"), "=1"); name == "" || strings.ContainsAny(name, "=!") {
+		return fmt.Errorf("invalid flag %q", s)
+	}
+	*l = append(*l, s)
+	return nil
+}
+
+// apply sets the flags in t; a flag `NAME=0` is turned off.
+func (l flagList) apply(t *peg.Tree) {
+	for _, s := range l {
+		if name := strings.TrimSuffix(s, "=0"); name != s {
+			t.SetFlag(name, false)
+		} else {
+			t.SetFlag(strings.TrimSuffix(s, "=1"), true)
+		}
+	}
+}
+
+// A reportFormat selects how the report of compiling a grammar,
+// containing its warnings, is written to stderr, using option -report.
+type reportFormat string
+
+func (f *reportFormat) String() string { return string(*f) }
+
+func (f *reportFormat) Set(s string) error {
+	switch s {
+	case "text", "json", "none":
+		*f = reportFormat(s)
+		return nil
+	}
+	return fmt.Errorf("invalid format %q", s)
+}
+
+// write renders r on stderr; with option -verbose, the text
+// includes the statistics.
+func (f reportFormat) write(r *peg.Report) {
+	var err error
+	switch f {
+	case "text":
+		err = r.WriteText(os.Stderr, verbose)
+	case "json":
+		err = r.WriteJSON(os.Stderr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (c *command) init(s *Syntax) {
+	c.flags = flag.NewFlagSet(s.Name+" "+c.name, flag.ExitOnError)
+	c.flags.BoolVar(&inline, "inline", false, "parse rule inlining")
+	c.flags.BoolVar(&_switch, "switch", false, "replace if-else if-else like blocks with switch blocks")
+	c.flags.Var(&flags, "D", "turn on flag `NAME`, or turn it off, if given as NAME=0, overriding a %define in the grammar")
+	c.flags.BoolVar(&verbose, "verbose", false, "enable additional output, like statistics")
+	c.flags.Var(&report, "report", "write the warnings, and statistics, of compiling a grammar in `FORMAT`, one of text, json, or none")
+	c.flags.BoolVar(&peg.WarnLeftRecursion, "warnleftrec", false, "only warn about left recursive rules, instead of failing")
+	c.flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s %s [options] %s\n", s.Name, c.name, c.args)
+		c.flags.PrintDefaults()
+	}
+}
+
+// usage prints the usage message of c, and exits.
+func (c *command) usage() {
+	c.flags.Usage()
+	os.Exit(2)
+}
+
+/*
+Main runs the command described by s, using the command line
+arguments. If the first argument is not the name of a subcommand,
+gen is assumed, so that the command line options of earlier
+versions continue to work.
+*/
+func Main(s *Syntax) {
+	runtime.GOMAXPROCS(2)
+	log.SetFlags(0)
+	log.SetPrefix(s.Name + ": ")
+
+	args := os.Args[1:]
+	c := commands[0]
+	if len(args) > 0 {
+		if args[0] == "help" {
+			help(s)
+			return
+		}
+		for _, cmd := range commands {
+			if cmd.name == args[0] {
+				c, args = cmd, args[1:]
+				break
+			}
+		}
+	}
+	c.init(s)
+	c.run(s, c, args)
+}
+
+func help(s *Syntax) {
+	fmt.Fprintf(os.Stderr, "usage: %s [command] [options] FILE...\n\nCommands:\n", s.Name)
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "\t%s\t%s\n", c.name, c.help)
+	}
+	fmt.Fprintf(os.Stderr, "\nUse \"%s command -h\" for the options of a command.\n", s.Name)
+}
+
+// load reads and parses a grammar file, and the grammars it imports.
+func (s *Syntax) load(file string) *peg.Tree {
+	return s.loadImports(file, nil)
+}
+
+// loadImports loads a grammar file, which may be imported by the
+// files in chain, like load.
+func (s *Syntax) loadImports(file string, chain []string) *peg.Tree {
+	for _, f := range chain {
+		if f == file {
+			log.Fatalf("%s: import cycle: %s -> %s", chain[0], strings.Join(chain, " -> "), file)
+		}
+	}
+	var b []byte
+	var err error
+	if peg.IsStdFile(file) {
+		b, err = peg.ReadStdFile(file)
+	} else {
+		b, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	t, err := s.loadText(string(b))
+	if err != nil {
+		// prefix each line, as the tree may report several errors
+		log.Fatal(file + ":" + strings.Replace(err.Error(), "\n", "\n"+file+":", -1))
+	}
+	t.AddFile(file)
+	for _, imp := range t.Imports() {
+		path := imp.File
+		if !filepath.IsAbs(path) && !peg.IsStdFile(path) {
+			path = filepath.Join(filepath.Dir(file), path)
+		}
+		if err := t.Import(s.loadImports(path, append(chain, file)), imp.Namespace); err != nil {
+			log.Fatal(file + ": " + err.Error())
+		}
+	}
+	return t
+}
+
+// loadText parses the text of a grammar. It matches the
+// signature of playground.Loader.
+func (s *Syntax) loadText(grammar string) (*peg.Tree, error) {
+	t := peg.New(inline, _switch)
+	flags.apply(t)
+	if err := s.Parse(t, grammar); err != nil {
+		return nil, err
+	}
+	if err := t.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
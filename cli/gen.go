@@ -0,0 +1,306 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/knieriem/peg"
+	"github.com/knieriem/peg/playground"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func gen(s *Syntax, c *command, args []string) {
+	f := c.flags
+	var (
+		optiFlags = f.String("O", "", "turn on various optimizations")
+		selfCheck = f.String("selfcheck", "", "compare the generated code with the contents of `GOFILE` instead of printing it")
+		verify    = f.String("verify", "", "only check whether `GOFILE` has been generated from the current grammar and options")
+		serve     = f.String("serve", "", "run a web playground at `ADDR`, FILE being optional")
+		deps      = f.String("deps", "", "write the grammar files the output depends on in make syntax to `DFILE`")
+		raceCheck = f.String("racecheck", "", "also write a test to `TESTFILE`, that parses the files in testdata/racecheck concurrently, to be run using go test -race")
+		output    = f.String("o", "", "write the generated code to `GOFILE` instead of stdout")
+		prefix    = f.String("prefix", "", "prefix for generated identifiers, replacing \"yy\"")
+		ruleStack = f.Bool("rulestack", false, "record the rules active at the position of a parse error")
+		bom       = f.Bool("bom", false, "skip a UTF-8 byte order mark at the start of the input")
+		crlf      = f.Bool("crlf", false, "count \\r\\n as a single newline in error positions")
+		parseFile = f.Bool("parsefile", false, "generate a ParseFile method, which memory-maps its input")
+		memo      = f.Bool("memo", false, "memoize the results of rules, keeping at most MemoLimit of them")
+		trace     = f.Bool("trace", false, "report calls of Parse, and applications of rules marked with @trace, to a Tracer")
+		metrics   = f.Bool("metrics", false, "count the applications of rules, and measure the duration of Parse, reporting them to a MetricsSink")
+		iterative = f.Bool("iterative", false, "generate rules that return to their callers using an explicit stack, so that the Go stack does not grow with the nesting of the input")
+		partial   = f.Bool("partial", false, "commit after each item of a repetition in the start rule, so that the actions of the items preceding an error are executed")
+		ambiguity = f.Bool("ambiguity", false, "count how often a later branch of an ordered choice would have matched too, as reported by method Ambiguities")
+		recognize = f.Bool("recognize", false, "generate a recognizer, dropping actions, commits, captures, and semantic values, whose method Recognize reports the consumed length")
+		captures  = f.Bool("captures", false, "replace the actions by ones recording the text matched by captures < > in field Captures of the parser")
+		generics  = f.Bool("generics", false, "generate function ParseAs, which returns the semantic value of the start rule like method ParseValue, but as a given type, using type parameters of Go 1.18")
+		inlined   = f.Bool("inlinereport", false, "report the rules inlined on stderr, together with the rules they have been inlined into")
+		undo      = f.Bool("undo", false, "generate OnBacktrack, which registers functions called on backtracking")
+		spans     = f.String("spans", "", "record the text spans matched by captures, if `MODE` is \"captures\", or also by rules, if it is \"rules\", or by token rules, if it is \"tokens\"")
+		commit    = f.String("commit", "", "if `MODE` is \"nested\", let commits within nested rules execute pending actions too")
+		empty     = f.String("empty", "", "if `MODE` is \"noteof\", let the empty literal \"\" fail at the end of the input, instead of always matching")
+		maxDepth  = f.Int("maxdepth", 0, "let Parse fail with ErrTooDeep, instead of overflowing the stack, if more than `N` rules are nested (adjustable using MaxDepth)")
+		thunks    = f.Int("thunks", 0, "initial length `N` of the queue of actions, which doubles if needed (default 32)")
+		values    = f.Int("values", 0, "initial length `N` of the stack of semantic values, which doubles if needed (default 256)")
+		split     = f.Int("split", 0, "distribute the rules across `N` additional files, named like GOFILE, with suffixes _rules1.go, ...")
+		lang      = f.String("lang", "go", "generate the output using backend `LANG`, one of "+strings.Join(peg.BackendNames(), ", ")+"; js and ts generate recognizers in JavaScript and TypeScript")
+	)
+	f.Parse(args)
+
+	if *serve != "" && f.NArg() <= 1 {
+		var example []byte
+		if f.NArg() == 1 {
+			b, err := ioutil.ReadFile(f.Arg(0))
+			if err != nil {
+				log.Fatal(err)
+			}
+			example = b
+		}
+		log.Fatal(http.ListenAndServe(*serve, playground.Handler(s.loadText, string(example))))
+	}
+	if f.NArg() != 1 {
+		c.usage()
+	}
+	file := f.Arg(0)
+
+	t := s.load(file)
+	if *prefix != "" {
+		t.Define("prefix", *prefix)
+	}
+	switch *spans {
+	case "":
+	case "captures", "rules", "tokens":
+		t.Define("spans", *spans)
+	default:
+		log.Fatalf("invalid -spans mode: %q", *spans)
+	}
+	for name, n := range map[string]int{"thunks": *thunks, "values": *values, "maxdepth": *maxDepth} {
+		if n > 0 {
+			t.Define(name, strconv.Itoa(n))
+		}
+	}
+	switch *commit {
+	case "":
+	case "nested":
+		t.Define("commit", *commit)
+	default:
+		log.Fatalf("invalid -commit mode: %q", *commit)
+	}
+	switch *empty {
+	case "":
+	case "noteof":
+		t.Define("empty", *empty)
+	default:
+		log.Fatalf("invalid -empty mode: %q", *empty)
+	}
+	for name, on := range map[string]bool{"rulestack": *ruleStack, "bom": *bom, "crlf": *crlf, "parsefile": *parseFile, "undo": *undo, "memo": *memo, "metrics": *metrics, "trace": *trace, "iterative": *iterative, "partial": *partial, "ambiguity": *ambiguity, "recognize": *recognize, "captures": *captures, "generics": *generics, "inlinereport": *inlined} {
+		if on {
+			t.Define(name, "1")
+		}
+	}
+	if *lang != "go" {
+		b, ok := peg.LookupBackend(*lang)
+		if !ok {
+			log.Fatalf("invalid -lang: %q", *lang)
+		}
+		if *split > 0 || *verify != "" || *selfCheck != "" || *deps != "" || *raceCheck != "" {
+			log.Fatalf("option -lang %s cannot be combined with -split, -verify, -selfcheck, -deps, or -racecheck", *lang)
+		}
+		generate(t, b, peg.Options{Optimizations: *optiFlags}, *output)
+		return
+	}
+	if t.PackageName() == "" {
+		dir := filepath.Dir(file)
+		if *output != "" {
+			dir = filepath.Dir(*output)
+		}
+		t.Define("package", inferPackage(dir, *output))
+	}
+	// The files are generated into memory, and only written, once all
+	// of them have been generated, so that existing ones are left
+	// unchanged, if the grammar cannot be compiled.
+	var files outputSet
+	if *deps != "" {
+		target := *output
+		if target == "" {
+			target = strings.TrimSuffix(file, filepath.Ext(file)) + ".go"
+		}
+		var b bytes.Buffer
+		if err := t.WriteDeps(&b, target); err != nil {
+			log.Fatal(err)
+		}
+		files.add(*deps, b.Bytes())
+	}
+	if *raceCheck != "" {
+		var b bytes.Buffer
+		if err := t.WriteRaceCheck(&b); err != nil {
+			log.Fatal(err)
+		}
+		files.add(*raceCheck, b.Bytes())
+	}
+	if *verify != "" {
+		if err := t.Verify(*verify, *optiFlags); err != nil {
+			log.Fatal(err)
+		}
+		files.commit()
+		return
+	}
+	if *selfCheck != "" {
+		var b bytes.Buffer
+		compile(t, &b, nil, *optiFlags)
+		if err := peg.CheckGenerated(*selfCheck, b.Bytes()); err != nil {
+			log.Fatal(file, ": ", err)
+		}
+		files.commit()
+		return
+	}
+	if *split > 0 && *output == "" {
+		log.Fatal("option -split requires -o")
+	}
+	var main bytes.Buffer
+	var parts []io.Writer
+	for i := 0; i < *split; i++ {
+		parts = append(parts, new(bytes.Buffer))
+	}
+	compile(t, &main, parts, *optiFlags)
+	for i, b := range parts {
+		files.add(fmt.Sprintf("%s_rules%d.go", strings.TrimSuffix(*output, ".go"), i+1), b.(*bytes.Buffer).Bytes())
+	}
+	files.output(*output, main.Bytes())
+}
+
+// compile generates the code of t, like CompileParts, writes the
+// report to stderr, and exits, if the grammar cannot be compiled.
+func compile(t *peg.Tree, out io.Writer, parts []io.Writer, optiFlags string) {
+	r, err := t.CompileParts(out, parts, optiFlags)
+	report.write(r)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+/*
+An outputSet collects the files generated by a command, which are
+written by commit only once all of them have been generated, each
+to a temporary file in its directory first, so that a failure never
+leaves a truncated file behind, nor one that does not match the
+others, like the parts of option -split.
+*/
+type outputSet struct {
+	files []string
+	data  [][]byte
+}
+
+func (s *outputSet) add(file string, data []byte) {
+	s.files = append(s.files, file)
+	s.data = append(s.data, data)
+}
+
+// output adds the main output of a command to be written to file,
+// and commits the set; if file is empty, the output is written to
+// stdout instead.
+func (s *outputSet) output(file string, data []byte) {
+	if file != "" {
+		s.add(file, data)
+	}
+	s.commit()
+	if file == "" {
+		if _, err := os.Stdout.Write(data); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// commit writes the files of the set, keeping the permissions of
+// existing ones. The temporary files are only renamed, once all
+// of them have been written; if that fails, they are removed,
+// and the program exits.
+func (s *outputSet) commit() {
+	var temps []string
+	err := func() error {
+		for i, file := range s.files {
+			tmp, err := writeTemp(file, s.data[i])
+			if err != nil {
+				return err
+			}
+			temps = append(temps, tmp)
+		}
+		for i, tmp := range temps {
+			if err := os.Rename(tmp, s.files[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		for _, tmp := range temps {
+			os.Remove(tmp)
+		}
+		log.Fatal(err)
+	}
+}
+
+// writeTemp writes data to a new temporary file in the directory of
+// file, with the permissions of file, if it exists, and returns its
+// name.
+func writeTemp(file string, data []byte) (string, error) {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(file); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	f, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// generate writes the output of a backend to the named file,
+// or to stdout.
+func generate(t *peg.Tree, b peg.Backend, o peg.Options, file string) {
+	var out bytes.Buffer
+	var r peg.Report
+	o.Report = &r
+	err := b.Generate(t, o, &out)
+	report.write(&r)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var files outputSet
+	files.output(file, out.Bytes())
+}
+
+// inferPackage returns the name of the package of the Go files in
+// directory dir, except for the output file, and tests, for a grammar
+// that does not declare a package; if there are none, it is "main".
+func inferPackage(dir, output string) string {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.go"))
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") || output != "" && filepath.Clean(name) == filepath.Clean(output) {
+			continue
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), name, nil, parser.PackageClauseOnly)
+		if err == nil {
+			return f.Name.Name
+		}
+	}
+	return "main"
+}
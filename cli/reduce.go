@@ -0,0 +1,178 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/knieriem/peg"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+reduce minimizes a grammar and an input, for which a test command
+succeeds, e.g. because they make the generator crash, or the
+generated parser misbehave, so that bugs found with large grammars
+can be reported using small examples. It uses delta debugging:
+chunks of the rules, alternatives, and elements of sequences of
+the grammar, and of the bytes of the input, are removed, as long as
+the test still succeeds; if no chunk can be removed, their size is
+halved, down to single parts.
+*/
+func reduce(s *Syntax, c *command, args []string) {
+	testCmd := c.flags.String("test", "", "`COMMAND` testing a candidate, given the names of the grammar and input files as additional arguments; exit status 0 means that the problem persists")
+	timeout := c.flags.Duration("timeout", 10*time.Second, "`DURATION` after which a test is stopped, and considered failed")
+	c.flags.Parse(args)
+	if c.flags.NArg() != 2 || *testCmd == "" {
+		c.usage()
+	}
+	file, inputFile := c.flags.Arg(0), c.flags.Arg(1)
+	b, err := ioutil.ReadFile(inputFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	input := string(b)
+	dir, err := ioutil.TempDir("", s.Name+"-reduce")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r := &reducer{
+		s:           s,
+		cmd:         strings.Fields(*testCmd),
+		timeout:     *timeout,
+		grammarFile: filepath.Join(dir, filepath.Base(file)),
+		inputFile:   filepath.Join(dir, filepath.Base(inputFile)),
+	}
+	grammar := r.format(s.load(file))
+	if !r.test(grammar, input) {
+		os.RemoveAll(dir)
+		log.Fatal("the test does not succeed with the formatted grammar, and the original input")
+	}
+	for {
+		g := r.reduceGrammar(grammar, input)
+		in := r.reduceInput(g, input)
+		if g == grammar && in == input {
+			break
+		}
+		grammar, input = g, in
+	}
+	for _, f := range []struct{ name, text string }{{minName(file), grammar}, {minName(inputFile), input}} {
+		if err := ioutil.WriteFile(f.name, []byte(f.text), 0666); err != nil {
+			os.RemoveAll(dir)
+			log.Fatal(err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%d tests run; wrote %s, and %s (%d bytes)\n", r.runs, minName(file), minName(inputFile), len(input))
+}
+
+// minName returns the name of the file a reduced version of file
+// is written to, like "calc.min.leg" for "calc.leg".
+func minName(file string) string {
+	ext := filepath.Ext(file)
+	return strings.TrimSuffix(file, ext) + ".min" + ext
+}
+
+type reducer struct {
+	s                      *Syntax
+	cmd                    []string
+	timeout                time.Duration
+	grammarFile, inputFile string // names of the candidates
+	runs                   int
+}
+
+// test writes the candidates, and reports whether the test
+// command succeeds on them.
+func (r *reducer) test(grammar, input string) bool {
+	r.runs++
+	if err := ioutil.WriteFile(r.grammarFile, []byte(grammar), 0666); err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(r.inputFile, []byte(input), 0666); err != nil {
+		log.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	return exec.CommandContext(ctx, r.cmd[0], append(r.cmd[1:], r.grammarFile, r.inputFile)...).Run() == nil
+}
+
+func (r *reducer) format(t *peg.Tree) string {
+	var b bytes.Buffer
+	if err := t.WriteGrammar(&b, r.s.Leg); err != nil {
+		log.Fatal(err)
+	}
+	return b.String()
+}
+
+// reduceGrammar returns the smallest grammar found, for which the
+// test succeeds together with input.
+func (r *reducer) reduceGrammar(grammar, input string) string {
+	t, err := r.s.loadText(grammar)
+	if err != nil {
+		log.Fatal(err)
+	}
+	minimize(t.Reductions(), func(from, to int) (bool, int) {
+		t, err := r.s.loadText(grammar)
+		if err != nil {
+			return false, 0
+		}
+		t.Reduce(from, to)
+		g := r.format(t)
+		if g == grammar || !r.test(g, input) {
+			return false, 0
+		}
+		grammar = g
+		return true, t.Reductions()
+	})
+	return grammar
+}
+
+// reduceInput returns the smallest input found, for which the
+// test succeeds together with grammar.
+func (r *reducer) reduceInput(grammar, input string) string {
+	minimize(len(input), func(from, to int) (bool, int) {
+		in := input[:from] + input[to:]
+		if !r.test(grammar, in) {
+			return false, 0
+		}
+		input = in
+		return true, len(input)
+	})
+	return input
+}
+
+// minimize removes chunks of the n parts of a value using remove,
+// which reports whether the test has succeeded without the parts
+// from to to-1, and if so, their number afterwards.
+func minimize(n int, remove func(from, to int) (ok bool, n int)) {
+	for k := (n + 1) / 2; k > 0; {
+		removed := false
+		for i := 0; i < n; {
+			to := i + k
+			if to > n {
+				to = n
+			}
+			if ok, m := remove(i, to); ok {
+				n = m
+				removed = true
+			} else {
+				i = to
+			}
+		}
+		switch {
+		case removed:
+			if k > (n+1)/2 {
+				k = (n + 1) / 2
+			}
+		case k == 1:
+			return
+		default:
+			k /= 2
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/knieriem/peg"
+	"github.com/knieriem/peg/antlr"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+func format(s *Syntax, c *command, args []string) {
+	c.flags.Parse(args)
+	if c.flags.NArg() != 1 {
+		c.usage()
+	}
+	t := s.load(c.flags.Arg(0))
+	if err := t.WriteGrammar(os.Stdout, s.Leg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// export prints a grammar in the syntax of another parser generator.
+func export(s *Syntax, c *command, args []string) {
+	dialect := c.flags.String("to", "", "write the grammar in `DIALECT`, one of "+strings.Join(peg.ExportDialects, ", "))
+	c.flags.Parse(args)
+	if c.flags.NArg() != 1 || *dialect == "" {
+		c.usage()
+	}
+	t := s.load(c.flags.Arg(0))
+	if err := t.Export(os.Stdout, *dialect); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// convert prints a grammar in the syntax of the other command,
+// i.e. a leg grammar in peg syntax, or a peg grammar in leg syntax.
+func convert(s *Syntax, c *command, args []string) {
+	c.flags.Parse(args)
+	if c.flags.NArg() != 1 {
+		c.usage()
+	}
+	t := s.load(c.flags.Arg(0))
+	dialect := "leg"
+	if s.Leg {
+		dialect = "peg"
+	}
+	if err := t.Export(os.Stdout, dialect); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// lint compiles grammars without writing the result, so that only
+// warnings, like about unused rules, and errors are printed.
+func lint(s *Syntax, c *command, args []string) {
+	optiFlags := c.flags.String("O", "", "turn on various optimizations")
+	c.flags.Parse(args)
+	if c.flags.NArg() == 0 {
+		c.usage()
+	}
+	failed := false
+	for _, file := range c.flags.Args() {
+		t := s.load(file)
+		r, err := t.Compile(ioutil.Discard, *optiFlags)
+		report.write(r)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// importGrammar converts an ANTLR v4 grammar, and prints it in the
+// syntax of the command. Features that could not be translated
+// are reported on stderr.
+func importGrammar(s *Syntax, c *command, args []string) {
+	c.flags.Parse(args)
+	if c.flags.NArg() != 1 {
+		c.usage()
+	}
+	file := c.flags.Arg(0)
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	t := peg.New(inline, _switch)
+	if !s.Leg {
+		t.Define("package", "main")
+	}
+	notes, err := antlr.Convert(t, string(b))
+	if err == nil {
+		err = t.Err()
+	}
+	if err != nil {
+		log.Fatal(file, ":", err)
+	}
+	for _, n := range notes {
+		fmt.Fprintf(os.Stderr, "%s:%v\n", file, n)
+	}
+	if err := t.WriteGrammar(os.Stdout, s.Leg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func viz(s *Syntax, c *command, args []string) {
+	c.flags.Parse(args)
+	if c.flags.NArg() != 1 {
+		c.usage()
+	}
+	t := s.load(c.flags.Arg(0))
+
+	w := bufio.NewWriter(os.Stdout)
+	fmt.Fprintf(w, "digraph %q {\n", c.flags.Arg(0))
+	for el := t.Front(); el != nil; el = el.Next() {
+		r, ok := el.Value.(peg.Rule)
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(w, "\t%q;\n", r.String())
+		seen := make(map[string]bool)
+		peg.Inspect(r.GetExpression(), func(n peg.Node) bool {
+			if n != nil && n.GetType() == peg.TypeName {
+				if name := n.String(); !seen[name] {
+					seen[name] = true
+					fmt.Fprintf(w, "\t%q -> %q;\n", r.String(), name)
+				}
+			}
+			return true
+		})
+	}
+	fmt.Fprintf(w, "}\n")
+	w.Flush()
+}
+
+// test matches each input file against the grammar, using
+// the interpreter, and reports whether its whole content
+// has been accepted. With option -verify-opt, each input is
+// also matched against the grammar as rewritten by the
+// optimizations of -switch and -O, which must accept the same
+// inputs, and match the same rules at the same positions.
+func test(s *Syntax, c *command, args []string) {
+	start := c.flags.String("start", "", "apply `RULE` instead of the start rule")
+	trace := c.flags.Bool("trace", false, "print a trace of all rule invocations")
+	verifyOpt := c.flags.Bool("verify-opt", false, "compare the results with those of the optimized grammar")
+	actions := c.flags.Bool("actions", false, "execute actions consisting of simple assignments, using a restricted evaluator, and print the semantic value")
+	optiFlags := c.flags.String("O", "all", "optimizations to verify with -verify-opt")
+	c.flags.Parse(args)
+	if c.flags.NArg() < 2 {
+		c.usage()
+	}
+	t := s.load(c.flags.Arg(0))
+	if *start == "" {
+		*start = t.StartRule()
+	}
+	ip := peg.NewInterpreter(t)
+	if *trace {
+		ip.Trace = os.Stdout
+	}
+	if *actions {
+		ip.Eval = peg.EvalAction
+	}
+	var opt *peg.Interpreter
+	if *verifyOpt {
+		inline, _switch = true, true
+		t := s.load(c.flags.Arg(0))
+		compile(t, ioutil.Discard, nil, *optiFlags)
+		opt = peg.NewInterpreter(t)
+	}
+	failed := false
+	for _, file := range c.flags.Args()[1:] {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		input := string(b)
+		m, err := ip.Parse(*start, input)
+		if opt != nil {
+			if diff := compareOpt(m, err, opt, *start, input); diff != "" {
+				fmt.Printf("%s: optimized grammar differs: %s\n", file, diff)
+				failed = true
+				continue
+			}
+		}
+		switch {
+		case err != nil:
+			fmt.Printf("%s:%v\n", file, err)
+			failed = true
+		case m.End != len(input):
+			fmt.Printf("%s: only %d of %d bytes matched\n", file, m.End, len(input))
+			failed = true
+		case *actions:
+			fmt.Printf("%s: ok, value %#v\n", file, m.Value)
+		default:
+			fmt.Printf("%s: ok\n", file)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// compareOpt matches input using the interpreter of the optimized
+// grammar, and describes how the result differs from m and err,
+// the result of the original grammar. Since leaf rules may have
+// been inlined, only matches of rules that also occur in the
+// result of the optimized grammar are compared; captures are
+// compared in the order of their ends.
+func compareOpt(m *peg.Match, err error, opt *peg.Interpreter, start, input string) string {
+	m1, err1 := opt.Parse(start, input)
+	switch {
+	case (err == nil) != (err1 == nil):
+		if err != nil {
+			return "input accepted"
+		}
+		return "input rejected"
+	case err != nil:
+		return ""
+	case m.End != m1.End:
+		return fmt.Sprintf("%d instead of %d bytes matched", m1.End, m.End)
+	}
+	seen := make(map[string]bool)
+	opts := flatten(m1, nil, func(string) bool { return true })
+	for _, o := range opts {
+		seen[o.Rule] = true
+	}
+	orig := flatten(m, nil, func(rule string) bool { return seen[rule] })
+	for i, o := range orig {
+		if i == len(opts) {
+			return fmt.Sprintf("rule %s at %d..%d not matched", o.Rule, o.Begin, o.End)
+		}
+		if o1 := opts[i]; o1.Rule != o.Rule || o1.Begin != o.Begin || o1.End != o.End {
+			return fmt.Sprintf("rule %s matched at %d..%d instead of rule %s at %d..%d", o1.Rule, o1.Begin, o1.End, o.Rule, o.Begin, o.End)
+		}
+	}
+	if len(opts) > len(orig) {
+		o := opts[len(orig)]
+		return fmt.Sprintf("additional match of rule %s at %d..%d", o.Rule, o.Begin, o.End)
+	}
+	for i, c := range m.Captures {
+		if i == len(m1.Captures) {
+			return fmt.Sprintf("capture %q at %d..%d missing", input[c[0]:c[1]], c[0], c[1])
+		}
+		if c1 := m1.Captures[i]; c1 != c {
+			return fmt.Sprintf("capture %q at %d..%d instead of %q at %d..%d", input[c1[0]:c1[1]], c1[0], c1[1], input[c[0]:c[1]], c[0], c[1])
+		}
+	}
+	if len(m1.Captures) > len(m.Captures) {
+		c := m1.Captures[len(m.Captures)]
+		return fmt.Sprintf("additional capture %q at %d..%d", input[c[0]:c[1]], c[0], c[1])
+	}
+	return ""
+}
+
+// flatten appends the sub-matches of m in pre-order to list,
+// omitting those whose rules are not accepted by keep.
+func flatten(m *peg.Match, list []*peg.Match, keep func(rule string) bool) []*peg.Match {
+	for _, sub := range m.Sub {
+		if keep(sub.Rule) {
+			list = append(list, sub)
+		}
+		list = flatten(sub, list, keep)
+	}
+	return list
+}
@@ -0,0 +1,96 @@
+package peg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Clone returns a copy of the tree, which can be modified, and
+// compiled, independently of the original. Like with Encode, the
+// tree must not have been compiled yet.
+func (t *Tree) Clone() (*Tree, error) {
+	return t.copyRules(t.definedRules(), false)
+}
+
+/*
+Subset returns a copy of the tree containing only the rules reachable
+from the rules named startRules, e.g. to generate a small parser of
+the expressions of a language from the grammar of the whole language.
+The rules of startRules come first, in the given order, so that the
+first of them is the start rule of the subset, followed by the other
+rules in their original order. Markers, like %private, and assertions
+of rules not contained in the subset are omitted, and so is a %start
+directive naming such a rule.
+*/
+func (t *Tree) Subset(startRules ...string) (*Tree, error) {
+	if len(startRules) == 0 {
+		return nil, errors.New("no start rules given")
+	}
+	defined := make(map[string]*rule)
+	for _, r := range t.definedRules() {
+		defined[r.name] = r
+	}
+	reached := make(map[string]bool)
+	var walk func(rule string)
+	walk = func(rule string) {
+		r, ok := defined[rule]
+		if !ok || reached[rule] {
+			return
+		}
+		reached[rule] = true
+		Inspect(r.expression, func(node Node) bool {
+			if n, ok := node.(*name); ok {
+				walk(n.string)
+			}
+			return true
+		})
+	}
+	var rules []*rule
+	first := make(map[string]bool, len(startRules))
+	for _, s := range startRules {
+		r, ok := defined[s]
+		if !ok {
+			return nil, fmt.Errorf("rule '%s' is not defined", s)
+		}
+		if !first[s] {
+			first[s] = true
+			rules = append(rules, r)
+		}
+		walk(s)
+	}
+	for _, r := range t.definedRules() {
+		if reached[r.name] && !first[r.name] {
+			rules = append(rules, r)
+		}
+	}
+	s, err := t.copyRules(rules, true)
+	if err != nil {
+		return nil, err
+	}
+	if start := s.defines["start"]; start != "" && !reached[start] {
+		s.defines["start"] = ""
+	}
+	return s, nil
+}
+
+// copyRules returns a new tree containing rules, by encoding them,
+// and decoding them again; see encode.
+func (t *Tree) copyRules(rules []*rule, subset bool) (*Tree, error) {
+	if len(t.stack) != 0 {
+		return nil, errors.New("cannot copy a tree while a rule is being defined")
+	}
+	var b bytes.Buffer
+	if err := t.encode(&b, rules, subset); err != nil {
+		return nil, err
+	}
+	c := New(t.inline, t._switch)
+	for name, on := range t.flags {
+		c.SetFlag(name, on)
+	}
+	c.imports = append(c.imports, t.imports...)
+	if err := c.Decode(&b); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,192 @@
+/*
+Conformance runs the conformance suite of the generator. For each
+leg grammar NAME.leg in the directory of the suite, which defaults
+to testdata/grammars, a parser is generated by the leg command using
+each of several sets of options, and built together with a harness
+into a program, which must accept each file in directory NAME/accept,
+and reject each file in NAME/reject. A file is accepted, if Parse
+succeeds, and the whole of the input has been consumed.
+
+The grammars must not have a package clause, nor a main function, and
+must keep the default name yyParser of the parser type, which the
+harness refers to as renamed by option -prefix, if given. Directory
+NAME may contain a harness of its own, main.go, which replaces the
+default one, e.g. to check the spans recorded for inputs listed in
+it; it is run once, without arguments, and must exit with a non-zero
+status, if a check has failed. A file NAME/opts, if present, lists
+the sets of options for the grammar, one per line, replacing those
+of option -opts, e.g. if the harness depends on the ids of rules,
+which are renamed by -prefix. Options -leg and -opts select the leg
+command, and the sets of options, separated by semicolons, e.g.
+
+	conformance -leg cmd/leg/leg -opts '-O all;-memo' testdata/grammars
+
+The names of the grammars, and options, failing are printed, and the
+exit status is non-zero, if any of them has failed.
+*/
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	leg  = flag.String("leg", "leg", "run the leg command `LEG`")
+	opts = flag.String("opts", ";-switch -inline -O all;-memo;-memo -recognize;-iterative;-recognize;-partial;-split 2;-split 2 -recognize;-prefix zz", "sets of options, separated by semicolons, to generate the parsers with")
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("conformance: ")
+	flag.Parse()
+	dir := filepath.Join("testdata", "grammars")
+	if flag.NArg() > 0 {
+		dir = flag.Arg(0)
+	}
+	grammars, err := filepath.Glob(filepath.Join(dir, "*.leg"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(grammars) == 0 {
+		log.Fatalf("no grammars found in %s", dir)
+	}
+	tmp, err := ioutil.TempDir("", "conformance")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	failed, runs := 0, 0
+	for _, g := range grammars {
+		base := strings.TrimSuffix(g, ".leg")
+		accept, _ := filepath.Glob(filepath.Join(base, "accept", "*"))
+		reject, _ := filepath.Glob(filepath.Join(base, "reject", "*"))
+		h := harness
+		if b, err := ioutil.ReadFile(filepath.Join(base, "main.go")); err == nil {
+			h = string(b)
+		}
+		sets := strings.Split(*opts, ";")
+		if b, err := ioutil.ReadFile(filepath.Join(base, "opts")); err == nil {
+			sets = strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+		}
+		for _, o := range sets {
+			if err := check(tmp, g, h, strings.Fields(o), accept, reject); err != nil {
+				fmt.Printf("%s [%s]:\n%s", g, o, err)
+				failed++
+			}
+		}
+		runs += len(sets)
+	}
+	if failed != 0 {
+		log.Fatalf("%d of %d runs failed", failed, runs)
+	}
+}
+
+// check generates a parser from grammar g, using options opts, builds
+// it together with harness h within directory tmp, and runs it on the
+// files to accept, and to reject, or, if h is not the default harness,
+// once without arguments.
+func check(tmp, g, h string, opts, accept, reject []string) error {
+	prog := filepath.Join(tmp, "run")
+	// parts written by -split for a previous grammar
+	old, _ := filepath.Glob(filepath.Join(tmp, "parser_rules*.go"))
+	for _, f := range old {
+		os.Remove(f)
+	}
+	parser := "yyParser"
+	for i, o := range opts {
+		if o == "-prefix" && i+1 < len(opts) {
+			parser = opts[i+1] + "Parser"
+		}
+	}
+	main := strings.Replace(h, "yyParser", parser, -1)
+	if err := ioutil.WriteFile(filepath.Join(tmp, "main.go"), []byte(main), 0666); err != nil {
+		return err
+	}
+	args := append(opts, "-o", filepath.Join(tmp, "parser.go"), g)
+	if err := run(exec.Command(*leg, args...)); err != nil {
+		return err
+	}
+	parts, _ := filepath.Glob(filepath.Join(tmp, "parser_rules*.go"))
+	for i, f := range parts {
+		parts[i] = filepath.Base(f)
+	}
+	build := exec.Command("go", append([]string{"build", "-o", prog, "parser.go", "main.go"}, parts...)...)
+	build.Dir = tmp
+	if err := run(build); err != nil {
+		return err
+	}
+	if h != harness {
+		return run(exec.Command(prog))
+	}
+	if len(accept) != 0 {
+		if err := run(exec.Command(prog, append([]string{"accept"}, accept...)...)); err != nil {
+			return err
+		}
+	}
+	if len(reject) != 0 {
+		if err := run(exec.Command(prog, append([]string{"reject"}, reject...)...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run runs a command, returning its output as error, if it fails.
+func run(cmd *exec.Cmd) error {
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if len(out) == 0 {
+			out = []byte(err.Error() + "\n")
+		}
+		return errors.New(string(out))
+	}
+	return nil
+}
+
+// harness is the main program built together with each parser.
+const harness = `package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+func main() {
+	accept := os.Args[1] == "accept"
+	failed := false
+	for _, file := range os.Args[2:] {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		p := &yyParser{Buffer: string(b)}
+		p.Init()
+		err = p.Parse()
+		if rest := len(p.ResetBuffer("")); err == nil && rest != 0 {
+			err = fmt.Errorf("%d bytes not consumed", rest)
+		}
+		switch {
+		case accept && err != nil:
+			fmt.Printf("%s: rejected: %v\n", file, err)
+		case !accept && err == nil:
+			fmt.Printf("%s: accepted\n", file)
+		default:
+			continue
+		}
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+`
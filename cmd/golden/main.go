@@ -0,0 +1,33 @@
+/*
+Golden compares the code generated for the grammars of package
+internal/golden with the golden files in directory
+internal/golden/testdata, or, if option -update is given, rewrites
+the golden files. The exit status is non-zero, if any file differs.
+*/
+package main
+
+import (
+	"flag"
+	"github.com/knieriem/peg/internal/golden"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var (
+	dir    = flag.String("dir", filepath.Join("internal", "golden", "testdata"), "directory `DIR` containing the golden files")
+	update = flag.Bool("update", false, "rewrite the golden files")
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("golden: ")
+	flag.Parse()
+	errs := golden.Run(*dir, *update)
+	for _, err := range errs {
+		log.Print(err)
+	}
+	if len(errs) != 0 {
+		os.Exit(1)
+	}
+}
@@ -5,44 +5,16 @@
 package main
 
 import (
-	"bufio"
-	"flag"
-	"fmt"
 	"github.com/knieriem/peg"
-	"io/ioutil"
-	"log"
-	"os"
-	"runtime"
-)
-
-var (
-	inline    = flag.Bool("inline", false, "parse rule inlining")
-	_switch   = flag.Bool("switch", false, "replace if-else if-else like blocks with switch blocks")
-	optiFlags = flag.String("O", "", "turn on various optimizations")
+	"github.com/knieriem/peg/cli"
 )
 
 func main() {
-	runtime.GOMAXPROCS(2)
-	flag.Parse()
-
-	if flag.NArg() != 1 {
-		flag.Usage()
-		fmt.Fprintf(os.Stderr, "  FILE: the peg file to compile\n")
-		os.Exit(1)
-	}
-	file := flag.Arg(0)
+	cli.Main(&cli.Syntax{Name: "peg", Leg: false, Parse: parse})
+}
 
-	buffer, err := ioutil.ReadFile(file)
-	if err != nil {
-		log.Fatal(err)
-	}
-	p := &Peg{Tree: peg.New(*inline, *_switch), Buffer: string(buffer)}
+func parse(t *peg.Tree, grammar string) error {
+	p := &Peg{Tree: t, Buffer: grammar}
 	p.Init()
-	if err = p.Parse(0); err == nil {
-		w := bufio.NewWriter(os.Stdout)		
-		p.Compile(w, *optiFlags)
-		w.Flush()
-	} else {
-		log.Print(file, ":", err)
-	}
+	return p.Parse(0)
 }
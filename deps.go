@@ -0,0 +1,53 @@
+package peg
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// AddFile records the name of a grammar file
+// the contents of the tree have been read from.
+func (t *Tree) AddFile(name string) {
+	for _, f := range t.files {
+		if f == name {
+			return
+		}
+	}
+	t.files = append(t.files, name)
+}
+
+/*
+WriteDeps writes a rule in make syntax to w, stating that
+target depends on all grammar files recorded by AddFile.
+For each file an additional empty rule is written, so that make
+won't complain if a file vanishes. Files of the standard library
+are omitted, as they are part of the generator.
+*/
+func (t *Tree) WriteDeps(w io.Writer, target string) (err error) {
+	escape := strings.NewReplacer(" ", `\ `, "#", `\#`, "$", "$$").Replace
+
+	if _, err = fmt.Fprintf(w, "%s:", escape(target)); err != nil {
+		return
+	}
+	for _, f := range t.files {
+		if IsStdFile(f) {
+			continue
+		}
+		if _, err = fmt.Fprintf(w, " %s", escape(f)); err != nil {
+			return
+		}
+	}
+	if _, err = fmt.Fprintln(w); err != nil {
+		return
+	}
+	for _, f := range t.files {
+		if IsStdFile(f) {
+			continue
+		}
+		if _, err = fmt.Fprintf(w, "\n%s:\n", escape(f)); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,139 @@
+/*
+Package difftest compares two parsers on a corpus of inputs, like
+parsers generated from the same grammar by different versions of
+the generator, or with and without optimizations, so that changes
+of their behaviour are noticed before the generator is upgraded.
+For each input, it reports whether one parser accepts what the
+other rejects, whether they consume different lengths of the
+input, and whether they record different spans.
+
+As the types of generated parsers differ, each parser is wrapped
+into a function returning a Result, like
+
+	func(input string) difftest.Result {
+		p := &Calc{Buffer: input}
+		p.Init()
+		err := p.Parse()
+		return difftest.Result{Err: err, End: len(input) - len(p.ResetBuffer(""))}
+	}
+
+where the length of the text returned by ResetBuffer, the part of
+the buffer not parsed, tells the consumed length. Spans recorded
+by parsers generated with %spans may be copied into Result.Spans.
+*/
+package difftest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// A Span is the text input[Begin:End] matched by a rule, or a
+// capture within a rule, like the spans recorded by a generated
+// parser. The ids of the rules of both parsers must agree.
+type Span struct {
+	Rule       int
+	Begin, End int
+}
+
+// A Result describes how a parser has handled an input.
+type Result struct {
+	Err   error  // returned by Parse
+	End   int    // offset up to which the input has been consumed
+	Spans []Span // optional
+}
+
+// A Parser parses an input, and returns the result.
+type Parser func(input string) Result
+
+// A Divergence describes how the results of two parsers differ
+// for an input.
+type Divergence struct {
+	File string // name of the input file
+	Msg  string
+	A, B Result
+}
+
+func (d *Divergence) String() string {
+	return d.File + ": " + d.Msg
+}
+
+/*
+Compare parses input with both parsers, and returns a description
+of how the results differ, or nil, if they do not. A panic of a
+parser is turned into an error of its result; if only one of the
+parsers panics, or fails, the results differ. If both parsers
+succeed, their consumed lengths, and spans, are compared.
+*/
+func Compare(input string, a, b Parser) *Divergence {
+	ra, pa := run(a, input)
+	rb, pb := run(b, input)
+	d := &Divergence{A: ra, B: rb}
+	switch {
+	case pa != pb:
+		if pa {
+			d.Msg = "A panics: " + ra.Err.Error()
+		} else {
+			d.Msg = "B panics: " + rb.Err.Error()
+		}
+	case (ra.Err == nil) != (rb.Err == nil):
+		if ra.Err == nil {
+			d.Msg = "accepted by A, rejected by B: " + rb.Err.Error()
+		} else {
+			d.Msg = "rejected by A, accepted by B: " + ra.Err.Error()
+		}
+	case ra.Err != nil:
+		return nil
+	case ra.End != rb.End:
+		d.Msg = fmt.Sprintf("A consumed %d bytes, B %d", ra.End, rb.End)
+	default:
+		i := 0
+		for i < len(ra.Spans) && i < len(rb.Spans) && ra.Spans[i] == rb.Spans[i] {
+			i++
+		}
+		switch {
+		case i < len(ra.Spans) && i < len(rb.Spans):
+			d.Msg = fmt.Sprintf("span %d differs: A %v, B %v", i, ra.Spans[i], rb.Spans[i])
+		case len(ra.Spans) != len(rb.Spans):
+			d.Msg = fmt.Sprintf("A recorded %d spans, B %d", len(ra.Spans), len(rb.Spans))
+		default:
+			return nil
+		}
+	}
+	return d
+}
+
+// run applies p to input, turning a panic into an error.
+func run(p Parser, input string) (r Result, panicked bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			r, panicked = Result{Err: fmt.Errorf("%v", e)}, true
+		}
+	}()
+	return p(input), false
+}
+
+/*
+Run compares the parsers on each regular file within the directory
+tree rooted at dir, in lexical order, and returns the divergences
+found. An error is returned, if the files cannot be read.
+*/
+func Run(dir string, a, b Parser) (ds []*Divergence, err error) {
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if d := Compare(string(data), a, b); d != nil {
+			d.File = path
+			ds = append(ds, d)
+		}
+		return nil
+	})
+	return
+}
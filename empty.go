@@ -0,0 +1,73 @@
+package peg
+
+import "bytes"
+
+/*
+resolveEmpty applies the semantics of the empty literal "" chosen
+using %empty. By default, it matches the empty string, and never
+fails. With "%empty noteof", it fails at the end of the input, like
+&., which it is replaced with, so that the analyses of the grammar,
+and the backends, only need to handle the default.
+*/
+func (t *Tree) resolveEmpty() {
+	if t.defines["empty"] != "noteof" {
+		return
+	}
+	var resolve func(node Node) Node
+	resolve = func(node Node) Node {
+		if isEmptyString(node) {
+			l := &nodeList{Type: TypePeekFor}
+			l.PushBack(dot)
+			return l
+		}
+		if l, ok := node.(List); ok {
+			for el := l.Front(); el != nil; el = el.Next() {
+				el.Value = resolve(el.Value.(Node))
+			}
+		}
+		return node
+	}
+	for el := t.Front(); el != nil; el = el.Next() {
+		if r, ok := el.Value.(*rule); ok && r.expression != nil {
+			r.expression = resolve(r.expression)
+		}
+	}
+}
+
+// checkEmpty warns about alternatives of ordered choices that begin
+// with the empty literal, followed by further expressions, like
+// "" 'b'. The literal does not change what the alternative matches,
+// or, with %empty noteof, only excludes the end of the input, so it
+// probably has been written by mistake.
+func (t *Tree) checkEmpty() {
+	effect := "which has no effect"
+	if t.defines["empty"] == "noteof" {
+		effect = "which only checks that the end of the input has not been reached"
+	}
+	for element := t.Front(); element != nil; element = element.Next() {
+		r, ok := element.Value.(*rule)
+		if !ok || r.expression == nil {
+			continue
+		}
+		Inspect(r.expression, func(node Node) bool {
+			if node == nil || node.GetType() != TypeAlternate {
+				return true
+			}
+			i := 0
+			for el := node.(List).Front(); el != nil; el = el.Next() {
+				i++
+				first := el.Value.(Node)
+				for first.GetType() == TypeSequence {
+					first = first.(List).Front().Value.(Node)
+				}
+				if first == el.Value.(Node) || !isEmptyString(first) {
+					continue
+				}
+				var b bytes.Buffer
+				writeExpression(&b, el.Value.(Node), precSequence, false)
+				t.warnf("%srule '%v': alternative %d (%s) begins with the empty literal, %s", t.rulePos(r), r, i, &b, effect)
+			}
+			return true
+		})
+	}
+}
@@ -0,0 +1,430 @@
+package peg
+
+import (
+	"bufio"
+	encbinary "encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// encodeMagic starts an encoded grammar, followed by encodeVersion,
+// which must be incremented whenever the format changes.
+const (
+	encodeMagic   = "peg\x00grammar"
+	encodeVersion = 1
+)
+
+// Operations of an encoded grammar. Most of them correspond to
+// a method of Tree, which Decode calls to rebuild the grammar.
+const (
+	opStop byte = iota
+	opHeader
+	opTrailer
+	opFile
+	opDefine
+	opSwitchExclude
+	opPrivate
+	opToken
+	opTraced
+	opNoInline
+	opAssertFirst
+	opRule
+	opExpression
+	opVariable
+	opName
+	opDot
+	opString
+	opClass
+	opPredicate
+	opIndent
+	opPushState
+	opPopState
+	opBytes
+	opCommit
+	opBegin
+	opEnd
+	opAnchor
+	opNil
+	opAction
+	opImmediateAction
+	opErrorAction
+	opAlternate
+	opSequence
+	opPeekFor
+	opPeekNot
+	opQuery
+	opStar
+	opPlus
+)
+
+/*
+Encode writes the grammar contained in the tree to w in a compact,
+versioned binary format, that Decode reads much faster than the
+grammar text is parsed, so that tools like the interpreter may cache
+grammars. The tree must not have been compiled yet. Like with
+WriteGrammar, comments are not preserved; other than that, the
+decoded tree generates the same code.
+
+The grammar is encoded as the sequence of calls to the methods of
+Tree that would build it, like from the parser of a grammar, with
+expressions in postfix order; flags of %if sections are not kept,
+as they have been applied while parsing.
+*/
+func (t *Tree) Encode(w io.Writer) error {
+	return t.encode(w, t.definedRules(), false)
+}
+
+// definedRules returns the rules of the tree having an expression,
+// in the order of their definition.
+func (t *Tree) definedRules() (rules []*rule) {
+	for el := t.Front(); el != nil; el = el.Next() {
+		if r, ok := el.Value.(*rule); ok && r.expression != nil {
+			rules = append(rules, r)
+		}
+	}
+	return
+}
+
+// encode writes the grammar, restricted to rules, in their order.
+// If subset is set, markers and assertions of other rules are
+// omitted as well.
+func (t *Tree) encode(w io.Writer, rules []*rule, subset bool) error {
+	keep := func(string) bool { return true }
+	if subset {
+		names := make(map[string]bool, len(rules))
+		for _, r := range rules {
+			names[r.name] = true
+		}
+		keep = func(name string) bool { return names[name] }
+	}
+	e := &encoder{w: bufio.NewWriter(w)}
+	e.w.WriteString(encodeMagic)
+	e.uint(encodeVersion)
+
+	for _, h := range t.Headers {
+		e.op(opHeader, h)
+	}
+	for _, s := range t.trailers {
+		e.op(opTrailer, s)
+	}
+	for _, f := range t.files {
+		e.op(opFile, f)
+	}
+	// only defines differing from their defaults are written
+	defaults := New(t.inline, t._switch).defines
+	var names []string
+	for name, v := range t.defines {
+		if v != defaults[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		e.op(opDefine, name, t.defines[name])
+	}
+	for _, m := range []struct {
+		op    byte
+		names map[string]bool
+	}{
+		{opSwitchExclude, t.switchExcl},
+		{opPrivate, t.private},
+		{opToken, t.tokens},
+		{opTraced, t.traced},
+		{opNoInline, t.noInline},
+	} {
+		for _, name := range sortedNames(m.names) {
+			if keep(name) {
+				e.op(m.op, name)
+			}
+		}
+	}
+	for _, a := range t.firstAsserts {
+		if keep(a.rule) {
+			e.op(opAssertFirst, a.rule, a.class)
+		}
+	}
+
+	for _, r := range rules {
+		if e.err != nil {
+			break
+		}
+		e.op(opRule, r.name, r.file)
+		e.uint(uint64(r.line))
+		e.node(r.expression)
+		e.op(opExpression)
+	}
+	e.op(opStop)
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+type encoder struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (e *encoder) uint(x uint64) {
+	var buf [encbinary.MaxVarintLen64]byte
+	e.w.Write(buf[:encbinary.PutUvarint(buf[:], x)])
+}
+
+// op writes an operation, followed by its string arguments,
+// each preceded by its length.
+func (e *encoder) op(op byte, args ...string) {
+	e.w.WriteByte(op)
+	for _, s := range args {
+		e.uint(uint64(len(s)))
+		e.w.WriteString(s)
+	}
+}
+
+func (e *encoder) node(node Node) {
+	switch node.GetType() {
+	case TypeName:
+		n := node.(*name)
+		if n.varp != nil {
+			e.op(opVariable, n.varp.name)
+		}
+		e.op(opName, n.string)
+	case TypeDot:
+		e.op(opDot)
+	case TypeCharacter, TypeString:
+		e.op(opString, node.String())
+	case TypeClass:
+		e.op(opClass, node.String())
+	case TypePredicate:
+		e.op(opPredicate, node.String())
+	case TypeIndent:
+		e.op(opIndent, node.String())
+	case TypeState:
+		if s := node.String(); s != "" {
+			e.op(opPushState, s)
+		} else {
+			e.op(opPopState)
+		}
+	case TypeBytes:
+		e.op(opBytes, node.String())
+	case TypeCommit:
+		e.op(opCommit)
+	case TypeBegin:
+		e.op(opBegin)
+	case TypeEnd:
+		e.op(opEnd)
+	case TypeAnchor:
+		e.op(opAnchor, node.String())
+	case TypeNil:
+		e.op(opNil)
+	case TypeAction:
+		a := node.(*action)
+		if a.isImmediate {
+			e.op(opImmediateAction, a.text)
+		} else {
+			e.op(opAction, a.source)
+		}
+	case TypeError:
+		l := node.(List)
+		e.node(l.Front().Value.(Node))
+		e.op(opErrorAction, l.Front().Next().Value.(*action).text)
+	case TypeAlternate, TypeSequence:
+		op := opAlternate
+		if node.GetType() == TypeSequence {
+			op = opSequence
+		}
+		l := node.(List)
+		if l.Len() == 0 {
+			e.err = errors.New("cannot encode an empty list")
+			return
+		}
+		e.node(l.Front().Value.(Node))
+		for el := l.Front().Next(); el != nil; el = el.Next() {
+			e.node(el.Value.(Node))
+			e.op(op)
+		}
+	case TypePeekFor, TypePeekNot, TypeQuery, TypeStar, TypePlus:
+		e.node(node.(List).Front().Value.(Node))
+		e.op(map[Type]byte{
+			TypePeekFor: opPeekFor,
+			TypePeekNot: opPeekNot,
+			TypeQuery:   opQuery,
+			TypeStar:    opStar,
+			TypePlus:    opPlus,
+		}[node.GetType()])
+	default:
+		e.err = fmt.Errorf("cannot encode node of type %v, as the tree has been compiled", node.GetType())
+	}
+}
+
+// sortedNames returns the names of a set of rules in lexical order.
+func sortedNames(set map[string]bool) (names []string) {
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+/*
+Decode reads a grammar written by Encode from r into the tree, which
+must have been created by New, like before parsing a grammar. An
+error is returned, if the data are not a grammar encoded by this
+version of Encode.
+*/
+func (t *Tree) Decode(r io.Reader) (err error) {
+	d := &decoder{r: bufio.NewReader(r)}
+	defer func() {
+		if e := recover(); e != nil {
+			if de, ok := e.(decodeError); ok {
+				err = de.err
+				return
+			}
+			// e.g. an expression missing on the stack
+			err = fmt.Errorf("malformed encoded grammar: %v", e)
+		}
+	}()
+	magic := make([]byte, len(encodeMagic))
+	if _, err := io.ReadFull(d.r, magic); err != nil || string(magic) != encodeMagic {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		return errors.New("not an encoded grammar")
+	}
+	if v := d.uint(); v != encodeVersion {
+		return fmt.Errorf("unsupported version %d of encoded grammar", v)
+	}
+	for {
+		op, err := d.r.ReadByte()
+		if err != nil {
+			d.fail(err)
+		}
+		switch op {
+		case opStop:
+			if len(t.stack) != 0 {
+				return errors.New("malformed encoded grammar: incomplete rule")
+			}
+			return nil
+		case opHeader:
+			t.AddHeader(d.string())
+		case opTrailer:
+			t.AddTrailer(d.string())
+		case opFile:
+			t.AddFile(d.string())
+		case opDefine:
+			name := d.string()
+			t.Define(name, d.string())
+		case opSwitchExclude:
+			t.SwitchExclude(d.string())
+		case opPrivate:
+			t.MakePrivate(d.string())
+		case opToken:
+			t.MakeToken(d.string())
+		case opTraced:
+			t.MakeTraced(d.string())
+		case opNoInline:
+			t.MakeNoInline(d.string())
+		case opAssertFirst:
+			rule := d.string()
+			t.firstAsserts = append(t.firstAsserts, firstAssert{rule, d.string()})
+		case opRule:
+			t.AddRule(d.string())
+			t.currentRule().file = d.string()
+			t.currentRule().line = int(d.uint())
+		case opExpression:
+			t.AddExpression()
+		case opVariable:
+			t.AddVariable(d.string())
+		case opName:
+			t.AddName(d.string())
+		case opDot:
+			t.AddDot()
+		case opString:
+			t.AddString(d.string())
+		case opClass:
+			t.AddClass(d.string())
+		case opPredicate:
+			t.AddPredicate(d.string())
+		case opIndent:
+			t.AddIndent(d.string())
+		case opPushState:
+			t.AddPushState(d.string())
+		case opPopState:
+			t.AddPopState()
+		case opBytes:
+			t.AddBytes(d.string())
+		case opCommit:
+			t.AddCommit()
+		case opBegin:
+			t.AddBegin()
+		case opEnd:
+			t.AddEnd()
+		case opAnchor:
+			t.AddAnchor(d.string())
+		case opNil:
+			t.AddNil()
+		case opAction:
+			t.AddAction(d.string())
+		case opImmediateAction:
+			t.AddImmediateAction(d.string())
+		case opErrorAction:
+			t.AddErrorAction(d.string())
+		case opAlternate:
+			t.AddAlternate()
+		case opSequence:
+			t.AddSequence()
+		case opPeekFor:
+			t.AddPeekFor()
+		case opPeekNot:
+			t.AddPeekNot()
+		case opQuery:
+			t.AddQuery()
+		case opStar:
+			t.AddStar()
+		case opPlus:
+			t.AddPlus()
+		default:
+			return fmt.Errorf("malformed encoded grammar: unknown operation %d", op)
+		}
+	}
+}
+
+// A decodeError carries an error of the reader,
+// or of the data, up to Decode.
+type decodeError struct{ err error }
+
+type decoder struct {
+	r *bufio.Reader
+}
+
+func (d *decoder) fail(err error) {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	panic(decodeError{err})
+}
+
+func (d *decoder) uint() uint64 {
+	x, err := encbinary.ReadUvarint(d.r)
+	if err != nil {
+		d.fail(err)
+	}
+	return x
+}
+
+func (d *decoder) bytes(n int) string {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		d.fail(err)
+	}
+	return string(buf)
+}
+
+func (d *decoder) string() string {
+	n := d.uint()
+	if n > 1<<30 {
+		d.fail(errors.New("malformed encoded grammar: string too long"))
+	}
+	return d.bytes(int(n))
+}
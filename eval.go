@@ -0,0 +1,563 @@
+package peg
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	gotoken "go/token"
+	"strconv"
+	"strings"
+)
+
+// An ActionEnv holds the data an action executed by an Interpreter
+// may refer to, and change.
+type ActionEnv struct {
+	Text  string                 // yytext, the text of the last < > pair
+	Begin int                    // begin, the offset of Text
+	Value interface{}            // $$, or yy, the semantic value
+	Vars  map[string]interface{} // the variables of the rule, like e in e:Expr
+}
+
+/*
+EvalAction executes the code of an action, as an Interpreter does,
+if it is assigned to its field Eval. Instead of arbitrary Go, it only
+accepts assignments, like "$$ = a + b", "n, _ = strconv.Atoi(yytext)",
+or "s += yytext", and increments, to $$, the variables of the rule,
+and to local variables declared using :=. Expressions may consist of
+integer, floating point, string, and character literals, true and
+false, yytext, begin, the values assigned, unary and binary operators
+like in Go, indexing and slicing of strings, and calls of the
+conversions int, float64, and string, of len, and of the functions
+in evalFuncs, like strconv.Atoi. Integers are represented as int,
+and characters, and the bytes of strings, as their int values.
+Any other code results in an error, so that grammars of unknown
+origin may compute simple semantic values, without being able to
+execute code that has effects beyond the environment.
+*/
+func EvalAction(code string, env *ActionEnv) error {
+	src := "package p; func _() {\n" + code + "\n}"
+	fset := gotoken.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, 0)
+	if err != nil {
+		return err
+	}
+	e := &evaluator{env: env, locals: make(map[string]interface{}), fset: fset, src: src}
+	for _, stmt := range f.Decls[0].(*ast.FuncDecl).Body.List {
+		if err := e.stmt(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evalFuncs are the functions that may be called by actions
+// executed using EvalAction, besides the builtin ones.
+var evalFuncs = map[string]func(args []interface{}) ([]interface{}, error){
+	"strconv.Atoi": func(args []interface{}) ([]interface{}, error) {
+		s, err := stringArgs(args, 1)
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(s[0])
+		return []interface{}{n, err}, nil
+	},
+	"strconv.ParseFloat": func(args []interface{}) ([]interface{}, error) {
+		if len(args) != 2 || args[1] != 64 {
+			return nil, errors.New("only 64 bit floats are supported")
+		}
+		s, err := stringArgs(args[:1], 1)
+		if err != nil {
+			return nil, err
+		}
+		f, err := strconv.ParseFloat(s[0], 64)
+		return []interface{}{f, err}, nil
+	},
+	"strconv.Itoa": func(args []interface{}) ([]interface{}, error) {
+		if len(args) != 1 {
+			return nil, errors.New("one argument expected")
+		}
+		n, ok := args[0].(int)
+		if !ok {
+			return nil, fmt.Errorf("%T argument instead of int", args[0])
+		}
+		return []interface{}{strconv.Itoa(n)}, nil
+	},
+	"strconv.Unquote": func(args []interface{}) ([]interface{}, error) {
+		s, err := stringArgs(args, 1)
+		if err != nil {
+			return nil, err
+		}
+		s[0], err = strconv.Unquote(s[0])
+		return []interface{}{s[0], err}, nil
+	},
+	"strconv.Quote":     stringFunc(strconv.Quote),
+	"strings.ToLower":   stringFunc(strings.ToLower),
+	"strings.ToUpper":   stringFunc(strings.ToUpper),
+	"strings.TrimSpace": stringFunc(strings.TrimSpace),
+	"fmt.Sprint": func(args []interface{}) ([]interface{}, error) {
+		return []interface{}{fmt.Sprint(args...)}, nil
+	},
+}
+
+func stringFunc(f func(string) string) func([]interface{}) ([]interface{}, error) {
+	return func(args []interface{}) ([]interface{}, error) {
+		s, err := stringArgs(args, 1)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{f(s[0])}, nil
+	}
+}
+
+// stringArgs checks that args consists of n strings.
+func stringArgs(args []interface{}, n int) ([]string, error) {
+	if len(args) != n {
+		return nil, fmt.Errorf("%d arguments instead of %d", len(args), n)
+	}
+	s := make([]string, n)
+	for i, a := range args {
+		var ok bool
+		if s[i], ok = a.(string); !ok {
+			return nil, fmt.Errorf("%T argument instead of string", a)
+		}
+	}
+	return s, nil
+}
+
+type evaluator struct {
+	env    *ActionEnv
+	locals map[string]interface{}
+	fset   *gotoken.FileSet
+	src    string
+}
+
+// text returns the source of node, for error messages.
+func (e *evaluator) text(node ast.Node) string {
+	return e.src[e.fset.Position(node.Pos()).Offset:e.fset.Position(node.End()).Offset]
+}
+
+func (e *evaluator) stmt(stmt ast.Stmt) error {
+	switch s := stmt.(type) {
+	case *ast.EmptyStmt:
+		return nil
+	case *ast.IncDecStmt:
+		op := gotoken.ADD
+		if s.Tok == gotoken.DEC {
+			op = gotoken.SUB
+		}
+		return e.assign(s.X, s.Tok, func(v interface{}) (interface{}, error) { return binary(op, v, 1) })
+	case *ast.AssignStmt:
+		var values []interface{}
+		if len(s.Rhs) == 1 && len(s.Lhs) > 1 {
+			call, ok := s.Rhs[0].(*ast.CallExpr)
+			if !ok {
+				return errors.New("assignment mismatch")
+			}
+			v, err := e.call(call)
+			if err != nil {
+				return err
+			}
+			values = v
+		} else {
+			for _, x := range s.Rhs {
+				v, err := e.expr(x)
+				if err != nil {
+					return err
+				}
+				values = append(values, v)
+			}
+		}
+		if len(values) != len(s.Lhs) {
+			return fmt.Errorf("assignment mismatch: %d variables, but %d values", len(s.Lhs), len(values))
+		}
+		for i, lhs := range s.Lhs {
+			v := values[i]
+			op, ok := assignOps[s.Tok]
+			err := e.assign(lhs, s.Tok, func(old interface{}) (interface{}, error) {
+				if ok {
+					return binary(op, old, v)
+				}
+				return v, nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported statement %s", e.text(stmt))
+}
+
+// assignOps maps assignment operators like += to binary operators.
+var assignOps = map[gotoken.Token]gotoken.Token{
+	gotoken.ADD_ASSIGN: gotoken.ADD,
+	gotoken.SUB_ASSIGN: gotoken.SUB,
+	gotoken.MUL_ASSIGN: gotoken.MUL,
+	gotoken.QUO_ASSIGN: gotoken.QUO,
+	gotoken.REM_ASSIGN: gotoken.REM,
+}
+
+// assign sets the variable x to the result of f, which is passed
+// its current value.
+func (e *evaluator) assign(x ast.Expr, tok gotoken.Token, f func(interface{}) (interface{}, error)) error {
+	id, ok := x.(*ast.Ident)
+	if !ok {
+		return fmt.Errorf("unsupported assignment to %s", e.text(x))
+	}
+	name := id.Name
+	if name == "_" {
+		_, err := f(nil)
+		return err
+	}
+	var old interface{}
+	switch _, isVar := e.env.Vars[name]; {
+	case tok == gotoken.DEFINE:
+		if name == "yy" || isVar {
+			return fmt.Errorf("%s redeclared", name)
+		}
+	case name == "yy":
+		old = e.env.Value
+	case isVar:
+		old = e.env.Vars[name]
+	default:
+		var ok bool
+		if old, ok = e.locals[name]; !ok {
+			return fmt.Errorf("assignment to undefined %s", name)
+		}
+	}
+	v, err := f(old)
+	if err != nil {
+		return err
+	}
+	switch _, isVar := e.env.Vars[name]; {
+	case tok == gotoken.DEFINE:
+		e.locals[name] = v
+	case name == "yy":
+		e.env.Value = v
+	case isVar:
+		e.env.Vars[name] = v
+	default:
+		e.locals[name] = v
+	}
+	return nil
+}
+
+func (e *evaluator) expr(x ast.Expr) (interface{}, error) {
+	switch x := x.(type) {
+	case *ast.BasicLit:
+		switch x.Kind {
+		case gotoken.INT:
+			n, err := strconv.ParseInt(x.Value, 0, 0)
+			return int(n), err
+		case gotoken.FLOAT:
+			return strconv.ParseFloat(x.Value, 64)
+		case gotoken.CHAR:
+			r, _, _, err := strconv.UnquoteChar(x.Value[1:len(x.Value)-1], '\'')
+			return int(r), err
+		case gotoken.STRING:
+			return strconv.Unquote(x.Value)
+		}
+	case *ast.Ident:
+		switch x.Name {
+		case "yy":
+			return e.env.Value, nil
+		case "yytext":
+			return e.env.Text, nil
+		case "begin":
+			return e.env.Begin, nil
+		case "true", "false":
+			return x.Name == "true", nil
+		case "nil":
+			return nil, nil
+		}
+		if v, ok := e.locals[x.Name]; ok {
+			return v, nil
+		}
+		if v, ok := e.env.Vars[x.Name]; ok {
+			return v, nil
+		}
+		return nil, fmt.Errorf("undefined: %s", x.Name)
+	case *ast.ParenExpr:
+		return e.expr(x.X)
+	case *ast.UnaryExpr:
+		v, err := e.expr(x.X)
+		if err != nil {
+			return nil, err
+		}
+		switch v := v.(type) {
+		case int:
+			switch x.Op {
+			case gotoken.ADD:
+				return v, nil
+			case gotoken.SUB:
+				return -v, nil
+			}
+		case float64:
+			switch x.Op {
+			case gotoken.ADD:
+				return v, nil
+			case gotoken.SUB:
+				return -v, nil
+			}
+		case bool:
+			if x.Op == gotoken.NOT {
+				return !v, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid operation %v on %T", x.Op, v)
+	case *ast.BinaryExpr:
+		a, err := e.expr(x.X)
+		if err != nil {
+			return nil, err
+		}
+		if x.Op == gotoken.LAND || x.Op == gotoken.LOR {
+			if a, ok := a.(bool); ok && a == (x.Op == gotoken.LOR) {
+				return a, nil
+			}
+		}
+		b, err := e.expr(x.Y)
+		if err != nil {
+			return nil, err
+		}
+		return binary(x.Op, a, b)
+	case *ast.IndexExpr:
+		s, i, err := e.stringIndex(x.X, x.Index)
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= len(s) {
+			return nil, fmt.Errorf("index %d out of range [0:%d]", i, len(s))
+		}
+		return int(s[i]), nil
+	case *ast.SliceExpr:
+		if x.Slice3 {
+			break
+		}
+		lo, hi := 0, -1
+		s, err := e.string(x.X)
+		if err != nil {
+			return nil, err
+		}
+		if x.Low != nil {
+			if _, lo, err = e.stringIndex(x.X, x.Low); err != nil {
+				return nil, err
+			}
+		}
+		hi = len(s)
+		if x.High != nil {
+			if _, hi, err = e.stringIndex(x.X, x.High); err != nil {
+				return nil, err
+			}
+		}
+		if lo < 0 || hi < lo || hi > len(s) {
+			return nil, fmt.Errorf("slice bounds [%d:%d] out of range [0:%d]", lo, hi, len(s))
+		}
+		return s[lo:hi], nil
+	case *ast.CallExpr:
+		v, err := e.call(x)
+		if err != nil {
+			return nil, err
+		}
+		if len(v) != 1 {
+			return nil, fmt.Errorf("%d values in single-value context", len(v))
+		}
+		return v[0], nil
+	}
+	return nil, fmt.Errorf("unsupported expression %s", e.text(x))
+}
+
+func (e *evaluator) string(x ast.Expr) (string, error) {
+	v, err := e.expr(x)
+	if err != nil {
+		return "", err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("%T instead of string", v)
+	}
+	return s, nil
+}
+
+// stringIndex evaluates a string and an index into it.
+func (e *evaluator) stringIndex(x, index ast.Expr) (s string, i int, err error) {
+	if s, err = e.string(x); err != nil {
+		return
+	}
+	v, err := e.expr(index)
+	if err != nil {
+		return
+	}
+	i, ok := v.(int)
+	if !ok {
+		err = fmt.Errorf("index of type %T", v)
+	}
+	return
+}
+
+func (e *evaluator) call(x *ast.CallExpr) ([]interface{}, error) {
+	var name string
+	switch fun := x.Fun.(type) {
+	case *ast.Ident:
+		name = fun.Name
+	case *ast.SelectorExpr:
+		if pkg, ok := fun.X.(*ast.Ident); ok {
+			name = pkg.Name + "." + fun.Sel.Name
+		}
+	}
+	var args []interface{}
+	for _, a := range x.Args {
+		v, err := e.expr(a)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+	switch name {
+	case "int", "float64", "string", "len":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s expects one argument", name)
+		}
+		v, err := builtin(name, args[0])
+		return []interface{}{v}, err
+	}
+	f, ok := evalFuncs[name]
+	if !ok {
+		return nil, fmt.Errorf("call of unsupported function %s", name)
+	}
+	v, err := f(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return v, nil
+}
+
+func builtin(name string, v interface{}) (interface{}, error) {
+	switch name {
+	case "len":
+		if s, ok := v.(string); ok {
+			return len(s), nil
+		}
+	case "int":
+		switch v := v.(type) {
+		case int:
+			return v, nil
+		case float64:
+			return int(v), nil
+		}
+	case "float64":
+		switch v := v.(type) {
+		case int:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		}
+	case "string":
+		switch v := v.(type) {
+		case int:
+			return string(rune(v)), nil
+		case string:
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid argument of type %T for %s", v, name)
+}
+
+// binary applies op to a and b; an int operand is converted
+// to float64, if the other one is a float64.
+func binary(op gotoken.Token, a, b interface{}) (interface{}, error) {
+	if x, ok := a.(int); ok {
+		if _, ok := b.(float64); ok {
+			a = float64(x)
+		}
+	}
+	if y, ok := b.(int); ok {
+		if _, ok := a.(float64); ok {
+			b = float64(y)
+		}
+	}
+	switch x := a.(type) {
+	case int:
+		if y, ok := b.(int); ok {
+			switch op {
+			case gotoken.ADD:
+				return x + y, nil
+			case gotoken.SUB:
+				return x - y, nil
+			case gotoken.MUL:
+				return x * y, nil
+			case gotoken.QUO, gotoken.REM:
+				if y == 0 {
+					return nil, errors.New("integer division by zero")
+				}
+				if op == gotoken.QUO {
+					return x / y, nil
+				}
+				return x % y, nil
+			}
+			return compare(op, x < y, x == y)
+		}
+	case float64:
+		if y, ok := b.(float64); ok {
+			switch op {
+			case gotoken.ADD:
+				return x + y, nil
+			case gotoken.SUB:
+				return x - y, nil
+			case gotoken.MUL:
+				return x * y, nil
+			case gotoken.QUO:
+				return x / y, nil
+			}
+			return compare(op, x < y, x == y)
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			if op == gotoken.ADD {
+				return x + y, nil
+			}
+			return compare(op, x < y, x == y)
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			switch op {
+			case gotoken.LAND:
+				return x && y, nil
+			case gotoken.LOR:
+				return x || y, nil
+			case gotoken.EQL:
+				return x == y, nil
+			case gotoken.NEQ:
+				return x != y, nil
+			}
+		}
+	case nil:
+		switch op {
+		case gotoken.EQL:
+			return b == nil, nil
+		case gotoken.NEQ:
+			return b != nil, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid operation %T %v %T", a, op, b)
+}
+
+// compare returns the result of a comparison op, given
+// whether the first operand is less than, or equal to the second.
+func compare(op gotoken.Token, less, equal bool) (interface{}, error) {
+	switch op {
+	case gotoken.EQL:
+		return equal, nil
+	case gotoken.NEQ:
+		return !equal, nil
+	case gotoken.LSS:
+		return less, nil
+	case gotoken.LEQ:
+		return less || equal, nil
+	case gotoken.GTR:
+		return !less && !equal, nil
+	case gotoken.GEQ:
+		return !less, nil
+	}
+	return nil, fmt.Errorf("invalid operator %v", op)
+}
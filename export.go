@@ -0,0 +1,474 @@
+package peg
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// Dialects accepted by Export.
+var ExportDialects = []string{"peg", "leg", "pointlander", "pest", "c-peg", "c-leg"}
+
+/*
+Export writes the grammar contained in the tree in the syntax
+selected by dialect: "peg" or "leg" for the syntaxes of this
+package, so that grammars can be converted between them, or the
+syntax of another parser generator: "pointlander" for
+github.com/pointlander/peg, "pest" for the Rust parser generator
+pest, and "c-peg" or "c-leg" for the peg and leg tools written in
+C, which this package derives from. Like WriteGrammar, it must be
+called before the tree is compiled.
+
+Actions, predicates, headers and trailers are copied verbatim, if
+the dialect supports them, and need to be adapted to the target
+language. Features the dialect lacks, like directives and error
+actions in peg, commit in other parser generators, or actions
+in pest, are dropped; each of them is reported once on stderr.
+*/
+func (t *Tree) Export(w io.Writer, dialect string) error {
+	t.resolveEmpty()
+	x := &exporter{t: t, dialect: dialect, w: bufio.NewWriter(w), reported: make(map[string]bool)}
+	switch dialect {
+	case "leg":
+		if p := t.defines["package"]; p != "" && len(t.Headers) == 0 {
+			fmt.Fprintf(x.w, "%%{\npackage %s\n%%}\n\n", p)
+		}
+		if p := t.defines["Peg"]; p != "yyParser" {
+			x.note("parser type " + p + " not supported, named yyParser")
+		}
+		if u := t.defines["userstate"]; strings.ContainsAny(strings.TrimSpace(u), " \t\n;") {
+			// only a single embedded type can be declared in leg syntax
+			x.drop("user state consisting of several fields")
+			t.defines["userstate"] = ""
+			defer func() { t.defines["userstate"] = u }()
+		}
+		if err := t.WriteGrammar(x.w, true); err != nil {
+			return err
+		}
+		return x.w.Flush()
+	case "peg":
+		x.pegHeader()
+	case "pointlander":
+		pkg := t.defines["package"]
+		if pkg == "" {
+			pkg = "main"
+		}
+		fmt.Fprintf(x.w, "package %s\n\n", pkg)
+		fmt.Fprintf(x.w, "type %s Peg {\n", t.defines["Peg"])
+		if u := t.defines["userstate"]; u != "" {
+			fmt.Fprintf(x.w, "\t%s\n", u)
+		}
+		fmt.Fprintf(x.w, "}\n\n")
+		if len(t.Headers) != 0 || len(t.trailers) != 0 {
+			x.drop("headers and trailers")
+		}
+	case "c-peg", "c-leg":
+		for _, h := range t.Headers {
+			fmt.Fprintf(x.w, "%%{%s%%}\n\n", h)
+		}
+	case "pest":
+		if len(t.Headers) != 0 || len(t.trailers) != 0 {
+			x.drop("headers and trailers")
+		}
+	default:
+		return fmt.Errorf("unknown dialect %q, expected one of %s", dialect, strings.Join(ExportDialects, ", "))
+	}
+	for el := t.Front(); el != nil; el = el.Next() {
+		if r, ok := el.Value.(*rule); ok && r.expression != nil {
+			x.rule(r)
+		}
+	}
+	if len(t.trailers) != 0 && (dialect == "c-peg" || dialect == "c-leg") {
+		fmt.Fprintf(x.w, "%%%%%s", strings.Join(t.trailers, ""))
+	}
+	return x.w.Flush()
+}
+
+// pegHeader writes the package clause and the declarations of
+// the parser type, and the semantic values, that start a grammar
+// in peg syntax. If the tree has been read from a leg grammar,
+// the package name is taken from the headers.
+func (x *exporter) pegHeader() {
+	t := x.t
+	pkg := t.defines["package"]
+	other := len(t.trailers) != 0
+	for _, h := range t.Headers {
+		for _, line := range strings.Split(h, "\n") {
+			switch f := strings.Fields(line); {
+			case len(f) == 0:
+			case len(f) == 2 && f[0] == "package" && pkg == "":
+				pkg = f[1]
+			default:
+				other = true
+			}
+		}
+	}
+	if other {
+		x.drop("headers, except for the package clause, and trailers")
+	}
+	if pkg == "" {
+		pkg = "main"
+	}
+	fmt.Fprintf(x.w, "package %s\n\n", pkg)
+	fmt.Fprintf(x.w, "type %s Peg {%s}\n", t.defines["Peg"], t.defines["userstate"])
+	if y := t.defines["yystype"]; y != "yyStype" {
+		fmt.Fprintf(x.w, "type YYSTYPE %s\n", y)
+	}
+	fmt.Fprintf(x.w, "\n")
+
+	var b bytes.Buffer
+	t.writeDirectives(&b)
+	for _, line := range strings.Split(b.String(), "\n") {
+		if f := strings.Fields(line); len(f) != 0 && f[0] != "%YYSTYPE" && f[0] != "%userstate" {
+			x.drop("directive " + f[0])
+		}
+	}
+}
+
+type exporter struct {
+	t        *Tree
+	dialect  string
+	w        *bufio.Writer
+	reported map[string]bool // messages that have been printed
+}
+
+// drop reports a feature that the dialect does not support.
+func (x *exporter) drop(feature string) {
+	x.note(feature + " not supported, dropped")
+}
+
+// note prints a message about the output, unless it has been
+// printed before.
+func (x *exporter) note(msg string) {
+	if !x.reported[msg] {
+		x.reported[msg] = true
+		fmt.Fprintf(os.Stderr, "%s: %s\n", x.dialect, msg)
+	}
+}
+
+// pestBuiltins are names of rules predefined by pest, which
+// are renamed, as are WHITESPACE and COMMENT, which pest would
+// insert implicitly between the elements of sequences.
+var pestBuiltins = map[string]bool{
+	"ANY": true, "SOI": true, "EOI": true, "PUSH": true, "POP": true, "POP_ALL": true,
+	"PEEK": true, "PEEK_ALL": true, "DROP": true, "NEWLINE": true,
+	"WHITESPACE": true, "COMMENT": true,
+	"ASCII": true, "ASCII_DIGIT": true, "ASCII_ALPHA": true, "ASCII_ALPHANUMERIC": true,
+}
+
+// name returns the name of a rule as written in the dialect.
+func (x *exporter) name(name string) string {
+	if x.dialect != "leg" {
+		// qualified names of imported rules
+		name = strings.Replace(name, ".", "_", -1)
+	}
+	if x.dialect == "c-leg" {
+		return name
+	}
+	name = strings.Replace(name, "-", "_", -1)
+	if x.dialect == "pest" && pestBuiltins[name] {
+		name += "_"
+	}
+	return name
+}
+
+func (x *exporter) rule(r *rule) {
+	w := x.w
+	bar := " / "
+	if x.t.tokens[r.name] {
+		x.drop("@token")
+	}
+	if x.t.traced[r.name] {
+		x.drop("@trace")
+	}
+	if x.t.noInline[r.name] {
+		x.drop("@noinline")
+	}
+	switch x.dialect {
+	case "pest":
+		bar = " | "
+		kind := "{"
+		if x.t.private[r.name] {
+			kind = "_{"
+		}
+		fmt.Fprintf(w, "%s = %s", x.name(r.name), kind)
+	case "c-leg":
+		bar = " | "
+		fmt.Fprintf(w, "%s\t= ", r.name)
+	default:
+		fmt.Fprintf(w, "%s\t<- ", x.name(r.name))
+	}
+	if e := r.expression; e.GetType() == TypeAlternate || e.GetType() == TypeUnorderedAlternate {
+		sep := "\n\t" + bar[1:]
+		if x.dialect == "pest" {
+			sep = "\n  " + bar[1:]
+			fmt.Fprintf(w, "\n    ")
+		}
+		for el := e.(List).Front(); el != nil; el = el.Next() {
+			if el != e.(List).Front() {
+				fmt.Fprintf(w, "%s", sep)
+			}
+			x.expression(el.Value.(Node), precSequence)
+		}
+		if x.dialect == "pest" {
+			fmt.Fprintf(w, "\n")
+		}
+	} else {
+		if x.dialect == "pest" {
+			fmt.Fprintf(w, " ")
+		}
+		x.expression(e, precAlternate)
+		if x.dialect == "pest" {
+			fmt.Fprintf(w, " ")
+		}
+	}
+	if x.dialect == "pest" {
+		fmt.Fprintf(w, "}")
+	}
+	fmt.Fprintf(w, "\n\n")
+}
+
+// dropped reports whether node is left out of the output, as
+// the dialect does not support it. Expressions like matches of
+// the error action ~{} are not dropped completely, but only
+// the parts that are not supported.
+func (x *exporter) dropped(node Node) bool {
+	var feature string
+	switch node.GetType() {
+	case TypeCommit:
+		if x.dialect == "peg" {
+			return false
+		}
+		feature = "commit"
+	case TypeAnchor:
+		feature = "anchors"
+	case TypeIndent:
+		feature = "indentation"
+	case TypeState:
+		feature = "%push and %pop"
+	case TypeBytes:
+		feature = "@{}"
+	case TypeNil:
+		return true
+	case TypeBegin, TypeEnd:
+		if x.dialect != "pest" {
+			return false
+		}
+		feature = "captures"
+	case TypeAction:
+		if x.dialect != "pest" {
+			return false
+		}
+		feature = "actions"
+	case TypePredicate:
+		if x.dialect != "pest" {
+			return false
+		}
+		feature = "semantic predicates"
+	default:
+		return false
+	}
+	x.drop(feature)
+	return true
+}
+
+// empty writes an expression matching the empty string.
+func (x *exporter) empty() {
+	if x.dialect == "pest" {
+		fmt.Fprintf(x.w, `""`)
+	} else {
+		fmt.Fprintf(x.w, "''")
+	}
+}
+
+// expression writes node like writeExpression, but in the syntax of
+// the dialect, leaving out the features it does not support.
+func (x *exporter) expression(node Node, prec int) {
+	w := x.w
+	if x.dropped(node) {
+		x.empty()
+		return
+	}
+	if node.GetType() == TypeClass && x.dialect == "pest" {
+		x.pestClass(node.String(), prec)
+		return
+	}
+	if precedence(node) < prec {
+		fmt.Fprintf(w, "(")
+		defer fmt.Fprintf(w, ")")
+	}
+	list := func(sep string, prec int) {
+		var elems []Node
+		for el := node.(List).Front(); el != nil; el = el.Next() {
+			if n := el.Value.(Node); node.GetType() != TypeSequence || !x.dropped(n) {
+				elems = append(elems, n)
+			}
+		}
+		if len(elems) == 0 {
+			x.empty()
+		}
+		for i, n := range elems {
+			if i > 0 {
+				fmt.Fprintf(w, "%s", sep)
+			}
+			x.expression(n, prec)
+		}
+	}
+	switch node.GetType() {
+	case TypeAlternate, TypeUnorderedAlternate:
+		if x.dialect == "pest" || x.dialect == "c-leg" {
+			list(" | ", precSequence)
+		} else {
+			list(" / ", precSequence)
+		}
+	case TypeSequence:
+		if x.dialect == "pest" {
+			list(" ~ ", precPrefix)
+		} else {
+			list(" ", precPrefix)
+		}
+	case TypePeekFor, TypePeekNot:
+		fmt.Fprintf(w, "%s", map[Type]string{TypePeekFor: "&", TypePeekNot: "!"}[node.GetType()])
+		x.expression(node.(List).Front().Value.(Node), precSuffix)
+	case TypeError:
+		l := node.(List)
+		x.expression(l.Front().Value.(Node), precPrefix)
+		if x.dialect == "c-leg" {
+			fmt.Fprintf(w, " ~{%s}", l.Front().Next().Value.(*action).source)
+		} else {
+			x.drop("error actions")
+		}
+	case TypeQuery, TypeStar, TypePlus:
+		x.expression(node.(List).Front().Value.(Node), precPrimary)
+		fmt.Fprintf(w, "%s", map[Type]string{TypeQuery: "?", TypeStar: "*", TypePlus: "+"}[node.GetType()])
+	case TypeName:
+		if v := node.(*name).varp; v != nil {
+			if x.dialect == "c-leg" || x.dialect == "peg" {
+				fmt.Fprintf(w, "%s:", v.name)
+			} else {
+				x.drop("variables")
+			}
+		}
+		fmt.Fprintf(w, "%s", x.name(node.String()))
+	case TypeCharacter, TypeString:
+		if x.dialect == "pest" {
+			x.pestString(unescape(node.String()))
+		} else if s := node.String(); strings.Contains(s, "'") {
+			fmt.Fprintf(w, "\"%s\"", s)
+		} else {
+			fmt.Fprintf(w, "'%s'", s)
+		}
+	case TypeClass:
+		fmt.Fprintf(w, "[%s]", node)
+	case TypeDot:
+		if x.dialect == "pest" {
+			fmt.Fprintf(w, "ANY")
+		} else {
+			fmt.Fprintf(w, ".")
+		}
+	case TypePredicate:
+		fmt.Fprintf(w, "&{ %s }", node)
+	case TypeAction:
+		if node.(*action).isImmediate {
+			x.note("immediate actions not supported, written as usual actions")
+		}
+		fmt.Fprintf(w, "{%s}", node.(*action).source)
+	case TypeBegin, TypeEnd, TypeCommit:
+		fmt.Fprintf(w, "%s", node)
+	}
+}
+
+// pestString writes a literal as a pest string.
+func (x *exporter) pestString(s string) {
+	if !utf8.ValidString(s) {
+		x.note("literals that are not valid UTF-8 not supported, written with replacement characters")
+	}
+	fmt.Fprintf(x.w, `"`)
+	for _, r := range s {
+		fmt.Fprintf(x.w, "%s", pestChar(r, '"'))
+	}
+	fmt.Fprintf(x.w, `"`)
+}
+
+// pestChar returns the character r, as written in a pest string,
+// or in a pest character literal, depending on the quote.
+func pestChar(r rune, quote rune) string {
+	switch {
+	case r == quote || r == '\\':
+		return `\` + string(r)
+	case r == '\n':
+		return `\n`
+	case r == '\r':
+		return `\r`
+	case r == '\t':
+		return `\t`
+	case r < ' ' || r == 0x7F:
+		return fmt.Sprintf(`\x%02X`, r)
+	}
+	return string(r)
+}
+
+// pestClass writes a class as an alternation of ranges and
+// characters. A class containing more than half of all bytes
+// is written as its complement, followed by ANY.
+func (x *exporter) pestClass(text string, prec int) {
+	w := x.w
+	class := ParseClass(text)
+	inverse := class.len() > 128
+	if inverse {
+		class = class.copy()
+		class.complement()
+	}
+	var alts []string
+	char := func(c int) string { return "'" + pestChar(rune(c), '\'') + "'" }
+	for c := 0; c < 0x80; c++ {
+		if !class.has(uint8(c)) {
+			continue
+		}
+		lo := c
+		for c+1 < 0x80 && class.has(uint8(c+1)) {
+			c++
+		}
+		switch {
+		case c == lo:
+			alts = append(alts, char(c))
+		case c == lo+1:
+			alts = append(alts, char(lo), char(c))
+		default:
+			alts = append(alts, char(lo)+".."+char(c))
+		}
+	}
+	n := 0
+	for c := 0x80; c < 0x100; c++ {
+		if class.has(uint8(c)) {
+			n++
+		}
+	}
+	if n != 0 {
+		if n != 0x80 {
+			x.note("classes containing only some non-ASCII bytes not supported, written as matching any non-ASCII character")
+		}
+		alts = append(alts, `'\u{80}'..'\u{10FFFF}'`)
+	}
+	expr := strings.Join(alts, " | ")
+	switch {
+	case len(alts) == 0:
+		expr = "!ANY"
+		if inverse {
+			expr = "ANY"
+		}
+	case inverse:
+		if len(alts) > 1 {
+			expr = "(" + expr + ")"
+		}
+		expr = "!" + expr + " ~ ANY"
+	}
+	if inverse && len(alts) != 0 && prec > precSequence || !inverse && len(alts) > 1 && prec > precAlternate {
+		expr = "(" + expr + ")"
+	}
+	fmt.Fprintf(w, "%s", expr)
+}
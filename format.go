@@ -0,0 +1,315 @@
+package peg
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Binding strength of expressions, used to decide about parentheses.
+const (
+	precAlternate = iota
+	precSequence
+	precPrefix
+	precSuffix
+	precPrimary
+)
+
+/*
+WriteGrammar writes the grammar contained in the tree in leg syntax,
+if leg is true, or in peg syntax otherwise. The tree must not
+have been compiled yet. Comments of the original grammar are not
+preserved, and headers and trailers can only be written in leg
+syntax.
+*/
+func (t *Tree) WriteGrammar(w io.Writer, leg bool) error {
+	b := bufio.NewWriter(w)
+	if leg {
+		for _, h := range t.Headers {
+			fmt.Fprintf(b, "%%{%s%%}\n\n", h)
+		}
+		t.writeDirectives(b)
+	} else {
+		fmt.Fprintf(b, "package %s\n\n", t.defines["package"])
+		fmt.Fprintf(b, "type %s Peg {%s}\n", t.defines["Peg"], t.defines["userstate"])
+		if y := t.defines["yystype"]; y != "yyStype" {
+			fmt.Fprintf(b, "type YYSTYPE %s\n", y)
+		}
+		fmt.Fprintf(b, "\n")
+	}
+
+	for el := t.Front(); el != nil; el = el.Next() {
+		r, ok := el.Value.(*rule)
+		if !ok || r.expression == nil {
+			continue
+		}
+		sep := "<-"
+		if leg {
+			sep = "="
+		}
+		if leg && t.tokens[r.name] {
+			fmt.Fprintf(b, "@token ")
+		}
+		if leg && t.traced[r.name] {
+			fmt.Fprintf(b, "@trace ")
+		}
+		if leg && t.noInline[r.name] {
+			fmt.Fprintf(b, "@noinline ")
+		}
+		fmt.Fprintf(b, "%s\t%s ", r, sep)
+		if e := r.expression; e.GetType() == TypeAlternate || e.GetType() == TypeUnorderedAlternate {
+			bar := "/"
+			if leg {
+				bar = "|"
+			}
+			for i, el := 0, e.(List).Front(); el != nil; i, el = i+1, el.Next() {
+				if i > 0 {
+					fmt.Fprintf(b, "\n\t%s ", bar)
+				}
+				writeExpression(b, el.Value.(Node), precSequence, leg)
+			}
+		} else {
+			writeExpression(b, e, precAlternate, leg)
+		}
+		fmt.Fprintf(b, "\n\n")
+	}
+
+	if leg && len(t.trailers) != 0 {
+		fmt.Fprintf(b, "%%%%%s", strings.Join(t.trailers, ""))
+	}
+	return b.Flush()
+}
+
+func (t *Tree) writeDirectives(w io.Writer) {
+	if y := t.defines["yystype"]; y != "yyStype" {
+		fmt.Fprintf(w, "%%YYSTYPE %s\n", y)
+	}
+	if u := strings.TrimSpace(t.defines["userstate"]); u != "" {
+		fmt.Fprintf(w, "%%userstate %s\n", u)
+	}
+	for _, name := range []string{"prefix", "start", "yyspan", "state", "maxdepth"} {
+		if v := t.defines[name]; v != "" {
+			fmt.Fprintf(w, "%%%s %s\n", name, v)
+		}
+	}
+	if t.defines["commit"] == "nested" {
+		fmt.Fprintf(w, "%%commit nested\n")
+	}
+	if t.defines["empty"] == "noteof" {
+		fmt.Fprintf(w, "%%empty noteof\n")
+	}
+	for _, d := range initialSizes {
+		if v := t.defines[d.name]; v != d.def {
+			fmt.Fprintf(w, "%%%s %s\n", d.name, v)
+		}
+	}
+	switch t.defines["spans"] {
+	case "captures":
+		fmt.Fprintf(w, "%%spans\n")
+	case "rules", "tokens":
+		fmt.Fprintf(w, "%%spans %s\n", t.defines["spans"])
+	}
+	for _, name := range []string{"noexport", "rulestack", "bom", "crlf", "parsefile", "undo", "memo", "metrics", "iterative", "partial", "ambiguity", "recognize", "captures", "generics"} {
+		if t.defines[name] != "" {
+			fmt.Fprintf(w, "%%%s\n", name)
+		}
+	}
+	if len(t.switchExcl) != 0 {
+		var names []string
+		for name := range t.switchExcl {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(w, "%%switchexcl (%s)\n", strings.Join(names, " "))
+	}
+	for _, a := range t.firstAsserts {
+		fmt.Fprintf(w, "%%assert-first %s [%s]\n", a.rule, a.class)
+	}
+	if len(t.private) != 0 {
+		var names []string
+		for name := range t.private {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(w, "%%private (%s)\n", strings.Join(names, " "))
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+/*
+FprintGrammar writes node, a rule or an expression of a tree, in peg
+syntax to w, using parentheses only where needed. Within literals and
+classes, control characters, like newlines, and quotes that would end
+a literal, are escaped, so that the text can be read back; action
+code is written verbatim. The generated code uses it for the comments
+describing rules. Alternates that have been turned into switch
+statements by the optimizer, which need not be tried in order, are
+separated by '|'.
+*/
+func FprintGrammar(w io.Writer, node Node) error {
+	b := bufio.NewWriter(w)
+	if r, ok := node.(*rule); ok {
+		fmt.Fprintf(b, "%v <- ", r)
+		node = r.expression
+	}
+	if node != nil {
+		writeExpression(b, node, precAlternate, false)
+	}
+	return b.Flush()
+}
+
+// quoteLiteral returns the text of a literal, as stored in the tree,
+// enclosed in single quotes, or in double quotes, if it contains
+// a single quote but no double quote. Escape sequences are kept,
+// while quotes ending the literal, and control characters, are
+// escaped.
+func quoteLiteral(s string) string {
+	q := byte('\'')
+	if strings.Contains(s, "'") && !strings.Contains(s, `"`) {
+		q = '"'
+	}
+	var b bytes.Buffer
+	b.WriteByte(q)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			b.WriteString(s[i : i+2])
+			i++
+		case c == q:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteString(escapeControl(c))
+		}
+	}
+	b.WriteByte(q)
+	return b.String()
+}
+
+// escapeClass returns the text of a character class, as stored in
+// the tree, with control characters escaped.
+func escapeClass(s string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '\\' && i+1 < len(s) {
+			b.WriteString(s[i : i+2])
+			i++
+		} else {
+			b.WriteString(escapeControl(c))
+		}
+	}
+	return b.String()
+}
+
+// escapeControl returns an escape sequence for a control character,
+// that is understood by both peg and leg, or c itself otherwise.
+func escapeControl(c byte) string {
+	switch c {
+	case '\a':
+		return `\a`
+	case '\b':
+		return `\b`
+	case '\f':
+		return `\f`
+	case '\n':
+		return `\n`
+	case '\r':
+		return `\r`
+	case '\t':
+		return `\t`
+	case '\v':
+		return `\v`
+	}
+	if c < ' ' || c == 0x7f {
+		return fmt.Sprintf("\\%03o", c)
+	}
+	return string([]byte{c})
+}
+
+func precedence(node Node) int {
+	switch node.GetType() {
+	case TypeAlternate, TypeUnorderedAlternate:
+		return precAlternate
+	case TypeSequence:
+		return precSequence
+	case TypePeekFor, TypePeekNot, TypeError:
+		return precPrefix
+	case TypeQuery, TypeStar, TypePlus:
+		return precSuffix
+	}
+	return precPrimary
+}
+
+// writeExpression writes node, enclosed in parentheses,
+// if it binds less strongly than required by prec.
+func writeExpression(w io.Writer, node Node, prec int, leg bool) {
+	if precedence(node) < prec {
+		fmt.Fprintf(w, "(")
+		defer fmt.Fprintf(w, ")")
+	}
+	list := func(sep string, prec int) {
+		for el := node.(List).Front(); el != nil; el = el.Next() {
+			if el != node.(List).Front() {
+				fmt.Fprintf(w, "%s", sep)
+			}
+			writeExpression(w, el.Value.(Node), prec, leg)
+		}
+	}
+	switch node.GetType() {
+	case TypeAlternate:
+		if leg {
+			list(" | ", precSequence)
+		} else {
+			list(" / ", precSequence)
+		}
+	case TypeUnorderedAlternate:
+		// created by the optimizer, so that only compiled trees,
+		// printed in peg syntax, contain it
+		list(" | ", precSequence)
+	case TypeSequence:
+		list(" ", precPrefix)
+	case TypePeekFor:
+		fmt.Fprintf(w, "&")
+		writeExpression(w, node.(List).Front().Value.(Node), precSuffix, leg)
+	case TypePeekNot:
+		fmt.Fprintf(w, "!")
+		writeExpression(w, node.(List).Front().Value.(Node), precSuffix, leg)
+	case TypeError:
+		l := node.(List)
+		writeExpression(w, l.Front().Value.(Node), precPrefix, leg)
+		fmt.Fprintf(w, " ~{%s}", l.Front().Next().Value.(*action).source)
+	case TypeQuery, TypeStar, TypePlus:
+		writeExpression(w, node.(List).Front().Value.(Node), precPrimary, leg)
+		fmt.Fprintf(w, "%s", map[Type]string{TypeQuery: "?", TypeStar: "*", TypePlus: "+"}[node.GetType()])
+	case TypeName:
+		if v := node.(*name).varp; v != nil {
+			fmt.Fprintf(w, "%s:", v.name)
+		}
+		fmt.Fprintf(w, "%s", node)
+	case TypeCharacter, TypeString:
+		fmt.Fprintf(w, "%s", quoteLiteral(node.String()))
+	case TypeClass:
+		fmt.Fprintf(w, "[%s]", escapeClass(node.String()))
+	case TypePredicate:
+		fmt.Fprintf(w, "&{ %s }", node)
+	case TypeBytes:
+		fmt.Fprintf(w, "@{ %s }", node)
+	case TypeState:
+		if node.String() == "" {
+			fmt.Fprintf(w, "%%pop")
+		} else {
+			fmt.Fprintf(w, "%%push{ %s }", node)
+		}
+	case TypeAction:
+		if a := node.(*action); a.isImmediate {
+			fmt.Fprintf(w, "{!%s}", a.source)
+		} else {
+			fmt.Fprintf(w, "{%s}", a.source)
+		}
+	case TypeDot, TypeCommit, TypeBegin, TypeEnd, TypeAnchor, TypeIndent:
+		fmt.Fprintf(w, "%s", node)
+	}
+}
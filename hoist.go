@@ -0,0 +1,91 @@
+package peg
+
+/*
+hoistActions rewrites each alternate, whose alternatives are all
+sequences ending with the same action, like in
+
+	Sign	= < '+' > - { s = yytext } | < '-' > - { s = yytext }
+
+so that the action follows the alternate instead:
+
+	Sign	= (< '+' > - | < '-' > -) { s = yytext }
+
+As the action is queued at the same point, after the alternative
+that has matched, the effect is the same, but there is only one
+call of do, and one thunk function. The duplicates are removed from
+the actions of the tree, and the remaining ones are renumbered;
+the number of actions removed is counted in the statistics.
+Immediate actions, and error actions, are not hoisted.
+*/
+func (t *Tree) hoistActions() {
+	removed := make(map[*action]bool)
+	var hoist func(node Node) Node
+	hoist = func(node Node) Node {
+		l, ok := node.(*nodeList)
+		if !ok {
+			return node
+		}
+		for el := l.Front(); el != nil; el = el.Next() {
+			if n, ok := el.Value.(Node); ok {
+				el.Value = hoist(n)
+			}
+		}
+		if l.Type != TypeAlternate {
+			return node
+		}
+		var first *action
+		for el := l.Front(); el != nil; el = el.Next() {
+			a := lastAction(el.Value.(Node))
+			if a == nil || first != nil && a.text != first.text {
+				return node
+			}
+			if first == nil {
+				first = a
+			}
+		}
+		for el := l.Front(); el != nil; el = el.Next() {
+			sequence := el.Value.(*nodeList)
+			if a := sequence.Remove(sequence.Back()).(*action); a != first {
+				removed[a] = true
+			}
+			if sequence.Len() == 1 {
+				el.Value = sequence.Front().Value
+			}
+		}
+		sequence := &nodeList{Type: TypeSequence}
+		sequence.PushBack(l)
+		sequence.PushBack(first)
+		return sequence
+	}
+	for el := t.Front(); el != nil; el = el.Next() {
+		if r, ok := el.Value.(*rule); ok && r.expression != nil {
+			r.expression = hoist(r.expression)
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+	stats.hoisted += len(removed)
+	actions := t.Actions[:0]
+	for _, a := range t.Actions {
+		if !removed[a] {
+			a.id = len(actions)
+			actions = append(actions, a)
+		}
+	}
+	t.Actions = actions
+}
+
+// lastAction returns the action ending node, if it is a sequence
+// of at least two nodes, unless it is an immediate, or error action.
+func lastAction(node Node) *action {
+	sequence, ok := node.(*nodeList)
+	if !ok || sequence.Type != TypeSequence || sequence.Len() < 2 {
+		return nil
+	}
+	a, ok := sequence.Back().Value.(*action)
+	if !ok || a.isImmediate || a.isError {
+		return nil
+	}
+	return a
+}
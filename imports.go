@@ -0,0 +1,191 @@
+package peg
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/scanner"
+	gotoken "go/token"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+The import declarations of generated files are managed automatically.
+Packages referenced by actions, headers, or trailers, that have
+not been imported in a header, are looked up in knownPackages by
+their name. Imports that are not used, or that are specified more
+than once, e.g. in several header blocks, are dropped.
+*/
+var knownPackages = map[string]string{
+	"peg": "github.com/knieriem/peg",
+
+	"base64":   "encoding/base64",
+	"big":      "math/big",
+	"binary":   "encoding/binary",
+	"bufio":    "bufio",
+	"bytes":    "bytes",
+	"errors":   "errors",
+	"filepath": "path/filepath",
+	"fmt":      "fmt",
+	"hex":      "encoding/hex",
+	"io":       "io",
+	"ioutil":   "io/ioutil",
+	"json":     "encoding/json",
+	"list":     "container/list",
+	"log":      "log",
+	"math":     "math",
+	"os":       "os",
+	"path":     "path",
+	"reflect":  "reflect",
+	"regexp":   "regexp",
+	"sort":     "sort",
+	"strconv":  "strconv",
+	"strings":  "strings",
+	"sync":     "sync",
+	"time":     "time",
+	"unicode":  "unicode",
+	"utf16":    "unicode/utf16",
+	"utf8":     "unicode/utf8",
+}
+
+type importSpec struct {
+	name, path string
+	explicit   bool
+}
+
+// std reports whether the package is part of the standard library,
+// as the first element of its path does not contain a dot.
+func (s *importSpec) std() bool {
+	first := strings.SplitN(s.path, "/", 2)[0]
+	return !strings.Contains(first, ".")
+}
+
+func (s *importSpec) String() string {
+	if s.explicit {
+		return s.name + " " + strconv.Quote(s.path)
+	}
+	return strconv.Quote(s.path)
+}
+
+/*
+fixImports replaces the import declarations of a generated file by
+a single one, containing the packages the file actually uses.
+Package names that are not imported by the file itself are resolved
+using known, then using knownPackages. The packages imported by the
+resulting file are returned too. If src can not be parsed, it is
+returned unchanged, so that the compiler will report the error.
+Imports following other declarations, as from a header block
+placed between rules, are accepted, and moved to the top.
+*/
+func fixImports(src []byte, known map[string]string) ([]byte, map[string]string) {
+	fset := gotoken.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, 0)
+	if err != nil && !onlyLateImports(err) {
+		return src, nil
+	}
+
+	// Identifiers that are not resolved within the file,
+	// and are used as qualifiers, are package names.
+	var refs []string
+	used := make(map[string]bool)
+	ast.Inspect(f, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if id, ok := sel.X.(*ast.Ident); ok && id.Obj == nil && !used[id.Name] {
+				used[id.Name] = true
+				refs = append(refs, id.Name)
+			}
+		}
+		return true
+	})
+
+	var specs []*importSpec
+	have := make(map[string]bool)
+	add := func(s *importSpec) {
+		if key := s.String(); !have[key] {
+			have[key] = true
+			specs = append(specs, s)
+		}
+	}
+	imported := make(map[string]string)
+	for _, is := range f.Imports {
+		s := new(importSpec)
+		s.path, _ = strconv.Unquote(is.Path.Value)
+		s.name = path.Base(s.path)
+		if is.Name != nil {
+			s.name, s.explicit = is.Name.Name, true
+		}
+		switch {
+		case s.name == "_" || s.name == ".":
+			add(s)
+		case used[s.name]:
+			if _, ok := imported[s.name]; !ok {
+				imported[s.name] = s.path
+				add(s)
+			}
+		}
+	}
+	for _, name := range refs {
+		if _, ok := imported[name]; ok {
+			continue
+		}
+		p, ok := known[name]
+		if !ok {
+			p, ok = knownPackages[name]
+		}
+		if !ok {
+			// probably declared in another file of the package
+			continue
+		}
+		imported[name] = p
+		add(&importSpec{name: name, path: p, explicit: path.Base(p) != name})
+	}
+
+	// Like goimports, list the packages of the standard library first,
+	// separated from the others by an empty line, each group sorted by path.
+	sort.SliceStable(specs, func(i, j int) bool {
+		if a, b := specs[i].std(), specs[j].std(); a != b {
+			return a
+		}
+		return specs[i].path < specs[j].path
+	})
+	var b bytes.Buffer
+	last := fset.Position(f.Name.End()).Offset
+	b.Write(src[:last])
+	if len(specs) != 0 {
+		b.WriteString("\n\nimport (\n")
+		for i, s := range specs {
+			if i > 0 && s.std() != specs[i-1].std() {
+				b.WriteString("\n")
+			}
+			b.WriteString("\t" + s.String() + "\n")
+		}
+		b.WriteString(")")
+	}
+	for _, d := range f.Decls {
+		if gd, ok := d.(*ast.GenDecl); ok && gd.Tok == gotoken.IMPORT {
+			b.Write(src[last:fset.Position(gd.Pos()).Offset])
+			last = fset.Position(gd.End()).Offset
+			if last < len(src) && src[last] == '\n' {
+				last++
+			}
+		}
+	}
+	b.Write(src[last:])
+	return b.Bytes(), imported
+}
+
+func onlyLateImports(err error) bool {
+	list, ok := err.(scanner.ErrorList)
+	if !ok {
+		return false
+	}
+	for _, e := range list {
+		if e.Msg != "imports must appear before other declarations" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,175 @@
+package golden
+
+import (
+	"github.com/knieriem/peg"
+)
+
+// Cases lists the grammars compared with golden files,
+// each described by a comment in leg syntax.
+var Cases = []*Case{
+	{Name: "alternates", Build: alternates},
+	{Name: "stars", Build: stars},
+	{Name: "switch", Inline: true, Switch: true, Optimizations: "all", Build: switchCase},
+	{Name: "variables", Build: variables},
+	{Name: "constructors", Build: constructors},
+}
+
+/*
+	Start	= 'a' 'b' | 'c' | [d-f] Rest
+	Rest	= "xy" | .
+*/
+func alternates(t *peg.Tree) {
+	t.AddRule("Start")
+	t.AddString("a")
+	t.AddString("b")
+	t.AddSequence()
+	t.AddString("c")
+	t.AddAlternate()
+	t.AddClass("d-f")
+	t.AddName("Rest")
+	t.AddSequence()
+	t.AddAlternate()
+	t.AddExpression()
+
+	t.AddRule("Rest")
+	t.AddString("xy")
+	t.AddDot()
+	t.AddAlternate()
+	t.AddExpression()
+}
+
+/*
+	Start	= 'a'* [0-9]+ 'b'? !.
+*/
+func stars(t *peg.Tree) {
+	t.AddRule("Start")
+	t.AddString("a")
+	t.AddStar()
+	t.AddClass("0-9")
+	t.AddPlus()
+	t.AddSequence()
+	t.AddString("b")
+	t.AddQuery()
+	t.AddSequence()
+	t.AddDot()
+	t.AddPeekNot()
+	t.AddSequence()
+	t.AddExpression()
+}
+
+/*
+	Start	= Number | Word | '(' Start ')'
+	Number	= [0-9]+
+	Word	= [a-z]+
+*/
+func switchCase(t *peg.Tree) {
+	t.AddRule("Start")
+	t.AddName("Number")
+	t.AddName("Word")
+	t.AddAlternate()
+	t.AddString("(")
+	t.AddName("Start")
+	t.AddSequence()
+	t.AddString(")")
+	t.AddSequence()
+	t.AddAlternate()
+	t.AddExpression()
+
+	t.AddRule("Number")
+	t.AddClass("0-9")
+	t.AddPlus()
+	t.AddExpression()
+
+	t.AddRule("Word")
+	t.AddClass("a-z")
+	t.AddPlus()
+	t.AddExpression()
+}
+
+/*
+	%YYSTYPE int
+
+	Sum	= l:Num ( '+' r:Num { l += r } )* { $$ = l } commit
+	Num	= < [0-9]+ > { $$, _ = strconv.Atoi(yytext) }
+*/
+func variables(t *peg.Tree) {
+	t.Define("yystype", "int")
+
+	t.AddRule("Sum")
+	t.AddVariable("l")
+	t.AddName("Num")
+	t.AddString("+")
+	t.AddVariable("r")
+	t.AddName("Num")
+	t.AddSequence()
+	t.AddAction(" l += r ")
+	t.AddSequence()
+	t.AddStar()
+	t.AddSequence()
+	t.AddAction(" $$ = l ")
+	t.AddSequence()
+	t.AddCommit()
+	t.AddSequence()
+	t.AddExpression()
+
+	t.AddRule("Num")
+	t.AddBegin()
+	t.AddClass("0-9")
+	t.AddPlus()
+	t.AddSequence()
+	t.AddEnd()
+	t.AddSequence()
+	t.AddAction(" $$, _ = strconv.Atoi(yytext) ")
+	t.AddSequence()
+	t.AddExpression()
+}
+
+/*
+	%YYSTYPE int
+
+	Sum	= l:Num ( '+' r:Num { l += r } | '-' r:Num { l -= r } )* !. ~{ println("junk") } { $$ = l }
+	Num	= < [0-9]+ > { $$, _ = strconv.Atoi(yytext) }
+
+built using the constructors of nodes, instead of the stack.
+*/
+func constructors(t *peg.Tree) {
+	t.Define("yystype", "int")
+
+	op := func(sign, code string) peg.Node {
+		return must(peg.NewSequence(must(peg.NewString(sign)), must(peg.NewVariable("r", "Num")), must(peg.NewAction(code))))
+	}
+	sum := must(peg.NewSequence(
+		must(peg.NewVariable("l", "Num")),
+		must(peg.NewStar(must(peg.NewAlternate(op("+", " l += r "), op("-", " l -= r "))))),
+		must(peg.NewErrorAction(must(peg.NewPeekNot(peg.NewDot())), ` println("junk") `)),
+		must(peg.NewAction(" $$ = l ")),
+	))
+	num := must(peg.NewSequence(
+		peg.NewBegin(),
+		must(peg.NewPlus(must(peg.NewClass("0-9")))),
+		peg.NewEnd(),
+		must(peg.NewAction(" $$, _ = strconv.Atoi(yytext) ")),
+	))
+	for _, r := range []struct {
+		name string
+		expr peg.Node
+	}{{"Sum", sum}, {"Num", num}} {
+		if err := t.AppendRule(mustRule(peg.NewRule(r.name, r.expr))); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func must(n peg.Node, err error) peg.Node {
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func mustRule(r peg.Rule, err error) peg.Rule {
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
@@ -0,0 +1,68 @@
+/*
+Package golden compares the code generated for small grammars, each
+exercising a feature like ordered choices, repetitions, the -switch
+optimization, or variables, with golden files, so that changes to
+the code generator, like to its templates, show up as differences,
+which can be reviewed before the golden files are updated. The cases
+are run by command golden, like
+
+	go run ./cmd/golden          # report differences
+	go run ./cmd/golden -update  # rewrite the golden files
+*/
+package golden
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/knieriem/peg"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// A Case is a grammar, built by calling the methods of a Tree,
+// and the options it is compiled with.
+type Case struct {
+	Name           string // of the golden file, without suffix .go
+	Inline, Switch bool
+	Optimizations  string
+	Build          func(t *peg.Tree)
+}
+
+// Compile builds the grammar of the case, and returns the code
+// generated from it.
+func (c *Case) Compile() ([]byte, error) {
+	t := peg.New(c.Inline, c.Switch)
+	t.Define("package", "main")
+	c.Build(t)
+	var b bytes.Buffer
+	if _, err := t.Compile(&b, c.Optimizations); err != nil {
+		return nil, fmt.Errorf("%s: %v", c.Name, err)
+	}
+	return b.Bytes(), nil
+}
+
+// Check compares the code generated for the case with its golden
+// file within dir, returning an error that tells the first line
+// differing. If update is set, the golden file is written instead.
+func (c *Case) Check(dir string, update bool) error {
+	file := filepath.Join(dir, c.Name+".go")
+	code, err := c.Compile()
+	if err != nil {
+		return err
+	}
+	if update {
+		return ioutil.WriteFile(file, code, 0666)
+	}
+	return peg.CheckGenerated(file, code)
+}
+
+// Run checks each of Cases against the golden files within dir,
+// and returns the errors found.
+func Run(dir string, update bool) (errs []error) {
+	for _, c := range Cases {
+		if err := c.Check(dir, update); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return
+}
@@ -0,0 +1,532 @@
+package peg
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/*
+An Interpreter matches input directly against the rules of a Tree,
+without generating and compiling a parser first. Unless Eval is set,
+actions are not executed; error and immediate actions never are.
+Semantic predicates and changes of the user state always succeed,
+and counted matches @{ ... } match the empty string, since all of
+them consist of Go code.
+*/
+type Interpreter struct {
+	// If Trace is not nil, each rule invocation and
+	// its result are written to it.
+	Trace io.Writer
+
+	// MaxDepth limits the nesting of rule invocations,
+	// which protects against left recursive rules.
+	MaxDepth int
+
+	// If Eval is not nil, it executes the code of actions, with
+	// $$ replaced by yy, like EvalAction does. As in a generated
+	// parser, actions are queued, and executed when a commit is
+	// reached, which fails within a nested rule, if actions are
+	// pending from before it, unless %commit nested is given.
+	Eval func(code string, env *ActionEnv) error
+
+	rules   map[string]*rule
+	classes map[string]classEntry
+	nested  bool
+}
+
+// A Match describes the part of the input a rule
+// has matched, and the matches of its sub-rules.
+type Match struct {
+	Rule       string
+	Begin, End int
+	Sub        []*Match
+
+	// Value is the semantic value assigned to $$ by the last
+	// action executed, if Eval is set; it is only recorded for
+	// the match returned by Parse.
+	Value interface{}
+
+	// Captures holds the offsets of the texts matched by
+	// the captures < >, in the order of their ends, like the
+	// Captures of a generated parser; it is only recorded for
+	// the match returned by Parse.
+	Captures [][2]int
+}
+
+func NewInterpreter(t *Tree) *Interpreter {
+	t.resolveEmpty()
+	ip := &Interpreter{MaxDepth: 10000, rules: make(map[string]*rule), classes: t.Classes, nested: t.defines["commit"] == "nested"}
+	for el := t.Front(); el != nil; el = el.Next() {
+		if r, ok := el.Value.(*rule); ok {
+			ip.rules[r.String()] = r
+		}
+	}
+	return ip
+}
+
+// FirstRule returns the name of the first rule of the grammar,
+// which is applied by the generated parser when Parse(0) is called.
+func (t *Tree) FirstRule() string {
+	for el := t.Front(); el != nil; el = el.Next() {
+		if r, ok := el.Value.(*rule); ok {
+			return r.String()
+		}
+	}
+	return ""
+}
+
+// StartRule returns the name of the rule defined using
+// %start, or the name of the first rule.
+func (t *Tree) StartRule() string {
+	if name := t.defines["start"]; name != "" {
+		return name
+	}
+	return t.FirstRule()
+}
+
+type interpError struct {
+	msg string
+}
+
+/*
+Parse applies the rule named start to buffer. The end of the
+returned Match tells how much of the input has been consumed.
+*/
+func (ip *Interpreter) Parse(start, buffer string) (m *Match, err error) {
+	var (
+		position, max, depth int
+		stack                []*Match
+
+		// stack of indentation columns, see Tree.AddIndent
+		indents   = []struct{ col, parent int }{{0, -1}}
+		indentTop int
+
+		// queued actions, and the changes of the stack of the
+		// semantic values of variables, as in a generated parser
+		thunks     []thunk
+		entries    []int // lengths of thunks at the entries of the active rules
+		begin, end int
+		values     []interface{}
+		yyp        int
+		yy         interface{}
+		captures   [][2]int
+	)
+	defer func() {
+		if e := recover(); e != nil {
+			ie, ok := e.(interpError)
+			if !ok {
+				panic(e)
+			}
+			m, err = nil, fmt.Errorf("%s: %s", lineCol(buffer, position), ie.msg)
+		}
+	}()
+
+	top := &Match{}
+	stack = append(stack, top)
+
+	var match func(node Node) bool
+	matchRule := func(r *rule) bool {
+		if r.expression == nil {
+			panic(interpError{fmt.Sprintf("rule '%v' used but not defined", r)})
+		}
+		if depth++; depth > ip.MaxDepth {
+			panic(interpError{fmt.Sprintf("rule '%v' nested too deeply, possibly left recursive", r)})
+		}
+		indent := strings.Repeat("  ", depth-1)
+		if ip.Trace != nil {
+			fmt.Fprintf(ip.Trace, "%s%v @%s\n", indent, r, lineCol(buffer, position))
+		}
+		m := &Match{Rule: r.String(), Begin: position}
+		stack = append(stack, m)
+		entry := len(thunks)
+		entries = append(entries, entry)
+		nvar := len(r.variables)
+		if ip.Eval != nil && nvar != 0 {
+			thunks = append(thunks, thunk{kind: thunkPush, n: nvar})
+		}
+		ok := match(r.expression)
+		if ip.Eval != nil && nvar != 0 {
+			if ok {
+				thunks = append(thunks, thunk{kind: thunkPop, n: nvar})
+			} else if entry < len(thunks) {
+				thunks = thunks[:entry]
+			}
+		}
+		entries = entries[:len(entries)-1]
+		stack = stack[:len(stack)-1]
+		depth--
+		if ok {
+			m.End = position
+			parent := stack[len(stack)-1]
+			parent.Sub = append(parent.Sub, m)
+		}
+		if ip.Trace != nil {
+			if ok {
+				fmt.Fprintf(ip.Trace, "%s%v ok, %q\n", indent, r, buffer[m.Begin:m.End])
+			} else {
+				fmt.Fprintf(ip.Trace, "%s%v failed\n", indent, r)
+			}
+		}
+		return ok
+	}
+	fail := func() bool {
+		if position > max {
+			max = position
+		}
+		return false
+	}
+	// state describes what has to be restored after a failed
+	// attempt, besides the position
+	type state struct {
+		nsub, indentTop, nthunks, ncaptures int
+	}
+	// restore resets the position and the indentation, and drops
+	// sub-matches, actions and captures that have been added during
+	// a failed attempt; actions executed by a commit in between are kept.
+	restore := func(pos int, s state) {
+		position = pos
+		indentTop = s.indentTop
+		m := stack[len(stack)-1]
+		m.Sub = m.Sub[:s.nsub]
+		if s.nthunks < len(thunks) {
+			thunks = thunks[:s.nthunks]
+		}
+		captures = captures[:s.ncaptures]
+	}
+	mark := func() state {
+		return state{len(stack[len(stack)-1].Sub), indentTop, len(thunks), len(captures)}
+	}
+	// commit executes the queued actions.
+	commit := func() {
+		for _, th := range thunks {
+			switch th.kind {
+			case thunkPush:
+				if yyp += th.n; yyp >= len(values) {
+					values = append(values, make([]interface{}, yyp+1-len(values))...)
+				}
+			case thunkPop:
+				yyp -= th.n
+			case thunkSet:
+				values[yyp+th.n] = yy
+			case thunkAction:
+				vars := th.action.rule.variables
+				env := &ActionEnv{Text: th.text, Begin: th.begin, Value: yy, Vars: make(map[string]interface{}, len(vars))}
+				for _, v := range vars {
+					env.Vars[v.name] = values[yyp+v.offset]
+				}
+				if err := ip.Eval(th.action.text, env); err != nil {
+					panic(interpError{fmt.Sprintf("rule '%v': action { %s }: %v", th.action.rule, strings.TrimSpace(th.action.source), err)})
+				}
+				yy = env.Value
+				for _, v := range vars {
+					values[yyp+v.offset] = env.Vars[v.name]
+				}
+			}
+		}
+		thunks = thunks[:0]
+	}
+
+	match = func(node Node) bool {
+		switch node.GetType() {
+		case TypeRule:
+			return matchRule(node.(*rule))
+		case TypeName:
+			r, ok := ip.rules[node.String()]
+			if !ok {
+				panic(interpError{fmt.Sprintf("rule '%v' used but not defined", node)})
+			}
+			if !matchRule(r) {
+				return false
+			}
+			if v := node.(*name).varp; v != nil && ip.Eval != nil {
+				thunks = append(thunks, thunk{kind: thunkSet, n: v.offset})
+			}
+			return true
+		case TypeDot:
+			if position < len(buffer) {
+				position++
+				return true
+			}
+			return fail()
+		case TypeCharacter, TypeString:
+			s := unescape(node.String())
+			if strings.HasPrefix(buffer[position:], s) {
+				position += len(s)
+				return true
+			}
+			return fail()
+		case TypeClass:
+			c := node.(Token).GetClass()
+			if c == nil {
+				c = ip.classes[node.String()].Class
+			}
+			if position < len(buffer) && c.has(buffer[position]) {
+				position++
+				return true
+			}
+			return fail()
+		case TypeAction:
+			if a := node.(*action); ip.Eval != nil && !a.isImmediate && !a.isError {
+				th := thunk{kind: thunkAction, action: a, begin: begin}
+				if begin <= end {
+					th.text = buffer[begin:end]
+				}
+				thunks = append(thunks, th)
+			}
+			return true
+		case TypeCommit:
+			if ip.Eval != nil {
+				if !ip.nested && entries[len(entries)-1] != 0 {
+					return fail()
+				}
+				commit()
+			}
+			return true
+		case TypeBegin:
+			begin = position
+			return true
+		case TypeEnd:
+			end = position
+			captures = append(captures, [2]int{begin, end})
+			return true
+		case TypePredicate, TypeBytes, TypeState, TypeNil:
+			return true
+		case TypeAnchor:
+			if atAnchor(node.String(), buffer, position) {
+				return true
+			}
+			return fail()
+		case TypeIndent:
+			col := position - strings.LastIndexByte(buffer[:position], '\n') - 1
+			switch top := indents[indentTop]; node.String() {
+			case "%indent":
+				if col > top.col {
+					indents = append(indents, struct{ col, parent int }{col, indentTop})
+					indentTop = len(indents) - 1
+					return true
+				}
+			case "%dedent":
+				if indentTop != 0 {
+					indentTop = top.parent
+					return true
+				}
+			case "%samedent":
+				if col == top.col {
+					return true
+				}
+			}
+			return fail()
+		case TypeUnorderedAlternate:
+			// Like the switch generated for -switch, only the branch
+			// whose class contains the next byte is tried, or the last
+			// one, as the default, if its class is larger than two.
+			if position == len(buffer) {
+				return fail()
+			}
+			c := buffer[position]
+			for el := node.(List).Front(); el != nil; el = el.Next() {
+				seq := el.Value.(List).Front()
+				class := seq.Value.(List).Front().Value.(Node).(Token).GetClass()
+				if class.has(c) || el.Next() == nil && class.len() > 2 {
+					pos, s := position, mark()
+					if match(seq.Next().Value.(Node)) {
+						return true
+					}
+					restore(pos, s)
+					return false
+				}
+			}
+			return fail()
+		case TypeAlternate:
+			pos, s := position, mark()
+			for el := node.(List).Front(); el != nil; el = el.Next() {
+				if match(el.Value.(Node)) {
+					return true
+				}
+				restore(pos, s)
+			}
+			return false
+		case TypeSequence:
+			pos, s := position, mark()
+			for el := node.(List).Front(); el != nil; el = el.Next() {
+				if !match(el.Value.(Node)) {
+					restore(pos, s)
+					return false
+				}
+			}
+			return true
+		case TypeError:
+			return match(node.(List).Front().Value.(Node))
+		case TypePeekFor, TypePeekNot:
+			pos, s := position, mark()
+			ok := match(node.(List).Front().Value.(Node))
+			restore(pos, s)
+			if ok != (node.GetType() == TypePeekFor) {
+				return fail()
+			}
+			return true
+		case TypeQuery:
+			pos, s := position, mark()
+			if !match(node.(List).Front().Value.(Node)) {
+				restore(pos, s)
+			}
+			return true
+		case TypeStar, TypePlus:
+			sub := node.(List).Front().Value.(Node)
+			if node.GetType() == TypePlus && !match(sub) {
+				return false
+			}
+			for {
+				pos, s := position, mark()
+				if !match(sub) {
+					restore(pos, s)
+					break
+				}
+				if position == pos {
+					break
+				}
+			}
+			return true
+		}
+		panic(interpError{fmt.Sprintf("illegal node type: %v", node.GetType())})
+	}
+
+	r, ok := ip.rules[start]
+	if !ok {
+		return nil, fmt.Errorf("no such rule: %s", start)
+	}
+	if !matchRule(r) {
+		return nil, fmt.Errorf("%s: syntax error", lineCol(buffer, max))
+	}
+	top.Sub[0].Value = yy
+	top.Sub[0].Captures = captures
+	return top.Sub[0], nil
+}
+
+// A thunk is an entry of the queue of actions of an Interpreter.
+type thunk struct {
+	kind   int
+	n      int // number of variables, or offset of a variable
+	action *action
+	text   string
+	begin  int
+}
+
+const (
+	thunkAction = iota
+	thunkPush
+	thunkPop
+	thunkSet
+)
+
+// Fprint writes the tree of matches to w, one line per rule,
+// showing the matched text.
+func (m *Match) Fprint(w io.Writer, buffer string) {
+	var print func(m *Match, indent string)
+	print = func(m *Match, indent string) {
+		fmt.Fprintf(w, "%s%s %d-%d %q\n", indent, m.Rule, m.Begin, m.End, buffer[m.Begin:m.End])
+		for _, sub := range m.Sub {
+			print(sub, indent+"  ")
+		}
+	}
+	print(m, "")
+}
+
+// lineCol converts a buffer offset into a "line:column" string.
+func lineCol(buffer string, offset int) string {
+	line, col := 1, 0
+	for i := 0; i < offset && i < len(buffer); i++ {
+		if buffer[i] == '\n' {
+			line++
+			col = 0
+		} else {
+			col++
+		}
+	}
+	return fmt.Sprintf("%d:%d", line, col)
+}
+
+// atAnchor reports whether the assertion anchor, as
+// accepted by Tree.AddAnchor, holds at position pos.
+func atAnchor(anchor, buffer string, pos int) bool {
+	isWord := func(i int) bool {
+		if i < 0 || i >= len(buffer) {
+			return false
+		}
+		c := buffer[i]
+		return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+	}
+	switch anchor {
+	case `\A`:
+		return pos == 0
+	case `\z`:
+		return pos == len(buffer)
+	case "^":
+		return pos == 0 || buffer[pos-1] == '\n'
+	case `\b`:
+		return isWord(pos-1) != isWord(pos)
+	}
+	return false
+}
+
+// Unescape interprets the escape sequences that may be contained
+// in literals of a grammar, as returned by the String method of
+// their nodes.
+func Unescape(s string) string { return unescape(s) }
+
+func unescape(s string) string {
+	if strings.IndexByte(s, '\\') == -1 {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) {
+			var n int
+			c, n = unescapeByte(s[i+1:])
+			i += n
+		}
+		b = append(b, c)
+	}
+	return string(b)
+}
+
+// unescapeByte interprets the escape sequence at the start of s,
+// which follows a backslash, and returns the resulting byte, and
+// the length of the sequence.
+func unescapeByte(s string) (c byte, n int) {
+	switch c = s[0]; c {
+	case 'a':
+		c = '\a' /* bel */
+	case 'b':
+		c = '\b' /* bs */
+	case 'e':
+		c = '\033' /* esc */
+	case 'f':
+		c = '\f' /* ff */
+	case 'n':
+		c = '\n' /* nl */
+	case 'r':
+		c = '\r' /* cr */
+	case 't':
+		c = '\t' /* ht */
+	case 'v':
+		c = '\v' /* vt */
+	case '0', '1', '2', '3', '4', '5', '6', '7':
+		c -= '0'
+		// as in the grammars, three digits are read only up to \377
+		for n = 1; n < 3 && n < len(s) && s[n] >= '0' && s[n] <= '7' && (n < 2 || s[0] <= '3'); n++ {
+			c = c*8 + s[n] - '0'
+		}
+		return
+	case 'x':
+		if len(s) >= 3 {
+			if v, err := strconv.ParseUint(s[1:3], 16, 8); err == nil {
+				return byte(v), 3
+			}
+		}
+	}
+	return c, 1
+}
@@ -0,0 +1,340 @@
+package peg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+/*
+CompileJS writes a recognizer for the grammar to w as an ECMAScript
+module, in TypeScript, if ts is true, or in JavaScript otherwise.
+This way, the grammar used by the parser in Go can validate input
+in a browser too. Like in the generated parser, the input is matched
+in its UTF-8 encoding, byte by byte. As actions, semantic predicates,
+changes of the user state, and counted matches @{ ... } consist of
+Go code, they are handled as by the Interpreter: actions are not
+executed, predicates and state changes always succeed, and counted
+matches match the empty string.
+
+The module exports the ids of the rules as object rules, and a
+function parse(input, rule), which returns null, if the rule,
+by default the start rule, matches at the beginning of input,
+or an error otherwise, having properties line and pos, and a
+message like that of the error returned by Parse of the generated
+parser. Like WriteGrammar, it must be called before the tree is
+compiled.
+*/
+func (t *Tree) CompileJS(w io.Writer, ts bool) error {
+	t.resolveEmpty()
+	b := bufio.NewWriter(w)
+	ids := make(map[string]int)
+	var rules []*rule
+	for el := t.Front(); el != nil; el = el.Next() {
+		if r, ok := el.Value.(*rule); ok {
+			ids[r.name] = len(rules)
+			rules = append(rules, r)
+		}
+	}
+	if _, ok := ids[t.StartRule()]; !ok {
+		return fmt.Errorf("start rule '%s' not defined", t.StartRule())
+	}
+	c := &jsCompiler{t: t, ids: ids, literals: make(map[string]int)}
+	var code []string
+	for _, r := range rules {
+		if r.expression == nil {
+			return fmt.Errorf("rule '%v' used but not defined", r)
+		}
+		code = append(code, c.expression(r.expression))
+	}
+	classes := make([][]uint8, len(t.Classes))
+	for _, e := range t.Classes {
+		classes[e.Index] = e.Class[:]
+	}
+	tmpl := template.Must(template.New("js").Funcs(template.FuncMap{
+		"ts":  func() bool { return ts },
+		"def": func(key string) string { return t.defines[key] },
+		"bytes": func(b []uint8) string {
+			s := make([]string, len(b))
+			for i, c := range b {
+				s[i] = strconv.Itoa(int(c))
+			}
+			return strings.Join(s, ", ")
+		},
+	}).Parse(jsTemplate))
+	err := tmpl.Execute(b, map[string]interface{}{
+		"Rules":    rules,
+		"Code":     code,
+		"Start":    ids[t.StartRule()],
+		"Literals": c.literalList,
+		"Classes":  classes,
+	})
+	if err != nil {
+		return err
+	}
+	return b.Flush()
+}
+
+type jsCompiler struct {
+	t           *Tree
+	ids         map[string]int
+	literals    map[string]int // indexes into literalList
+	literalList [][]uint8
+}
+
+// expression returns a JavaScript expression matching node, which
+// evaluates to true or false, and restores the position on failure.
+func (c *jsCompiler) expression(node Node) string {
+	sub := func() string { return c.expression(node.(List).Front().Value.(Node)) }
+	switch node.GetType() {
+	case TypeName:
+		id, ok := c.ids[node.String()]
+		if !ok {
+			// reported by the Go backend; fails on use
+			return "undefinedRule(" + strconv.Quote(node.String()) + ")"
+		}
+		return fmt.Sprintf("r[%d]()", id)
+	case TypeDot:
+		return "dot()"
+	case TypeCharacter, TypeString:
+		s := unescape(node.String())
+		i, ok := c.literals[s]
+		if !ok {
+			i = len(c.literalList)
+			c.literals[s] = i
+			c.literalList = append(c.literalList, []uint8(s))
+		}
+		return fmt.Sprintf("str(lit[%d])", i)
+	case TypeClass:
+		return fmt.Sprintf("cls(classes[%d])", c.t.Classes[node.String()].Index)
+	case TypePredicate, TypeBytes, TypeState, TypeAction, TypeCommit, TypeBegin, TypeEnd, TypeNil:
+		return "true"
+	case TypeAnchor:
+		return "anchor(" + strconv.Quote(node.String()) + ")"
+	case TypeIndent:
+		return "indent(" + strconv.Quote(node.String()) + ")"
+	case TypeAlternate, TypeUnorderedAlternate:
+		var alts []string
+		for el := node.(List).Front(); el != nil; el = el.Next() {
+			e := c.expression(el.Value.(Node))
+			if el != node.(List).Front() {
+				e = "(reset(), " + e + ")"
+			}
+			alts = append(alts, e)
+		}
+		return "(mark(), (" + strings.Join(alts, " || ") + ") ? drop() : back())"
+	case TypeSequence:
+		var elems []string
+		for el := node.(List).Front(); el != nil; el = el.Next() {
+			elems = append(elems, c.expression(el.Value.(Node)))
+		}
+		return "(mark(), (" + strings.Join(elems, " && ") + ") ? drop() : back())"
+	case TypeError:
+		return sub()
+	case TypePeekFor:
+		return "((mark(), peek(" + sub() + ")) || fail())"
+	case TypePeekNot:
+		return "(!(mark(), peek(" + sub() + ")) || fail())"
+	case TypeQuery:
+		return "(mark(), " + sub() + " ? drop() : !back())"
+	case TypeStar:
+		return "star(() => " + sub() + ")"
+	case TypePlus:
+		return "plus(() => " + sub() + ")"
+	}
+	panic(fmt.Sprintf("illegal node type: %v", node.GetType()))
+}
+
+var jsTemplate = strings.Replace(`// Code generated from a peg grammar; DO NOT EDIT.
+
+// ids of the rules, as accepted by parse
+export const rules = Object.freeze({
+{{range $i, $r := .Rules}}	{{printf "%q" $r.String}}: {{$i}},
+{{end}}});
+
+const startRule = {{.Start}};
+
+const lit{{if ts}}: number[][]{{end}} = [
+{{range .Literals}}	[{{bytes .}}],
+{{end}}];
+
+const classes{{if ts}}: number[][]{{end}} = [
+{{range .Classes}}	[{{bytes .}}],
+{{end}}];
+
+{{if ts}}\
+export interface ParseError extends Error {
+	line: number;
+	pos: number;
+}
+
+{{end}}\
+/**
+ * Applies a rule, by default the start rule, to the UTF-8 encoding
+ * of input. It returns null, if the rule matches, or an error
+ * otherwise, whose line and pos, the position within the line,
+ * count from 1.
+ */
+export function parse(input{{if ts}}: string{{end}}, rule{{if ts}}: number{{end}} = startRule){{if ts}}: ParseError | null{{end}} {
+	const buf = new TextEncoder().encode(input);
+	let pos = 0, max = 0, begin = 0;
+{{if def "bom"}}\
+	if (buf.length >= 3 && buf[0] === 0xef && buf[1] === 0xbb && buf[2] === 0xbf) {
+		pos = max = begin = 3; // skip a UTF-8 byte order mark
+	}
+{{end}}\
+
+	// stack of indentation columns
+	const indents = [{ col: 0, parent: -1 }];
+	let indentTop = 0;
+
+	// saved positions, and tops of the indentation stack
+	const marks{{if ts}}: number[]{{end}} = [];
+	const mark = () => { marks.push(pos, indentTop); };
+	const reset = () => { pos = marks[marks.length - 2]; indentTop = marks[marks.length - 1]; };
+	const drop = () => { marks.length -= 2; return true; };
+	const back = () => { reset(); return !drop(); };
+	const peek = (ok{{if ts}}: boolean{{end}}) => { back(); return ok; };
+
+	const fail = () => {
+		if (pos > max) {
+			max = pos;
+		}
+		return false;
+	};
+	const dot = () => pos < buf.length ? (pos++, true) : fail();
+	const str = (s{{if ts}}: number[]{{end}}) => {
+		if (pos + s.length > buf.length) {
+			return fail();
+		}
+		for (let i = 0; i < s.length; i++) {
+			if (buf[pos + i] !== s[i]) {
+				return fail();
+			}
+		}
+		pos += s.length;
+		return true;
+	};
+	const cls = (c{{if ts}}: number[]{{end}}) => pos < buf.length && (c[buf[pos] >> 3] & (1 << (buf[pos] & 7))) !== 0 ? (pos++, true) : fail();
+	const star = (f{{if ts}}: () => boolean{{end}}) => {
+		for (;;) {
+			const p = pos;
+			mark();
+			if (!f()) {
+				back();
+				return true;
+			}
+			drop();
+			if (pos === p) {
+				return true;
+			}
+		}
+	};
+	const plus = (f{{if ts}}: () => boolean{{end}}) => f() && star(f);
+	const isWord = (i{{if ts}}: number{{end}}) => {
+		if (i < 0 || i >= buf.length) {
+			return false;
+		}
+		const c = buf[i];
+		return c === 0x5f || c >= 0x30 && c <= 0x39 || c >= 0x61 && c <= 0x7a || c >= 0x41 && c <= 0x5a;
+	};
+	const anchor = (a{{if ts}}: string{{end}}) => {
+		let ok = false;
+		switch (a) {
+		case "\\A":
+			ok = pos === 0;
+			break;
+		case "\\z":
+			ok = pos === buf.length;
+			break;
+		case "^":
+			ok = pos === 0 || buf[pos - 1] === 0x0a;
+			break;
+		case "\\b":
+			ok = isWord(pos - 1) !== isWord(pos);
+			break;
+		}
+		return ok || fail();
+	};
+	const indent = (op{{if ts}}: string{{end}}) => {
+		let i = pos > 0 ? buf.lastIndexOf(0x0a, pos - 1) + 1 : 0;
+{{if def "bom"}}\
+		if (i === 0 && begin === 3) {
+			i = 3;
+		}
+{{end}}\
+		const col = pos - i, top = indents[indentTop];
+		switch (op) {
+		case "%indent":
+			if (col > top.col) {
+				indents.push({ col: col, parent: indentTop });
+				indentTop = indents.length - 1;
+				return true;
+			}
+			break;
+		case "%dedent":
+			if (indentTop !== 0) {
+				indentTop = top.parent;
+				return true;
+			}
+			break;
+		case "%samedent":
+			if (col === top.col) {
+				return true;
+			}
+			break;
+		}
+		return fail();
+	};
+	const undefinedRule = (name{{if ts}}: string{{end}}){{if ts}}: boolean{{end}} => {
+		throw new Error("rule '" + name + "' used but not defined");
+	};
+
+	const r{{if ts}}: (() => boolean)[]{{end}} = [
+{{range $i, $r := .Rules}}		// {{$r.String}}
+		() => {{index $.Code $i}},
+{{end}}	];
+	if (r[rule]()) {
+		return null;
+	}
+
+	// at returns the position of the character at offset end, counted
+	// like by the Go parser. As commits are not executed, an unexpected
+	// end of file is reported after the first character, like a failure
+	// of the Go parser before the first commit.
+	const at = (end{{if ts}}: number{{end}}) => {
+		let line = 1, col = 0;
+		for (let i = begin; i <= end; i++) {
+{{if def "crlf"}}\
+			if (buf[i] === 0x0d && buf[i + 1] === 0x0a) {
+				continue;
+			}
+{{end}}\
+			if (buf[i] === 0x0a) {
+				line++;
+				col = 0;
+			} else if ((buf[i] & 0xc0) !== 0x80) {
+				col++;
+			}
+		}
+		return [line, col];
+	};
+	let line = 0, col = 0, msg{{if ts}}: string{{end}};
+	if (max >= buf.length) {
+		if (begin !== max && begin < buf.length) {
+			[line, col] = at(begin);
+		}
+		msg = "unexpected end of file";
+	} else {
+		[line, col] = at(max);
+		msg = "unexpected character '" + String.fromCharCode(buf[max]) + "'";
+	}
+	const err = new Error(line + ":" + col + ": " + msg){{if ts}} as ParseError{{end}};
+	err.line = line;
+	err.pos = col;
+	return err;
+}
+`, "\\\n", "", -1)
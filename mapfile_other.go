@@ -0,0 +1,18 @@
+//go:build !darwin && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!freebsd,!linux,!netbsd,!openbsd
+
+package peg
+
+import (
+	"io/ioutil"
+)
+
+// MapFile returns the contents of the named file as a string.
+// On this system, the file is read into memory; release does nothing.
+func MapFile(name string) (data string, release func() error, err error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return
+	}
+	return string(b), func() error { return nil }, nil
+}
@@ -0,0 +1,51 @@
+//go:build darwin || freebsd || linux || netbsd || openbsd
+// +build darwin freebsd linux netbsd openbsd
+
+package peg
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+/*
+MapFile returns the contents of the named file as a string.
+On systems that support it, the string refers to a read-only memory
+mapping of the file, so that large inputs need not be copied into
+memory. The string, and all strings derived from it, must not be used
+anymore after release has been called.
+*/
+func MapFile(name string) (data string, release func() error, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	size := fi.Size()
+	if size == 0 || !fi.Mode().IsRegular() || int64(int(size)) != size {
+		return readFile(name)
+	}
+	b, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return readFile(name)
+	}
+	data = *(*string)(unsafe.Pointer(&b))
+	release = func() error {
+		return syscall.Munmap(b)
+	}
+	return
+}
+
+func readFile(name string) (data string, release func() error, err error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return
+	}
+	return string(b), func() error { return nil }, nil
+}
@@ -0,0 +1,153 @@
+package peg
+
+import (
+	"fmt"
+	"strings"
+)
+
+// An Import is a grammar to be imported, as declared by a directive
+// like `%import common "common.leg"` of a leg grammar.
+type Import struct {
+	Namespace string // qualifies the names of the imported rules, if not empty
+	File      string // relative to the importing grammar
+}
+
+// AddImport records an import, given by the text of the directive
+// following %import: an optional namespace, and the name of the file
+// in double quotes. Imports are resolved by the caller of the parser,
+// using Imports and Import.
+func (t *Tree) AddImport(spec string) {
+	spec = strings.TrimSpace(spec)
+	i := strings.IndexByte(spec, '"')
+	if i == -1 {
+		return
+	}
+	imp := Import{Namespace: strings.TrimSpace(spec[:i]), File: strings.Trim(spec[i:], `"`)}
+	for _, other := range t.imports {
+		if other == imp {
+			return
+		}
+	}
+	t.imports = append(t.imports, imp)
+}
+
+// Imports returns the imports declared by the grammar,
+// in the order of their appearance.
+func (t *Tree) Imports() []Import {
+	return t.imports
+}
+
+/*
+Import adds the rules of the grammar contained in m, which must have
+been read from a file, so that messages about its rules refer to
+it, and whose imports must have been resolved already. If namespace
+is not empty, the imported rules are renamed, like Identifier to
+common.Identifier, as well as the references between them, so
+that grammars defining rules of the same name can be imported into
+different namespaces. References of the imported grammar to rules it
+does not define are qualified too, and so do not refer to rules of
+the importing grammar.
+
+Markers of the imported rules, like @token, %private, and
+%switchexcl, are kept, and headers are added, unless already
+present, so they must not contain a package clause; the defines,
+and the trailers of m are ignored. An error is
+returned, if an imported rule is already defined. The tree m must
+not be used afterwards.
+*/
+func (t *Tree) Import(m *Tree, namespace string) error {
+	qualify := func(name string) string {
+		if namespace == "" {
+			return name
+		}
+		return namespace + "." + name
+	}
+	file := ""
+	if len(m.files) != 0 {
+		file = m.files[0]
+	}
+	defined := make(map[string]bool)
+	for el := t.Front(); el != nil; el = el.Next() {
+		if r, ok := el.Value.(*rule); ok && r.expression != nil {
+			defined[r.name] = true
+		}
+	}
+	var rules []*rule
+	for el := m.Front(); el != nil; el = el.Next() {
+		if r, ok := el.Value.(*rule); ok && r.expression != nil {
+			if name := qualify(r.name); defined[name] {
+				return fmt.Errorf("rule '%s' imported from %s is already defined", name, file)
+			}
+			rules = append(rules, r)
+		}
+	}
+
+	for _, r := range rules {
+		if namespace != "" {
+			Inspect(r.expression, func(node Node) bool {
+				if n, ok := node.(*name); ok {
+					n.string = qualify(n.string)
+				}
+				return true
+			})
+		}
+		r.name = qualify(r.name)
+		r.id = t.ruleId
+		t.ruleId++
+		if r.file == "" {
+			r.file = file
+		}
+		t.PushBack(r)
+	}
+	for name := range m.rules {
+		if _, ok := t.rules[qualify(name)]; !ok {
+			t.rules[qualify(name)] = &rule{}
+		}
+	}
+	for _, a := range m.Actions {
+		a.id = len(t.Actions)
+		t.Actions = append(t.Actions, a)
+	}
+	// in the order of m's indices, so that the output is stable
+	classes := make([]string, len(m.Classes))
+	for text, c := range m.Classes {
+		classes[c.Index] = text
+	}
+	for _, text := range classes {
+		if _, ok := t.Classes[text]; !ok {
+			t.Classes[text] = classEntry{len(t.Classes), m.Classes[text].Class}
+		}
+	}
+
+	for _, name := range sortedNames(m.tokens) {
+		t.MakeToken(qualify(name))
+	}
+	for _, name := range sortedNames(m.traced) {
+		t.MakeTraced(qualify(name))
+	}
+	for _, name := range sortedNames(m.noInline) {
+		t.MakeNoInline(qualify(name))
+	}
+	for _, name := range sortedNames(m.private) {
+		t.MakePrivate(qualify(name))
+	}
+	for _, name := range sortedNames(m.switchExcl) {
+		t.SwitchExclude(qualify(name))
+	}
+	for _, a := range m.firstAsserts {
+		t.firstAsserts = append(t.firstAsserts, firstAssert{qualify(a.rule), a.class})
+	}
+headers:
+	for _, h := range m.Headers {
+		for _, other := range t.Headers {
+			if h == other {
+				continue headers
+			}
+		}
+		t.AddHeader(h)
+	}
+	for _, f := range m.files {
+		t.AddFile(f)
+	}
+	return nil
+}
@@ -0,0 +1,334 @@
+package peg
+
+import (
+	"errors"
+	"fmt"
+	"go/parser"
+	gotoken "go/token"
+	"strings"
+)
+
+/*
+The constructors of this file build the nodes of a grammar directly,
+for programs creating grammars, as an alternative to the methods of
+Tree like AddString and AddSequence, which are driven by the parser of
+a grammar, and operate on a stack, so that calling them in an
+unexpected order panics, or silently builds a wrong tree. Invalid
+arguments, like a class with an invalid escape sequence, or an action
+that is not valid Go code, are reported as errors instead. Rules are
+created using NewRule, and added to a tree using AppendRule, e.g.
+
+	digit, _ := peg.NewClass("0-9")
+	number, _ := peg.NewPlus(digit)
+	r, _ := peg.NewRule("Number", number)
+	err := t.AppendRule(r)
+
+Nodes are not shared: each must be used once only within the
+expressions of a tree, except for those returned by NewDot, NewBegin,
+NewEnd, NewCommit, and NewNil.
+*/
+
+func NewDot() Node    { return dot }
+func NewBegin() Node  { return begin }
+func NewEnd() Node    { return end }
+func NewCommit() Node { return commit }
+func NewNil() Node    { return nilNode }
+
+// escapeError returns the first error reported by checkEscapes.
+func escapeError(text, what string) (err error) {
+	checkEscapes(text, what, func(format string, a ...interface{}) {
+		if err == nil {
+			err = fmt.Errorf(format, a...)
+		}
+	})
+	return
+}
+
+// NewString returns a literal, given by its text as written between
+// quotes in a grammar, which may contain escape sequences.
+func NewString(text string) (Node, error) {
+	if err := escapeError(text, "literal '"+text+"'"); err != nil {
+		return nil, err
+	}
+	return newString(text), nil
+}
+
+// NewClass returns a character class, given by its text as written
+// between brackets in a grammar, like "^a-z_". Besides invalid escape
+// sequences, an unescaped ']', and ranges whose first character is
+// greater than the last one, are reported.
+func NewClass(text string) (Node, error) {
+	what := "class [" + text + "]"
+	if err := escapeError(text, what); err != nil {
+		return nil, err
+	}
+	// next returns the possibly escaped character at text[i:],
+	// and the index following it, like within ParseClass
+	next := func(i int) (byte, int) {
+		if text[i] == '\\' {
+			b, n := unescapeByte(text[i+1:])
+			return b, i + 1 + n
+		}
+		return text[i], i + 1
+	}
+	i := 0
+	if strings.HasPrefix(text, "^") {
+		i = 1
+	}
+	for i < len(text) {
+		if text[i] == ']' {
+			return nil, fmt.Errorf("%s: unescaped ']'", what)
+		}
+		var lo, hi byte
+		start := i
+		lo, i = next(i)
+		if i+1 < len(text) && text[i] == '-' {
+			if hi, i = next(i + 1); lo > hi {
+				return nil, fmt.Errorf("%s: invalid range %s", what, text[start:i])
+			}
+		}
+	}
+	return &token{Type: TypeClass, string: text}, nil
+}
+
+// isRuleName reports whether s is a valid name of a rule,
+// which may be qualified by the namespaces of imports.
+func isRuleName(s string) bool {
+	for _, part := range strings.Split(s, ".") {
+		if part == "" || part[0] >= '0' && part[0] <= '9' {
+			return false
+		}
+		for i := 0; i < len(part); i++ {
+			switch c := part[i]; {
+			case c == '-', c == '_':
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// NewName returns a reference to the rule of the given name.
+func NewName(rule string) (Node, error) {
+	if !isRuleName(rule) {
+		return nil, fmt.Errorf("invalid rule name '%s'", rule)
+	}
+	return &name{Type: TypeName, string: rule}, nil
+}
+
+// NewVariable returns a reference to a rule, whose semantic value
+// is assigned to a variable of the rule it appears in, like e:Expr.
+// References using the same variable within a rule share it.
+func NewVariable(varName, rule string) (Node, error) {
+	if !gotoken.IsIdentifier(varName) {
+		return nil, fmt.Errorf("invalid variable name '%s'", varName)
+	}
+	n, err := NewName(rule)
+	if err != nil {
+		return nil, err
+	}
+	n.(*name).varp = &variable{name: varName}
+	return n, nil
+}
+
+// NewPredicate returns a semantic predicate, like &{ n < 3 },
+// given by a Go expression.
+func NewPredicate(code string) (Node, error) {
+	if _, err := parser.ParseExpr(code); err != nil {
+		return nil, fmt.Errorf("predicate &{ %s }: %v", strings.TrimSpace(code), err)
+	}
+	return &token{Type: TypePredicate, string: strings.TrimSpace(code)}, nil
+}
+
+// checkCode returns an error, if code is not a valid sequence of Go
+// statements; what names it in the message.
+func checkCode(code, what string) error {
+	src := "package p; func _() {\n" + code + "\n}"
+	if _, err := parser.ParseFile(gotoken.NewFileSet(), "", src, 0); err != nil {
+		return fmt.Errorf("%s: %v", what, err)
+	}
+	return nil
+}
+
+// NewAction returns an action, like { $$ = n }, which is executed
+// at a commit; $$ denotes the semantic value of the rule.
+func NewAction(code string) (Node, error) {
+	text := replaceDollars(code)
+	if err := checkCode(text, "action {"+code+"}"); err != nil {
+		return nil, err
+	}
+	return &action{text: text, source: code}, nil
+}
+
+// NewImmediateAction returns an action, like {! ... }, that is
+// executed as soon as the parser reaches it; see AddImmediateAction.
+func NewImmediateAction(code string) (Node, error) {
+	if err := checkCode(code, "immediate action {!"+code+"}"); err != nil {
+		return nil, err
+	}
+	return &action{text: code, source: code, isImmediate: true}, nil
+}
+
+// NewErrorAction returns expression n, followed by an error action,
+// like ~{ ... }, which is executed when n fails.
+func NewErrorAction(n Node, code string) (Node, error) {
+	if n == nil {
+		return nil, errors.New("error action ~{" + code + "} without expression")
+	}
+	if err := checkCode(code, "error action ~{"+code+"}"); err != nil {
+		return nil, err
+	}
+	l := &nodeList{Type: TypeError}
+	l.PushBack(n)
+	l.PushBack(&action{text: code, source: code, isError: true})
+	return l, nil
+}
+
+// newList returns a list of nodes; what, like "sequence",
+// names it in messages.
+func newList(listType Type, what string, nodes []Node) (Node, error) {
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("%s without nodes", what)
+	}
+	for _, n := range nodes {
+		if n == nil {
+			return nil, fmt.Errorf("%s containing a nil node", what)
+		}
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	l := &nodeList{Type: listType}
+	for _, n := range nodes {
+		l.PushBack(n)
+	}
+	return l, nil
+}
+
+// NewSequence returns the sequence of nodes, or the node itself,
+// if there is only one.
+func NewSequence(nodes ...Node) (Node, error) { return newList(TypeSequence, "sequence", nodes) }
+
+// NewAlternate returns the ordered choice between nodes, or the node
+// itself, if there is only one.
+func NewAlternate(nodes ...Node) (Node, error) { return newList(TypeAlternate, "alternate", nodes) }
+
+func newFix(fixType Type, what string, n Node) (Node, error) {
+	if n == nil {
+		return nil, fmt.Errorf("%s of a nil node", what)
+	}
+	l := &nodeList{Type: fixType}
+	l.PushBack(n)
+	return l, nil
+}
+
+func NewPeekFor(n Node) (Node, error) { return newFix(TypePeekFor, "&-predicate", n) }
+func NewPeekNot(n Node) (Node, error) { return newFix(TypePeekNot, "!-predicate", n) }
+func NewQuery(n Node) (Node, error)   { return newFix(TypeQuery, "option", n) }
+func NewStar(n Node) (Node, error)    { return newFix(TypeStar, "repetition", n) }
+func NewPlus(n Node) (Node, error)    { return newFix(TypePlus, "repetition", n) }
+
+// NewRule returns a rule of the given name, matching expression,
+// to be added to a tree using AppendRule.
+func NewRule(name string, expression Node) (Rule, error) {
+	if !isRuleName(name) {
+		return nil, fmt.Errorf("invalid rule name '%s'", name)
+	}
+	if expression == nil {
+		return nil, fmt.Errorf("rule '%s' without expression", name)
+	}
+	return &rule{name: name, expression: expression}, nil
+}
+
+// shared reports whether a node may appear more than once in a tree.
+func shared(n Node) bool {
+	return n == dot || n == begin || n == end || n == commit || n == nilNode
+}
+
+/*
+AppendRule adds a rule created by NewRule to the tree, registering
+the classes, actions, and variables of its expression, like the
+parser of a grammar does. An error is returned, and the tree is left
+unchanged, if a rule of the same name has been defined already, if a
+node of the expression is used twice, or belongs to another rule, or
+if a rule is still being defined using the methods operating on the
+stack.
+*/
+func (t *Tree) AppendRule(r Rule) error {
+	rr, ok := r.(*rule)
+	switch {
+	case !ok:
+		return errors.New("rule not created by NewRule")
+	case len(t.stack) != 0:
+		return errors.New("cannot append a rule while another one is being defined")
+	}
+	for el := t.Front(); el != nil; el = el.Next() {
+		if other, ok := el.Value.(*rule); ok && other.name == rr.name {
+			return fmt.Errorf("rule '%s' is already defined", rr.name)
+		}
+	}
+
+	var err error
+	seen := make(map[Node]bool)
+	Inspect(rr.expression, func(node Node) bool {
+		switch {
+		case err != nil:
+			return false
+		case node == nil, shared(node):
+			return true
+		case seen[node]:
+			err = fmt.Errorf("rule '%s': node %v used twice", rr.name, node)
+			return false
+		}
+		seen[node] = true
+		if a, ok := node.(*action); ok && a.rule != nil {
+			err = fmt.Errorf("rule '%s': action {%s} already belongs to rule '%v'", rr.name, a.source, a.rule)
+		}
+		if n, ok := node.(*name); ok && n.varp != nil && n.varp.offset != 0 {
+			err = fmt.Errorf("rule '%s': variable %s:%s already belongs to another rule", rr.name, n.varp.name, n.string)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	rr.id = t.ruleId
+	t.ruleId++
+	Inspect(rr.expression, func(node Node) bool {
+		switch n := node.(type) {
+		case *name:
+			if _, ok := t.rules[n.string]; !ok {
+				t.rules[n.string] = &rule{}
+			}
+			if n.varp == nil {
+				break
+			}
+			v := n.varp
+			for _, other := range rr.variables {
+				if other.name == v.name {
+					n.varp = other
+					return true
+				}
+			}
+			v.offset = -1 - len(rr.variables)
+			rr.variables = append(rr.variables, v)
+		case *action:
+			n.id = len(t.Actions)
+			n.rule = rr
+			if !n.isError && !n.isImmediate {
+				rr.hasActions = true
+			}
+			t.Actions = append(t.Actions, n)
+		case *token:
+			if _, ok := t.Classes[n.string]; n.Type == TypeClass && !ok {
+				t.Classes[n.string] = classEntry{len(t.Classes), ParseClass(n.string)}
+			}
+		}
+		return true
+	})
+	t.PushBack(rr)
+	return nil
+}
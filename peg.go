@@ -5,16 +5,25 @@
 package peg
 
 import (
+	"bytes"
 	"container/list"
+	"errors"
 	"fmt"
+	"go/scanner"
+	gotoken "go/token"
 	"io"
-	"log"
-	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 )
 
-var Verbose bool
+// If WarnLeftRecursion is set, Compile only warns about left recursive
+// rules, instead of failing, as the generated parser would not terminate
+// once it applies one of them.
+var WarnLeftRecursion bool
 
 type Type uint8
 
@@ -41,6 +50,11 @@ const (
 	TypeStar
 	TypePlus
 	TypeNil
+	TypeError
+	TypeAnchor
+	TypeBytes
+	TypeIndent
+	TypeState
 	TypeLast
 )
 
@@ -66,7 +80,9 @@ type rule struct {
 	id         int
 	expression Node
 	hasActions bool
-	variables  map[string]*variable
+	variables  []*variable // in order of their first appearance
+	line       int         // of the definition, if recorded by SetRulePos
+	file       string      // of an imported rule
 }
 
 func (r *rule) GetType() Type {
@@ -95,7 +111,7 @@ func (r *rule) String() string {
 func (r *rule) GoString() string {
 	b := []byte(r.String())
 	for i := 0; i < len(b); i++ {
-		if b[i] == '-' {
+		if b[i] == '-' || b[i] == '.' {
 			b[i] = '_'
 		}
 	}
@@ -125,16 +141,16 @@ func (t *name) String() string {
 /* Used to represent TypeDot, TypeCharacter, TypeString, TypeClass, TypePredicate, and TypeNil. */
 type Token interface {
 	Node
-	GetClass() *characterClass
+	GetClass() *CharacterClass
 }
 
 type token struct {
 	Type
 	string string
-	class *characterClass
+	class *CharacterClass
 }
 
-func (t *token) GetClass() *characterClass {
+func (t *token) GetClass() *CharacterClass {
 	return t.class
 }
 
@@ -152,9 +168,18 @@ type Action interface {
 }
 
 type action struct {
-	text string
-	id   int
-	rule *rule
+	text   string
+	source string // text as written in the grammar
+	id     int
+	rule   *rule
+
+	// An error action is executed immediately,
+	// when the preceding expression fails.
+	isError bool
+
+	// An immediate action is executed as soon as the parser
+	// reaches it, instead of being deferred until a commit.
+	isImmediate bool
 }
 
 func (a *action) GetType() Type {
@@ -165,20 +190,21 @@ func (a *action) String() string {
 	return a.text
 }
 
-func (a *action) Code() (s string) {
-	vmap := a.rule.variables
+func (a *action) code(rename func(string) string) (s string) {
+	vars := a.rule.variables
 	ind := "\t\t\t"
-	off := 0
-	for _, v := range vmap {
-		off--
-		if v.offset == 0 {
-			v.offset = off
+	if a.isError || a.isImmediate {
+		for _, d := range readVariables(vars, a.text, rename) {
+			s += ind + d + "\n"
 		}
-		s += fmt.Sprintf(ind+"%s := yyval[yyp%d]\n", v.name, v.offset)
+		vars = nil
+	}
+	for _, v := range vars {
+		s += fmt.Sprintf(ind+rename("%s := yyval[yyp%d]\n"), v.name, v.offset)
 	}
 	s += fmt.Sprintf(ind+"%v\n", a)
-	for _, v := range vmap {
-		s += fmt.Sprintf(ind+"yyval[yyp%d] = %s\n", v.offset, v.name)
+	for _, v := range vars {
+		s += fmt.Sprintf(ind+rename("yyval[yyp%d] = %s\n"), v.offset, v.name)
 	}
 	return
 }
@@ -191,7 +217,10 @@ func (a *action) GetRule() string {
 	return a.rule.String()
 }
 
-/* Used to represent a TypeAlternate, TypeSequence, TypePeekFor, TypePeekNot, TypeQuery, TypeStar, or TypePlus */
+/*
+Used to represent a TypeAlternate, TypeSequence, TypePeekFor, TypePeekNot, TypeQuery, TypeStar, or TypePlus,
+or a TypeError, which contains an expression followed by its error action.
+*/
 
 type List interface {
 	Node
@@ -221,105 +250,9 @@ func (l *nodeList) String() string {
 	return s + ")"
 }
 
-/* Used to represent character classes. */
-type characterClass [32]uint8
-
-func (c *characterClass) copy() (class *characterClass) {
-	class = new(characterClass)
-	copy(class[0:], c[0:])
-	return
-}
-func (c *characterClass) add(character uint8)      { c[character>>3] |= (1 << (character & 7)) }
-func (c *characterClass) has(character uint8) bool { return c[character>>3]&(1<<(character&7)) != 0 }
-func (c *characterClass) complement() {
-	for i := range *c {
-		c[i] = ^c[i]
-	}
-}
-func (c *characterClass) union(class *characterClass) {
-	for index, value := range *class {
-		c[index] |= value
-	}
-}
-func (c *characterClass) intersection(class *characterClass) {
-	for index, value := range *class {
-		c[index] &= value
-	}
-}
-func (c *characterClass) len() (length int) {
-	for character := 0; character < 256; character++ {
-		if c.has(uint8(character)) {
-			length++
-		}
-	}
-	return
-}
-func (c *characterClass) String() (class string) {
-	escape := func(c uint8) string {
-		s := ""
-		switch uint8(c) {
-		case '\a':
-			s = `\a` /* bel */
-		case '\b':
-			s = `\b` /* bs */
-		case '\f':
-			s = `\f` /* ff */
-		case '\n':
-			s = `\n` /* nl */
-		case '\r':
-			s = `\r` /* cr */
-		case '\t':
-			s = `\t` /* ht */
-		case '\v':
-			s = `\v` /* vt */
-		case '\'':
-			s = `\'` /* ' */
-		case '"':
-			s = `\"` /* " */
-		case '[':
-			s = `\[` /* [ */
-		case ']':
-			s = `\]` /* ] */
-		case '\\':
-			s = `\\` /* \ */
-		case '-':
-			s = `\-` /* - */
-		default:
-			switch {
-			case c >= 0 && c < 32 || c >= 0x80:
-				s = fmt.Sprintf("\\%03o", c)
-			default:
-				s = fmt.Sprintf("%c", c)
-			}
-		}
-		return s
-	}
-	class = ""
-	l := 0
-	for character := 0; character < 256; character++ {
-		if c.has(uint8(character)) {
-			if l == 0 {
-				class += escape(uint8(character))
-			}
-			l++
-		} else {
-			if l == 2 {
-				class += escape(uint8(character - 1))
-			} else if l > 2 {
-				class += "-" + escape(uint8(character-1))
-			}
-			l = 0
-		}
-	}
-	if l >= 2 {
-		class += "-" + escape(255)
-	}
-	return
-}
-
 type classEntry struct {
 	Index int
-	Class *characterClass
+	Class *CharacterClass
 }
 
 /* A tree data structure into which a PEG can be parsed. */
@@ -330,14 +263,24 @@ type Tree struct {
 	varp       *variable
 	Headers    []string
 	trailers   []string
+	files      []string
 	list.List
 	Actions         []*action
 	Classes         map[string]classEntry
 	defines         map[string]string
 	switchExcl      map[string]bool
-	stack           [1024]Node
-	top             int
+	flags           map[string]bool // tested by %if sections
+	private         map[string]bool
+	firstAsserts    []firstAssert
+	tokens          map[string]bool
+	traced          map[string]bool
+	noInline        map[string]bool
+	stack           []Node // the rule being defined, and its pending expressions
+	errors          []string
+	imports         []Import
 	inline, _switch bool
+	report          *Report    // of the compilation in progress
+	reportMu        sync.Mutex // guards report, written by the tasks of join
 }
 
 func New(inline, _switch bool) *Tree {
@@ -345,29 +288,60 @@ func New(inline, _switch bool) *Tree {
 		rulesCount: make(map[string]uint),
 		Classes:    make(map[string]classEntry),
 		defines: map[string]string{
-			"package":   "",
-			"Peg":       "yyParser",
-			"userstate": "",
-			"yystype":   "yyStype",
-			"noexport":   "",
+			"package":      "",
+			"Peg":          "yyParser",
+			"userstate":    "",
+			"yystype":      "yyStype",
+			"noexport":     "",
+			"prefix":       "",
+			"rulestack":    "",
+			"bom":          "",
+			"crlf":         "",
+			"parsefile":    "",
+			"start":        "",
+			"spans":        "",
+			"yyspan":       "",
+			"state":        "",
+			"undo":         "",
+			"commit":       "",
+			"empty":        "",
+			"memo":         "",
+			"metrics":      "",
+			"trace":        "",
+			"maxdepth":     "",
+			"iterative":    "",
+			"partial":      "",
+			"ambiguity":    "",
+			"recognize":    "",
+			"inlinereport": "",
+			"captures":     "",
+			"generics":     "",
+			"thunks":       initialSizes[0].def,
+			"values":       initialSizes[1].def,
 		},
 		inline:  inline,
 		_switch: _switch}
 }
 
+// defines specifying the initial lengths of the queue of thunks,
+// and of the stack of semantic values, with their default values
+var initialSizes = []struct{ name, def string }{
+	{"thunks", "32"},
+	{"values", "256"},
+}
+
 func (t *Tree) push(n Node) {
-	t.top++
-	t.stack[t.top] = n
+	t.stack = append(t.stack, n)
 }
 
 func (t *Tree) pop() Node {
-	n := t.stack[t.top]
-	t.top--
+	n := t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
 	return n
 }
 
 func (t *Tree) currentRule() *rule {
-	return t.stack[1].(*rule)
+	return t.stack[0].(*rule)
 }
 
 func (t *Tree) AddRule(name string) {
@@ -375,6 +349,194 @@ func (t *Tree) AddRule(name string) {
 	t.ruleId++
 }
 
+/*
+Rules returns the rules of the grammar in the order of their
+definition. Rules are numbered from 0 in this order, as they are
+added by AddRule, AppendRule, Import, or Decode, so that the id of a
+rule, returned by GetId, is its index within the result, and the
+value of its constant in the generated parser, like ruleExpr, which
+Parse accepts. Reduce renumbers the remaining rules.
+*/
+func (t *Tree) Rules() (rules []Rule) {
+	for el := t.Front(); el != nil; el = el.Next() {
+		if r, ok := el.Value.(*rule); ok {
+			rules = append(rules, r)
+		}
+	}
+	return
+}
+
+// Rule returns the rule of the given name,
+// or nil, if there is no such rule.
+func (t *Tree) Rule(name string) Rule {
+	for el := t.Front(); el != nil; el = el.Next() {
+		if r, ok := el.Value.(*rule); ok && r.name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// renumberRules assigns consecutive ids to the rules,
+// in the order of their definition, after rules have been removed.
+func (t *Tree) renumberRules() {
+	t.ruleId = 0
+	for el := t.Front(); el != nil; el = el.Next() {
+		if r, ok := el.Value.(*rule); ok {
+			r.id = t.ruleId
+			t.ruleId++
+		}
+	}
+}
+
+// SetRulePos records the position of the rule being defined, given
+// as offset into text, the grammar, so that messages about the rule,
+// like about left recursion, can refer to the line of its definition.
+func (t *Tree) SetRulePos(text string, offset int) {
+	if offset <= len(text) {
+		t.currentRule().line = strings.Count(text[:offset], "\n") + 1
+	}
+}
+
+// rulePos returns the position of a rule's definition, like
+// "file.peg:12: ", to prefix messages about the rule with, or the
+// empty string, if it is not known.
+func (t *Tree) rulePos(r *rule) string {
+	switch {
+	case r.line == 0:
+		return ""
+	case r.file != "":
+		return fmt.Sprintf("%s:%d: ", r.file, r.line)
+	case len(t.files) == 0:
+		return fmt.Sprintf("line %d: ", r.line)
+	}
+	return fmt.Sprintf("%s:%d: ", t.files[0], r.line)
+}
+
+// errorf records an error of the grammar, found while the current
+// rule is defined, prefixed with the line of the rule, if known.
+func (t *Tree) errorf(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	if len(t.stack) != 0 {
+		if r, ok := t.stack[0].(*rule); ok {
+			msg = fmt.Sprintf("rule '%v': %s", r, msg)
+			if r.line != 0 {
+				msg = fmt.Sprintf("%d: %s", r.line, msg)
+			}
+		}
+	}
+	t.errors = append(t.errors, msg)
+}
+
+// Err returns the errors found while the grammar has been built,
+// like invalid escape sequences, one per line, or nil.
+func (t *Tree) Err() error {
+	if len(t.errors) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(t.errors, "\n"))
+}
+
+// checkEscapes reports an error, using errorf, for each invalid escape
+// sequence of text, the text of a literal, or a class, as written in a
+// grammar; what, like "class [a-z]", names it in the messages.
+func checkEscapes(text, what string, errorf func(format string, a ...interface{})) {
+	isHex := func(c byte) bool {
+		return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+	}
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\\' {
+			continue
+		}
+		switch i++; {
+		case i == len(text):
+			errorf("%s ends with a backslash", what)
+		case strings.IndexByte(`abefnrtv'"[]\-01234567`, text[i]) != -1:
+		case text[i] == 'x' && i+2 < len(text) && isHex(text[i+1]) && isHex(text[i+2]):
+		default:
+			errorf("%s: invalid escape sequence %s", what, text[i-1:i+1])
+		}
+	}
+}
+
+// An inlineReport lists, for each rule that has been inlined, why,
+// and the rules whose code contains its expression.
+type inlineReport struct {
+	into   map[*rule]map[*rule]bool
+	reason map[*rule]string
+}
+
+func (r *inlineReport) add(inlined, into *rule, reason string) {
+	if r.into == nil {
+		r.into = make(map[*rule]map[*rule]bool)
+		r.reason = make(map[*rule]string)
+	}
+	if r.into[inlined] == nil {
+		r.into[inlined] = make(map[*rule]bool)
+	}
+	r.into[inlined][into] = true
+	r.reason[inlined] = reason
+}
+
+// write prints the report to stderr, in the order of the rules
+// within the grammar.
+func (r *inlineReport) write(t *Tree) {
+	var rules []*rule
+	for el := t.Front(); el != nil; el = el.Next() {
+		if x, ok := el.Value.(*rule); ok {
+			rules = append(rules, x)
+		}
+	}
+	for _, x := range rules {
+		if r.into[x] == nil {
+			continue
+		}
+		var names []string
+		for _, into := range rules {
+			if r.into[x][into] {
+				names = append(names, "'"+into.String()+"'")
+			}
+		}
+		t.report.Decisions = append(t.report.Decisions, fmt.Sprintf("%srule '%v' (%s) inlined into %s", t.rulePos(x), x, r.reason[x], strings.Join(names, ", ")))
+	}
+}
+
+// reportRecursion reports a cycle of left recursive rules, each
+// applying the next one, and the last one the first, before input
+// is consumed, unless the cycle has been reported already.
+func (t *Tree) reportRecursion(cycle []*rule, reported map[string]bool) {
+	first := 0
+	for i, r := range cycle {
+		if r.id < cycle[first].id {
+			first = i
+		}
+	}
+	cycle = append(append([]*rule{}, cycle[first:]...), cycle[:first]...)
+	names := make([]string, len(cycle)+1)
+	for i, r := range cycle {
+		names[i] = r.name
+	}
+	names[len(cycle)] = cycle[0].name
+	key := strings.Join(names, " ")
+	if reported[key] {
+		return
+	}
+	reported[key] = true
+	// unless WarnLeftRecursion is set, compilation fails
+	reportf := t.compileErrorf
+	if WarnLeftRecursion {
+		reportf = t.warnf
+	}
+	if len(cycle) == 1 {
+		reportf("%sinfinite direct left recursion: %s\n", t.rulePos(cycle[0]), strings.Join(names, " -> "))
+		return
+	}
+	reportf("%sinfinite indirect left recursion: %s\n", t.rulePos(cycle[0]), strings.Join(names, " -> "))
+	for i, r := range cycle {
+		reportf("%s\trule '%v' may apply '%v' before consuming input\n", t.rulePos(r), r, names[i+1])
+	}
+}
+
 func (t *Tree) AddExpression() {
 	expression := t.pop()
 	rule := t.pop().(Rule)
@@ -390,20 +552,111 @@ func (t *Tree) AddTrailer(text string) {
 	t.trailers = append(t.trailers, text)
 }
 
+// AddVariable declares a variable of the current rule, like e in
+// e:Expr, unless it has been declared already. Variables are assigned
+// the offsets -1, -2, ... of the stack of semantic values in the order
+// of their first appearance, so that the generated code is stable.
 func (t *Tree) AddVariable(text string) {
-	var v *variable
-
 	r := t.currentRule()
-	if r.variables == nil {
-		r.variables = make(map[string]*variable)
-	}
-	if v = r.variables[text]; v == nil {
-		v = &variable{name: text}
+	for _, v := range r.variables {
+		if v.name == text {
+			t.varp = v
+			return
+		}
 	}
-	r.variables[text] = v
+	v := &variable{name: text, offset: -1 - len(r.variables)}
+	r.variables = append(r.variables, v)
 	t.varp = v
 }
 
+// checkVariables fails, if a variable of a rule has the name of a Go
+// keyword, or of an identifier the code of actions refers to, like
+// yytext, or yy, the latter ones being renamed using rename, which
+// would be redeclared, or silently shadowed by the variable.
+func (t *Tree) checkVariables(rename func(string) string) {
+	generated := map[string]bool{"yy": true, "yytext": true, "begin": true, "p": true}
+	for _, name := range []string{"yyp", "yyval", "yyvalue"} {
+		generated[rename(name)] = true
+	}
+	failed := false
+	for element := t.Front(); element != nil; element = element.Next() {
+		r, ok := element.Value.(*rule)
+		if !ok {
+			continue
+		}
+		for _, v := range r.variables {
+			switch {
+			case gotoken.Lookup(v.name).IsKeyword():
+				t.compileErrorf("%srule '%v': variable '%s' is a Go keyword", t.rulePos(r), r, v.name)
+			case generated[v.name]:
+				t.compileErrorf("%srule '%v': variable '%s' collides with an identifier of the generated code", t.rulePos(r), r, v.name)
+			default:
+				continue
+			}
+			failed = true
+		}
+	}
+	if failed {
+		t.fail("invalid variable names")
+	}
+}
+
+// parseTimeCode returns the code of node, if it is a semantic
+// predicate, an immediate, or an error action, which are executed
+// while parsing, instead of being deferred until a commit.
+func parseTimeCode(node Node) (code string, ok bool) {
+	switch n := node.(type) {
+	case *token:
+		return n.string, n.Type == TypePredicate
+	case *action:
+		return n.text, n.isImmediate || n.isError
+	}
+	return
+}
+
+// readVariables returns the declarations of the variables of vars
+// that code, executed while parsing, refers to. They are initialized
+// with the values assigned by the actions executed at the last commit,
+// which the code may read, but not change.
+func readVariables(vars []*variable, code string, rename func(string) string) (decls []string) {
+	if len(vars) == 0 {
+		return
+	}
+	refs := make(map[string]bool)
+	for _, name := range identifiers(code) {
+		refs[name] = true
+	}
+	for _, v := range vars {
+		if refs[v.name] {
+			decls = append(decls, fmt.Sprintf(rename("%s := yyvalue(%d)"), v.name, v.offset))
+		}
+	}
+	return
+}
+
+// identifiers returns the identifiers of Go code src, that are
+// not the selector of a qualified identifier, in order.
+func identifiers(src string) (names []string) {
+	var (
+		s    scanner.Scanner
+		prev gotoken.Token
+	)
+	fset := gotoken.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+	s.Init(file, []byte(src), func(gotoken.Position, string) {}, 0)
+	for {
+		_, tok, lit := s.Scan()
+		if tok == gotoken.EOF {
+			break
+		}
+		if tok == gotoken.IDENT && prev != gotoken.PERIOD {
+			names = append(names, lit)
+		}
+		prev = tok
+	}
+	return
+}
+
 func (t *Tree) AddName(text string) {
 	t.rules[text] = &rule{}
 	t.push(&name{Type: TypeName, string: text, varp: t.varp})
@@ -414,6 +667,13 @@ var dot *token = &token{Type: TypeDot, string: "."}
 
 func (t *Tree) AddDot() { t.push(dot) }
 func (t *Tree) AddString(text string) {
+	checkEscapes(text, "literal '"+text+"'", t.errorf)
+	t.push(newString(text))
+}
+
+// newString returns the node of a literal, which is a character,
+// if text describes a single, possibly escaped, byte.
+func newString(text string) *token {
 	length := len(text)
 s:
 	switch {
@@ -424,73 +684,63 @@ s:
 			case 2:
 				break s
 			case 4:
-				if text[1] >= '0' && text[1] <= '9' {
+				if text[1] >= '0' && text[1] <= '3' || text[1] == 'x' {
 					break s
 				}
 			}
 		}
 		fallthrough
 	default:
-		t.push(&token{Type: TypeString, string: text})
-		return
+		return &token{Type: TypeString, string: text}
 	}
-	t.push(&token{Type: TypeCharacter, string: text})
+	return &token{Type: TypeCharacter, string: text}
 }
 func (t *Tree) AddClass(text string) {
+	checkEscapes(text, "class ["+text+"]", t.errorf)
 	t.push(&token{Type: TypeClass, string: text})
 	if _, ok := t.Classes[text]; !ok {
-		c := new(characterClass)
-		t.Classes[text] = classEntry{len(t.Classes), c}
-		inverse := false
-		if text[0] == '^' {
-			inverse = true
-			text = text[1:]
-		}
-		var last uint8
-		hasLast := false
-		for i := 0; i < (len(text) - 1); i++ {
-			switch {
-			case (text[i] == '-') && hasLast:
-				i++
-				for j := last; j <= text[i]; j++ {
-					c.add(j)
-				}
-				hasLast = false
-			case (text[i] == '\\'):
-				i++
-				last, hasLast = text[i], true
-				switch last {
-				case 'a':
-					last = '\a' /* bel */
-				case 'b':
-					last = '\b' /* bs */
-				case 'f':
-					last = '\f' /* ff */
-				case 'n':
-					last = '\n' /* nl */
-				case 'r':
-					last = '\r' /* cr */
-				case 't':
-					last = '\t' /* ht */
-				case 'v':
-					last = '\v' /* vt */
-				}
-				c.add(last)
-			default:
-				last, hasLast = text[i], true
-				c.add(last)
-			}
-		}
-		c.add(text[len(text)-1])
-		if inverse {
-			c.complement()
-		}
+		t.Classes[text] = classEntry{len(t.Classes), ParseClass(text)}
 	}
 }
+
 func (t *Tree) AddPredicate(text string) {
 	t.push(&token{Type: TypePredicate, string: strings.TrimSpace(text)})
 }
 
+/*
+AddIndent pushes one of the primitives for indentation-sensitive
+grammars, which operate on a stack of indentation columns, initially
+containing column 0, and match the empty string: "%indent" succeeds
+if the current column is greater than the top of the stack, and
+pushes it, "%dedent" pops the top, unless it is the initial entry,
+and "%samedent" succeeds if the current column equals the top.
+Columns are counted in bytes from the beginning of the line. The
+stack is restored on backtracking, like the position.
+*/
+func (t *Tree) AddIndent(text string) { t.push(&token{Type: TypeIndent, string: text}) }
+
+/*
+AddPushState pushes an expression that makes the value of the Go
+expression text the new user state of the parser, which has been
+declared using the "state" define; AddPopState pushes one that
+returns to the previous state, failing if there is none. Both match
+the empty string. On backtracking, the state is restored together
+with the position. The string of a node created by AddPopState
+is empty.
+*/
+func (t *Tree) AddPushState(text string) {
+	t.push(&token{Type: TypeState, string: strings.TrimSpace(text)})
+}
+func (t *Tree) AddPopState() { t.push(&token{Type: TypeState}) }
+
+// AddBytes pushes an expression matching exactly as many bytes
+// as the Go expression text evaluates to, which happens when the
+// parser reaches it, e.g. to match the payload of a length-prefixed
+// record.
+func (t *Tree) AddBytes(text string) {
+	t.push(&token{Type: TypeBytes, string: strings.TrimSpace(text)})
+}
+
 var commit *token = &token{Type: TypeCommit, string: "commit"}
 
 func (t *Tree) AddCommit() { t.push(commit) }
@@ -499,19 +749,73 @@ var begin *token = &token{Type: TypeBegin, string: "<"}
 
 func (t *Tree) AddBegin() { t.push(begin) }
 
+// AddAnchor pushes an assertion that matches the empty string at
+// certain positions only: `\A` at the beginning of the input, `\z`
+// at its end, `^` at the beginning of a line, and `\b` at a word
+// boundary, i.e. between a character of [0-9A-Za-z_] and another
+// character, or the beginning or end of the input.
+func (t *Tree) AddAnchor(text string) { t.push(&token{Type: TypeAnchor, string: text}) }
+
 var end *token = &token{Type: TypeEnd, string: ">"}
 
 func (t *Tree) AddEnd() { t.push(end) }
 func (t *Tree) AddNil() { t.push(nilNode) }
 func (t *Tree) AddAction(text string) {
-	b := []byte(text)
-	for i := 0; i < len(b)-1; i++ {
-		if b[i] == '$' && b[i+1] == '$' {
-			b[i], b[i+1] = 'y', 'y'
+	a := &action{text: replaceDollars(text), source: text, id: len(t.Actions), rule: t.currentRule()}
+	t.currentRule().hasActions = true
+	t.Actions = append(t.Actions, a)
+	t.push(a)
+}
+
+/*
+replaceDollars returns the code of an action, with each $$, which
+denotes the semantic value of the rule, replaced by yy. As the code
+is split into Go tokens, a $$ within a string literal, or a comment,
+is kept, like in fmt.Sprint("$$", n), and a literal "$$" may be written
+in an action without any further escaping.
+*/
+func replaceDollars(src string) string {
+	if !strings.Contains(src, "$$") {
+		return src
+	}
+	var s scanner.Scanner
+	b := []byte(src)
+	fset := gotoken.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+	s.Init(file, []byte(src), func(gotoken.Position, string) {}, scanner.ScanComments)
+	dollar := -1 // offset of a preceding single $
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == gotoken.EOF {
+			break
+		}
+		if tok != gotoken.ILLEGAL || lit != "$" {
+			dollar = -1
+			continue
+		}
+		switch off := file.Offset(pos); {
+		case dollar != -1 && off == dollar+1:
+			b[dollar], b[off] = 'y', 'y'
+			dollar = -1
+		default:
+			dollar = off
 		}
 	}
-	a := &action{text: string(b), id: len(t.Actions), rule: t.currentRule()}
-	t.currentRule().hasActions = true
+	return string(b)
+}
+
+/*
+AddImmediateAction pushes an action, like leg's {! ... }, that is
+executed as soon as the parser reaches it, instead of being queued
+until the next commit. Like an error action, it may refer to yytext,
+the text of the last < > pair, and to position, but not to semantic
+values. It is not undone on backtracking, unless it registers a
+function doing so, using OnBacktrack of a parser generated with the
+"undo" define; and as it runs before any deferred action preceding
+it in the input, it must not depend on their effects.
+*/
+func (t *Tree) AddImmediateAction(text string) {
+	a := &action{text: text, source: text, id: len(t.Actions), rule: t.currentRule(), isImmediate: true}
 	t.Actions = append(t.Actions, a)
 	t.push(a)
 }
@@ -520,6 +824,87 @@ func (t *Tree) Define(name, text string) {
 		t.defines[name] = text
 	}
 }
+
+// SetFlag sets the value of a flag, that may be tested by %if
+// sections of a leg grammar, like by option -D. It takes precedence
+// over a later %define of the flag.
+func (t *Tree) SetFlag(name string, on bool) {
+	if t.flags == nil {
+		t.flags = make(map[string]bool)
+	}
+	t.flags[name] = on
+}
+
+// DefineFlag turns on a flag, unless it has been set already.
+func (t *Tree) DefineFlag(name string) {
+	if _, ok := t.flags[name]; !ok {
+		t.SetFlag(name, true)
+	}
+}
+
+// Condition reports whether the condition of an %if section holds,
+// which is either the name of a flag, or that name preceded by '!'.
+func (t *Tree) Condition(cond string) bool {
+	if strings.HasPrefix(cond, "!") {
+		return !t.flags[cond[1:]]
+	}
+	return t.flags[cond]
+}
+
+// A firstAssert is the assertion that a rule starts with the
+// characters of a class.
+type firstAssert struct {
+	rule, class string
+}
+
+// AssertFirst adds an assertion about the characters a rule may
+// start with, which is checked against the first set computed by
+// the -switch optimization, failing compilation if they differ.
+// Spec consists of the name of the rule and a class in brackets,
+// separated by white space, like "Number [0-9+-]".
+func (t *Tree) AssertFirst(spec string) {
+	if f := strings.Fields(spec); len(f) >= 2 {
+		class := strings.TrimSpace(strings.TrimPrefix(spec, f[0]))
+		t.firstAsserts = append(t.firstAsserts, firstAssert{f[0], class[1 : len(class)-1]})
+	}
+}
+
+// MakeToken marks a rule as describing a token, which is produced by
+// the generated Scanner. References to it are not inlined.
+func (t *Tree) MakeToken(rule string) {
+	if t.tokens == nil {
+		t.tokens = make(map[string]bool)
+	}
+	t.tokens[rule] = true
+}
+
+// MakeTraced marks a rule, whose applications are reported to the
+// Tracer of the generated parser. References to it are not inlined.
+func (t *Tree) MakeTraced(rule string) {
+	if t.traced == nil {
+		t.traced = make(map[string]bool)
+	}
+	t.traced[rule] = true
+}
+
+// MakeNoInline marks a rule, whose references are never inlined, so
+// that it keeps its identity in error messages, and traces.
+func (t *Tree) MakeNoInline(rule string) {
+	if t.noInline == nil {
+		t.noInline = make(map[string]bool)
+	}
+	t.noInline[rule] = true
+}
+
+// MakePrivate marks a rule as internal to the grammar: Parse refuses
+// to apply it, and references to it are inlined, if possible.
+func (t *Tree) MakePrivate(rule string) {
+	if t.private == nil {
+		t.private = make(map[string]bool)
+	}
+	t.private[rule] = true
+}
+
 func (t *Tree) SwitchExclude(rule string) {
 	if t.switchExcl == nil {
 		t.switchExcl = make(map[string]bool, 16)
@@ -554,27 +939,328 @@ func (t *Tree) AddQuery()   { t.addFix(TypeQuery) }
 func (t *Tree) AddStar()    { t.addFix(TypeStar) }
 func (t *Tree) AddPlus()    { t.addFix(TypePlus) }
 
+// AddErrorAction attaches an error action, like leg's ~{ ... }, to
+// the expression on top of the stack. The action is executed as soon
+// as the expression fails, and the expression still fails afterwards.
+func (t *Tree) AddErrorAction(text string) {
+	a := &action{text: text, source: text, id: len(t.Actions), rule: t.currentRule(), isError: true}
+	t.Actions = append(t.Actions, a)
+	n := &nodeList{Type: TypeError}
+	n.PushBack(t.pop())
+	n.PushBack(a)
+	t.push(n)
+}
+
+// join runs tasks concurrently, and waits for all of them. A panic
+// of a task, like one aborting the compilation, is raised again.
 func join(tasks []func()) {
-	length := len(tasks)
-	done := make(chan int, length)
+	done := make(chan interface{}, len(tasks))
 	for _, task := range tasks {
-		go func(task func()) { task(); done <- 1 }(task)
+		go func(task func()) {
+			defer func() { done <- recover() }()
+			task()
+		}(task)
 	}
-	for d := <-done; d < length; d += <-done {
+	var failure interface{}
+	for range tasks {
+		if e := <-done; e != nil && failure == nil {
+			failure = e
+		}
 	}
+	if failure != nil {
+		panic(failure)
+	}
+}
+
+func isEmptyString(node Node) bool {
+	return node.GetType() == TypeString && node.String() == ""
+}
+
+// rangeDensity is the average number of bytes per range of the
+// classes of a switch statement's cases, from which on the cases are
+// written as conditions on ranges, like yyc >= 'a' && yyc <= 'z',
+// instead of listing each byte.
+const rangeDensity = 4
+
+// denseCases reports whether the cases of an unordered alternate
+// are written as conditions on ranges; see rangeDensity. The last
+// case, if it becomes the default case, is not counted.
+func denseCases(list List) bool {
+	bytes, ranges := 0, 0
+	for element := list.Front(); element != nil; element = element.Next() {
+		class := element.Value.(List).Front().Value.(List).Front().Value.(Node).(Token).GetClass()
+		if element.Next() == nil && class.len() > 2 {
+			break
+		}
+		bytes += class.len()
+		class.Iterate(func(from, to byte) { ranges++ })
+	}
+	return ranges != 0 && bytes >= rangeDensity*ranges
+}
+
+// keywordCases is the least number of literals of an alternate
+// matched by matchKeywords, if optimization flag k is given.
+const keywordCases = 4
+
+// isKeywordSet reports whether the alternatives of list
+// are at least keywordCases literals.
+func isKeywordSet(list List) bool {
+	if list.Len() < keywordCases {
+		return false
+	}
+	for el := list.Front(); el != nil; el = el.Next() {
+		switch n := el.Value.(Node); n.GetType() {
+		case TypeCharacter:
+		case TypeString:
+			if n.String() == "" {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// keywordTable returns a composite literal of the literals of an
+// alternate of keywords, in the order of the alternatives, and by
+// their first byte, so that matchKeywords only has to compare those
+// literals starting with the byte at the current position.
+func keywordTable(list List) string {
+	var all []string
+	var byFirst [256][]string
+	for el := list.Front(); el != nil; el = el.Next() {
+		s := unescape(el.Value.(Node).String())
+		all = append(all, strconv.Quote(s))
+		byFirst[s[0]] = append(byFirst[s[0]], strconv.Quote(s))
+	}
+	var first []string
+	for b, literals := range byFirst {
+		if literals != nil {
+			first = append(first, byteLiteral(uint8(b))+": {"+strings.Join(literals, ", ")+"}")
+		}
+	}
+	return "{[]string{" + strings.Join(all, ", ") + "}, [256][]string{" + strings.Join(first, ", ") + "}}"
+}
+
+// tableCases is the least number of branches of an unordered
+// alternate, that is dispatched through a table, if optimization
+// flag t is given.
+const tableCases = 8
+
+// dispatchTable returns the table mapping each byte to the index,
+// starting at 1, of the branch of an unordered alternate whose class
+// contains it, or to 0, if there is none, or it is the last branch,
+// which becomes the default case; the table is split into lines of
+// 32 bytes, written as escape sequences of a string literal.
+func dispatchTable(list List) (lines []string) {
+	var table [256]byte
+	i := 1
+	for element := list.Front(); element != nil; element, i = element.Next(), i+1 {
+		class := element.Value.(List).Front().Value.(List).Front().Value.(Node).(Token).GetClass()
+		if element.Next() == nil && class.len() > 2 {
+			break
+		}
+		class.Iterate(func(from, to byte) {
+			for d := int(from); d <= int(to); d++ {
+				table[d] = byte(i)
+			}
+		})
+	}
+	for i := 0; i < len(table); i += 32 {
+		line := ""
+		for _, b := range table[i : i+32] {
+			line += fmt.Sprintf("\\x%02x", b)
+		}
+		lines = append(lines, line)
+	}
+	return
+}
+
+// caseLabels returns the expressions of a case of a switch statement
+// matching the bytes of class: the bytes themselves, or conditions
+// on ranges of variable yyc, if ranges is set.
+func caseLabels(class *CharacterClass, ranges bool) string {
+	var labels []string
+	if ranges {
+		class.Iterate(func(from, to byte) {
+			if from == to {
+				labels = append(labels, "yyc == "+byteLiteral(from))
+			} else {
+				labels = append(labels, "yyc >= "+byteLiteral(from)+" && yyc <= "+byteLiteral(to))
+			}
+		})
+	} else {
+		for d := 0; d < 256; d++ {
+			if class.has(uint8(d)) {
+				labels = append(labels, byteLiteral(uint8(d)))
+			}
+		}
+	}
+	return strings.Join(labels, ", ")
+}
+
+// byteLiteral returns a Go rune literal of byte d.
+func byteLiteral(d uint8) string {
+	s := ""
+	switch d {
+	case '\a':
+		s = `\a` /* bel */
+	case '\b':
+		s = `\b` /* bs */
+	case '\f':
+		s = `\f` /* ff */
+	case '\n':
+		s = `\n` /* nl */
+	case '\r':
+		s = `\r` /* cr */
+	case '\t':
+		s = `\t` /* ht */
+	case '\v':
+		s = `\v` /* vt */
+	case '\\':
+		s = `\\` /* \ */
+	case '\'':
+		s = `\'` /* ' */
+	default:
+		switch {
+		case d < 32 || d >= 0x80:
+			s = fmt.Sprintf("\\%03o", d)
+		default:
+			s = fmt.Sprintf("%c", d)
+		}
+	}
+	return "'" + s + "'"
+}
+
+// goChar returns a Go literal of the byte described by the text of
+// a character, as written in a grammar, which may be escaped.
+func goChar(text string) string {
+	if b := unescape(text)[0]; b >= 0x80 {
+		return fmt.Sprintf("'\\x%02x'", b)
+	} else {
+		return strconv.QuoteRune(rune(b))
+	}
+}
+
+// goString returns a Go literal of the bytes described by the text
+// of a literal, as written in a grammar, which may contain escapes.
+func goString(text string) string {
+	return strconv.Quote(unescape(text))
 }
 
-var anyChar = func() (c *characterClass) {
-	c = new(characterClass)
+// isSingleChar reports whether node matches exactly one character.
+func isSingleChar(node Node) bool {
+	switch node.GetType() {
+	case TypeDot, TypeCharacter, TypeClass:
+		return true
+	case TypeString:
+		s := node.String()
+		if len(s) > 1 && s[0] == '\\' {
+			_, n := unescapeByte(s[1:])
+			return n == len(s)-1
+		}
+		return len(s) == 1
+	}
+	return false
+}
+
+var anyChar = func() (c *CharacterClass) {
+	c = new(CharacterClass)
 	return
 }()
 
-func (t *Tree) Compile(out io.Writer, optiFlags string) {
+// Compile writes the parser generated from the grammar to out, and
+// returns a report of the warnings, and statistics, of the compilation.
+// If the grammar cannot be compiled, like if it contains left recursive
+// rules, or rules used but not defined, an error is returned, together
+// with the warnings found so far, and nothing is written to out.
+func (t *Tree) Compile(out io.Writer, optiFlags string) (*Report, error) {
+	return t.CompileParts(out, nil, optiFlags)
+}
+
+/*
+CompileParts works like Compile, but if parts is not empty,
+the rule functions are distributed across these writers, each of
+which will receive the contents of a separate Go file of the same
+package. Rules are assigned to parts in the order of
+their definition.
+*/
+func (t *Tree) CompileParts(out io.Writer, parts []io.Writer, optiFlags string) (r *Report, err error) {
+	start := time.Now()
+	r = &Report{}
+	t.report = r
+	defer func() {
+		t.report = nil
+		r.Duration = time.Since(start)
+		if e := recover(); e != nil {
+			ce, ok := e.(compileError)
+			if !ok {
+				panic(e)
+			}
+			err = r.err(ce)
+		}
+	}()
+	var (
+		main bytes.Buffer
+		bufs []io.Writer
+	)
+	for i := 0; i < len(parts); i++ {
+		bufs = append(bufs, new(bytes.Buffer))
+	}
+	header := stamp(t.Hash(optiFlags))
+	t.compileParts(&main, bufs, optiFlags)
+
+	code, imports := fixImports(main.Bytes(), nil)
+	io.WriteString(out, header)
+	out.Write(code)
+	for i, b := range bufs {
+		code, _ = fixImports(b.(*bytes.Buffer).Bytes(), imports)
+		io.WriteString(parts[i], header)
+		parts[i].Write(code)
+	}
+	return r, nil
+}
+
+func (t *Tree) compileParts(out io.Writer, parts []io.Writer, optiFlags string) {
 	counts := [TypeLast]uint{}
 	nvar := 0
+	// left over from compiling another tree
+	stats = statValues{}
 
 	O := parseOptiFlags(optiFlags)
+	rename := t.renamer()
+	userCode := t.userRenamer()
+	if prefix := t.defines["prefix"]; prefix != "" {
+		for name, def := range map[string]string{"Peg": "yyParser", "yystype": "yyStype"} {
+			if t.defines[name] == def {
+				t.defines[name] = prefixName(prefix, def)
+			}
+		}
+	}
 
+	t.checkEmpty()
+	t.resolveEmpty()
+	if t.defines["recognize"] != "" {
+		t.stripActions(false)
+		for _, name := range []string{"captures", "spans", "partial", "commit"} {
+			if t.defines[name] != "" {
+				t.warnf("%%%s ignored, as a recognizer executes no actions", name)
+				t.defines[name] = ""
+			}
+		}
+	} else if t.defines["captures"] != "" {
+		t.stripActions(true)
+	}
+	if O.hoistActions {
+		t.hoistActions()
+	}
+	t.checkVariables(rename)
+	valueKind := t.valueKind()
+	if valueKind == "interface" && t.defines["yyspan"] != "" {
+		t.warnf("%%yyspan ignored, as the semantic values are interfaces, which have no fields")
+		t.defines["yyspan"] = ""
+	}
 	for element := t.Front(); element != nil; element = element.Next() {
 		node := element.Value.(Node)
 		switch node.GetType() {
@@ -584,13 +1270,31 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 			nvar += len(rule.variables)
 		}
 	}
+	// whether predicates, immediate, or error actions read variables
+	readsVariables := false
+	for _, r := range t.rules {
+		if len(r.variables) == 0 || r.expression == nil {
+			continue
+		}
+		Inspect(r.expression, func(node Node) bool {
+			if code, ok := parseTimeCode(node); ok && len(readVariables(r.variables, code, rename)) != 0 {
+				readsVariables = true
+			}
+			return !readsVariables
+		})
+	}
+	var undefined []string
 	for name, r := range t.rules {
 		if r.name == "" {
-			r := &rule{name: name, id: t.ruleId}
-			t.ruleId++
-			t.rules[name] = r
-			t.PushBack(r)
+			undefined = append(undefined, name)
+		}
+	}
+	if len(undefined) != 0 {
+		sort.Strings(undefined)
+		for _, name := range undefined {
+			t.compileErrorf("rule '%v' used but not defined", name)
 		}
+		t.fail("undefined rules")
 	}
 
 	join([]func(){
@@ -606,7 +1310,7 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 					for element := node.(List).Front(); element != nil; element = element.Next() {
 						countTypes(element.Value.(Node))
 					}
-				case TypePeekFor, TypePeekNot, TypeQuery, TypeStar, TypePlus:
+				case TypePeekFor, TypePeekNot, TypeQuery, TypeStar, TypePlus, TypeError:
 					countTypes(node.(List).Front().Value.(Node))
 				}
 			}
@@ -638,7 +1342,7 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 					for element := node.(List).Front(); element != nil; element = element.Next() {
 						countRules(element.Value.(Node))
 					}
-				case TypePeekFor, TypePeekNot, TypeQuery, TypeStar, TypePlus:
+				case TypePeekFor, TypePeekNot, TypeQuery, TypeStar, TypePlus, TypeError:
 					countRules(node.(List).Front().Value.(Node))
 				}
 			}
@@ -649,30 +1353,45 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 					break
 				}
 			}
+			if r, ok := t.rules[t.StartRule()]; ok && r.expression != nil && r.String() != t.FirstRule() {
+				countRules(r)
+			}
 		},
 		func() {
+			// The rules are searched in the order of their definition,
+			// following references that may be applied before input is
+			// consumed; path holds the rules being searched. A cycle found
+			// is reported once, starting with the rule defined first.
+			var path []*rule
+			onPath := make([]bool, len(t.rules))
+			reported := make(map[string]bool)
 			var checkRecursion func(node Node) bool
-			ruleReached := make([]bool, len(t.rules))
 			checkRecursion = func(node Node) bool {
 				switch node.GetType() {
 				case TypeRule:
-					rule := node.(Rule)
-					id := rule.GetId()
-					if ruleReached[id] {
-						fmt.Fprintf(os.Stderr, "possible infinite left recursion in rule '%v'\n", node)
+					rule := node.(*rule)
+					if onPath[rule.id] {
+						i := len(path) - 1
+						for path[i] != rule {
+							i--
+						}
+						t.reportRecursion(path[i:], reported)
 						return false
 					}
-					ruleReached[id] = true
-					consumes := checkRecursion(rule.GetExpression())
-					ruleReached[id] = false
+					onPath[rule.id] = true
+					path = append(path, rule)
+					consumes := checkRecursion(rule.expression)
+					path = path[:len(path)-1]
+					onPath[rule.id] = false
 					return consumes
 				case TypeAlternate:
+					consumes := true
 					for element := node.(List).Front(); element != nil; element = element.Next() {
 						if !checkRecursion(element.Value.(Node)) {
-							return false
+							consumes = false
 						}
 					}
-					return true
+					return consumes
 				case TypeSequence:
 					for element := node.(List).Front(); element != nil; element = element.Next() {
 						if checkRecursion(element.Value.(Node)) {
@@ -680,9 +1399,13 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 						}
 					}
 				case TypeName:
-					return checkRecursion(t.rules[node.String()])
-				case TypePlus:
+					if r := t.rules[node.String()]; r != nil && r.expression != nil {
+						return checkRecursion(r)
+					}
+				case TypePlus, TypeError:
 					return checkRecursion(node.(List).Front().Value.(Node))
+				case TypePeekFor, TypePeekNot, TypeQuery, TypeStar:
+					checkRecursion(node.(List).Front().Value.(Node))
 				case TypeCharacter, TypeString:
 					return len(node.String()) > 0
 				case TypeDot, TypeClass:
@@ -690,11 +1413,264 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 				}
 				return false
 			}
-			for _, rule := range t.rules {
-				checkRecursion(rule)
+			for element := t.Front(); element != nil; element = element.Next() {
+				if rule, ok := element.Value.(*rule); ok && rule.expression != nil {
+					checkRecursion(rule)
+				}
+			}
+			if len(reported) != 0 && !WarnLeftRecursion {
+				t.fail("left recursive rules")
+			}
+		},
+		func() {
+			// Alternatives following one that never fails, like one
+			// matching the empty string, or `e?`, are never tried.
+			// Rules that never fail are determined as a least fixed point.
+			succeeds := make(map[*rule]bool)
+			var neverFails func(node Node) bool
+			neverFails = func(node Node) bool {
+				switch node.GetType() {
+				case TypeName:
+					r := t.rules[node.String()]
+					return r != nil && succeeds[r]
+				case TypeNil, TypeAction, TypeBegin, TypeEnd, TypeQuery, TypeStar:
+					return true
+				case TypeCharacter, TypeString:
+					return len(node.String()) == 0 // see resolveEmpty
+				case TypeAlternate, TypeUnorderedAlternate:
+					for element := node.(List).Front(); element != nil; element = element.Next() {
+						if neverFails(element.Value.(Node)) {
+							return true
+						}
+					}
+				case TypeSequence:
+					for element := node.(List).Front(); element != nil; element = element.Next() {
+						if !neverFails(element.Value.(Node)) {
+							return false
+						}
+					}
+					return true
+				case TypePlus, TypeError, TypePeekFor:
+					return neverFails(node.(List).Front().Value.(Node))
+				}
+				return false
+			}
+			for changed := true; changed; {
+				changed = false
+				for _, rule := range t.rules {
+					if !succeeds[rule] && rule.expression != nil && neverFails(rule.expression) {
+						succeeds[rule] = true
+						changed = true
+					}
+				}
+			}
+			describe := func(i int, node Node) string {
+				var b bytes.Buffer
+				writeExpression(&b, node, precSequence, false)
+				if b.Len() == 0 {
+					return fmt.Sprintf("%d (empty)", i+1)
+				}
+				return fmt.Sprintf("%d (%s)", i+1, &b)
+			}
+			for element := t.Front(); element != nil; element = element.Next() {
+				rule, ok := element.Value.(*rule)
+				if !ok || rule.expression == nil {
+					continue
+				}
+				Inspect(rule.expression, func(node Node) bool {
+					if node == nil || node.GetType() != TypeAlternate {
+						return true
+					}
+					var dead []string
+					always := ""
+					i := 0
+					for el := node.(List).Front(); el != nil; el = el.Next() {
+						switch {
+						case always != "":
+							dead = append(dead, describe(i, el.Value.(Node)))
+						case neverFails(el.Value.(Node)):
+							always = describe(i, el.Value.(Node))
+						}
+						i++
+					}
+					switch len(dead) {
+					case 0:
+					case 1:
+						t.warnf("%srule '%v': alternative %s is unreachable, as alternative %s never fails", t.rulePos(rule), rule, dead[0], always)
+					default:
+						t.warnf("%srule '%v': alternatives %s and %s are unreachable, as alternative %s never fails", t.rulePos(rule), rule, strings.Join(dead[:len(dead)-1], ", "), dead[len(dead)-1], always)
+					}
+					return true
+				})
+			}
+		},
+		func() {
+			// The generated code of a repetition loops as long as its
+			// operand succeeds, so it does not terminate, once an
+			// operand like `!x`, or `e?`, succeeds without consuming
+			// input. Nullable rules are determined as a least fixed point.
+			nullable := make(map[*rule]bool)
+			var isNullable func(node Node) bool
+			isNullable = func(node Node) bool {
+				switch node.GetType() {
+				case TypeName:
+					r := t.rules[node.String()]
+					return r != nil && nullable[r]
+				case TypeDot, TypeClass, TypeBytes:
+					return false
+				case TypeCharacter, TypeString:
+					return len(node.String()) == 0
+				case TypeAlternate, TypeUnorderedAlternate:
+					for element := node.(List).Front(); element != nil; element = element.Next() {
+						if isNullable(element.Value.(Node)) {
+							return true
+						}
+					}
+					return false
+				case TypeSequence:
+					for element := node.(List).Front(); element != nil; element = element.Next() {
+						if !isNullable(element.Value.(Node)) {
+							return false
+						}
+					}
+				case TypePlus, TypeError:
+					return isNullable(node.(List).Front().Value.(Node))
+				}
+				return true
+			}
+			for changed := true; changed; {
+				changed = false
+				for _, rule := range t.rules {
+					if !nullable[rule] && rule.expression != nil && isNullable(rule.expression) {
+						nullable[rule] = true
+						changed = true
+					}
+				}
+			}
+			failed := false
+			for element := t.Front(); element != nil; element = element.Next() {
+				rule, ok := element.Value.(*rule)
+				if !ok || rule.expression == nil {
+					continue
+				}
+				Inspect(rule.expression, func(node Node) bool {
+					if node == nil || node.GetType() != TypeStar && node.GetType() != TypePlus {
+						return true
+					}
+					if isNullable(node.(List).Front().Value.(Node)) {
+						var b bytes.Buffer
+						writeExpression(&b, node, precSequence, false)
+						t.compileErrorf("%srule '%v': repetition %s may loop forever, as its operand may succeed without consuming input", t.rulePos(rule), rule, &b)
+						failed = true
+					}
+					return true
+				})
+			}
+			if failed {
+				t.fail("repetitions of expressions that may match the empty string")
 			}
 		}})
 
+	// Private rules are inlined at each reference, except for one rule
+	// of each cycle of private rules, which otherwise would not terminate.
+	inlinePrivate := make(map[string]bool)
+	for name := range t.private {
+		if r, ok := t.rules[name]; !ok || r.expression == nil {
+			t.warnf("private rule '%v' not defined", name)
+		} else if name == t.StartRule() {
+			t.warnf("start rule '%v' cannot be private", name)
+		} else {
+			inlinePrivate[name] = true
+		}
+	}
+	// As semantic values don't work with inlining yet, rules that
+	// may set or provide a value are excluded.
+	if nvar > 0 {
+		for el := t.Front(); el != nil; el = el.Next() {
+			if r, ok := el.Value.(*rule); ok {
+				if r.hasActions || len(r.variables) != 0 {
+					delete(inlinePrivate, r.name)
+				}
+				Inspect(r, func(n Node) bool {
+					if n, ok := n.(*name); ok && n.varp != nil {
+						delete(inlinePrivate, n.String())
+					}
+					return true
+				})
+			}
+		}
+	}
+	var cyclic func(node Node, path map[string]bool) bool
+	cyclic = func(node Node, path map[string]bool) (found bool) {
+		Inspect(node, func(n Node) bool {
+			if found || n == nil || n.GetType() != TypeName || !inlinePrivate[n.String()] {
+				return !found
+			}
+			name := n.String()
+			if path[name] {
+				found = true
+				return false
+			}
+			path[name] = true
+			found = cyclic(t.rules[name].expression, path)
+			delete(path, name)
+			return false
+		})
+		return
+	}
+	for el := t.Front(); el != nil; el = el.Next() {
+		if r, ok := el.Value.(*rule); ok && inlinePrivate[r.name] && cyclic(r.expression, map[string]bool{r.name: true}) {
+			delete(inlinePrivate, r.name)
+		}
+	}
+	for name := range inlinePrivate {
+		if _, ok := t.rulesCount[name]; !ok {
+			delete(inlinePrivate, name)
+		}
+	}
+	// inlined reports whether references to a rule are replaced
+	// by its expression
+	inlined := func(name string) bool {
+		return !t.tokens[name] && !t.traced[name] && !t.noInline[name] && (t.inline && t.rulesCount[name] == 1 || inlinePrivate[name])
+	}
+
+	// Spans are queued as thunks, like actions, so that the parser
+	// maintains no queue of thunks only without either of them.
+	noThunks := t.Actions == nil && t.defines["spans"] == ""
+
+	// With %partial, the parser commits after each item matched by
+	// a repetition, that is the start rule's expression, or an element
+	// of its sequence, like Item* in File <- - Item* EOF, so that the
+	// actions of the items preceding an error are executed. The
+	// repetitions are looked up before leafs are inlined, as these
+	// are shared by all rules using them. Without actions, there is
+	// nothing to commit.
+	partialItems := make(map[Node]bool)
+	if t.defines["partial"] != "" && noThunks {
+		t.warnf("%%partial has no effect, as the grammar has no actions")
+	} else if r, ok := t.rules[t.StartRule()]; ok && t.defines["partial"] != "" && r.expression != nil {
+		e := r.GetExpression()
+		nodes := []Node{e}
+		if e.GetType() == TypeSequence {
+			nodes = nil
+			for el := e.(List).Front(); el != nil; el = el.Next() {
+				nodes = append(nodes, el.Value.(Node))
+			}
+		}
+		for _, n := range nodes {
+			if typ := n.GetType(); typ == TypeStar || typ == TypePlus {
+				partialItems[n] = true
+			}
+		}
+		if len(partialItems) == 0 {
+			t.warnf("%%partial has no effect, as the start rule '%v' does not contain a repetition of items", r)
+		}
+	}
+
+	// The rules inlined are reported with option -inlinereport;
+	// leafRule is the rule whose expression inlineLeafes walks.
+	var report inlineReport
+	var leafRule *rule
 	var inlineLeafes func(node Node) Node
 	inlineLeafes = func(node Node) (ret Node) {
 		ret = node
@@ -711,17 +1687,21 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 				}
 			}
 		case TypeName:
+			if t.noInline[node.String()] || t.tokens[node.String()] {
+				break // token rules are kept, like for their spans
+			}
 			r := t.rules[node.String()]
 			x := inlineLeafes(r)
 			if r != x {
 				stats.inlineLeafs++
+				report.add(r, leafRule, "leaf")
 				ret = x
 			}
 		case TypeSequence, TypeAlternate:
 			for el := node.(List).Front(); el != nil; el = el.Next() {
 				el.Value = inlineLeafes(el.Value.(Node))
 			}
-		case TypePlus, TypeStar, TypeQuery, TypePeekNot, TypePeekFor:
+		case TypePlus, TypeStar, TypeQuery, TypePeekNot, TypePeekFor, TypeError:
 			v := &node.(List).Front().Value
 			*v = inlineLeafes((*v).(Node))
 		}
@@ -729,23 +1709,76 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 	}
 	if O.inlineLeafs {
 		for _, rule := range t.rules {
+			leafRule = rule
 			inlineLeafes(rule.GetExpression())
 		}
 	}
+	if t.defines["inlinereport"] != "" {
+		for el := t.Front(); el != nil; el = el.Next() {
+			r, ok := el.Value.(*rule)
+			if !ok || r.expression == nil {
+				continue
+			}
+			Inspect(r.expression, func(node Node) bool {
+				if node != nil && node.GetType() == TypeName && inlined(node.String()) {
+					name := node.String()
+					reason := "referenced once"
+					if inlinePrivate[name] {
+						reason = "private"
+					}
+					report.add(t.rules[name], r, reason)
+				}
+				return true
+			})
+		}
+		report.write(t)
+	}
+
+	// In iterative mode, the code of all rules is part of a single
+	// function, in which rules return to their callers using gotos.
+	// As these cannot enter blocks, optimizations generating switch
+	// statements are turned off.
+	iterative := t.defines["iterative"] != ""
+	if iterative {
+		if parts != nil {
+			t.fail("the iterative mode cannot be combined with -split")
+		}
+		if t._switch {
+			t.warnf("option -switch ignored in iterative mode")
+			t._switch = false
+		}
+		O.seqPeekNot = false
+		if t.defines["memo"] != "" {
+			t.warnf("memoization disabled, as it is not supported in iterative mode")
+			t.defines["memo"] = ""
+		}
+	}
+
+	// With %ambiguity, the branches of ordered choices are probed,
+	// which the unordered choices created by -switch cannot be.
+	ambiguity := t.defines["ambiguity"] != ""
+	if ambiguity && t._switch {
+		t.warnf("option -switch ignored, as ordered choices are probed for ambiguities")
+		t._switch = false
+	}
 
 	if t._switch {
-		var optimizeAlternates func(node Node) (consumes, eof, peek bool, class *characterClass)
+		var optimizeAlternates func(node Node) (consumes, eof, peek bool, class *CharacterClass)
 		cache := make([]struct {
 			reached, consumes, eof, peek bool
-			class                        *characterClass
+			class                        *CharacterClass
 		}, len(t.rules))
-		optimizeAlternates = func(node Node) (consumes, eof, peek bool, class *characterClass) {
+		var current Rule // rule being optimized, for warnings
+		optimizeAlternates = func(node Node) (consumes, eof, peek bool, class *CharacterClass) {
 			switch node.GetType() {
 			case TypeRule:
 				rule := node.(Rule)
 				if t.switchExcl != nil && t.switchExcl[rule.String()] {
 					return
 				}
+				outer := current
+				current = rule
+				defer func() { current = outer }()
 				cache := &cache[rule.GetId()]
 				if cache.reached {
 					consumes, eof, peek, class = cache.consumes, cache.eof, cache.peek, cache.class
@@ -760,55 +1793,46 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 			case TypeName:
 				consumes, eof, peek, class = optimizeAlternates(t.rules[node.String()])
 			case TypeDot:
-				consumes, class = true, new(characterClass)
+				consumes, class = true, new(CharacterClass)
 				for index, _ := range *class {
 					class[index] = 0xff
 				}
 			case TypeString, TypeCharacter:
 				if node.String() == "" {
-					consumes, class = true, anyChar
+					// matches without consuming input, like an action;
+					// with %empty noteof, it has been replaced by &.
+					class = new(CharacterClass)
 					return
 				}
-				consumes, class = true, new(characterClass)
+				consumes, class = true, new(CharacterClass)
 				b := node.String()[0]
 				if b == '\\' {
-					b = node.String()[1]
-					switch b {
-					case 'a':
-						b = '\a' /* bel */
-					case 'b':
-						b = '\b' /* bs */
-					case 'f':
-						b = '\f' /* ff */
-					case 'n':
-						b = '\n' /* nl */
-					case 'r':
-						b = '\r' /* cr */
-					case 't':
-						b = '\t' /* ht */
-					case 'v':
-						b = '\v' /* vt */
-					default:
-						if s := node.String(); len(s) == 4 {
-							b = (s[1]-'0')*64 + (s[2]-'0')*8 + s[3] - '0'
-						}
-					}
+					b, _ = unescapeByte(node.String()[1:])
 				}
 				class.add(b)
 			case TypeClass:
 				consumes, class = true, t.Classes[node.String()].Class
 			case TypeAlternate:
-				consumes, peek, class = true, true, new(characterClass)
+				consumes, peek, class = true, true, new(CharacterClass)
 				alternate := node.(List)
 				mconsumes, meof, mpeek, properties, c :=
 					consumes, eof, peek, make([]struct {
 						intersects bool
-						class      *characterClass
+						class      *CharacterClass
 					}, alternate.Len()), 0
 				empty := false
+				// first characters of preceding alternatives that consist
+				// of a single character, which always succeed on them
+				single := new(CharacterClass)
 				for element := alternate.Front(); element != nil; element = element.Next() {
 					mconsumes, meof, mpeek, properties[c].class = optimizeAlternates(element.Value.(Node))
 					consumes, eof, peek = consumes && mconsumes, eof || meof, peek && mpeek
+					if mc := properties[c].class; mc != nil && !meof && mc.len() != 0 && single.contains(mc) && !isEmptyString(element.Value.(Node)) {
+						t.warnf("rule '%v': alternative %d is unreachable, as alternatives before it match all its first characters", current, c+1)
+					}
+					if isSingleChar(element.Value.(Node)) {
+						single.union(properties[c].class)
+					}
 					if properties[c].class != nil {
 						class.union(properties[c].class)
 						if properties[c].class.len() == 0 {
@@ -834,7 +1858,7 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 					}
 				}
 				if empty {
-					class = new(characterClass)
+					class = new(CharacterClass)
 					consumes = false
 					break
 				}
@@ -888,13 +1912,13 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 				meof, classes, c, element :=
 					eof, make([]struct {
 						peek  bool
-						class *characterClass
+						class *CharacterClass
 					}, sequence.Len()), 0, sequence.Front()
 				for ; !consumes && element != nil; element, c = element.Next(), c+1 {
 					consumes, meof, classes[c].peek, classes[c].class = optimizeAlternates(element.Value.(Node))
 					eof, peek = eof || meof, peek || classes[c].peek
 				}
-				eof, peek, class = !consumes && eof, !consumes && peek, new(characterClass)
+				eof, peek, class = !consumes && eof, !consumes && peek, new(CharacterClass)
 				for c--; c >= 0; c-- {
 					if classes[c].class != nil {
 						if classes[c].peek {
@@ -911,7 +1935,7 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 				peek = true
 				// might be buggy
 				_, eof, _, _ = optimizeAlternates(node.(List).Front().Value.(Node))
-				class = new(characterClass)
+				class = new(CharacterClass)
 				eof = !eof
 				class = class.copy()
 				class.complement()
@@ -920,10 +1944,12 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 				fallthrough
 			case TypeQuery, TypeStar:
 				_, eof, _, class = optimizeAlternates(node.(List).Front().Value.(Node))
-			case TypePlus:
+			case TypePlus, TypeError:
 				consumes, eof, peek, class = optimizeAlternates(node.(List).Front().Value.(Node))
 			case TypeAction, TypeNil:
-				class = new(characterClass)
+				class = new(CharacterClass)
+			case TypeAnchor, TypeBytes, TypeIndent, TypeState:
+				class, eof = new(CharacterClass), true
 			}
 			return
 		}
@@ -934,93 +1960,133 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 				break
 			}
 		}
+		failed := false
+		for _, a := range t.firstAsserts {
+			r, ok := t.rules[a.rule]
+			if !ok || r.expression == nil {
+				t.warnf("rule '%v' of first set assertion not defined", a.rule)
+				continue
+			}
+			c := cache[r.id]
+			if !c.reached || c.class == nil {
+				t.warnf("rule '%v': first set not computed, as the rule is not reached, or excluded from -switch", r)
+				continue
+			}
+			if want := ParseClass(a.class); *c.class != *want {
+				t.compileErrorf("rule '%v': first set [%v] differs from the asserted [%v]", r, c.class, want)
+				failed = true
+			}
+		}
+		if failed {
+			t.fail("first set assertions failed")
+		}
+	} else if len(t.firstAsserts) != 0 {
+		t.warnf("first set assertions are only checked with option -switch")
 	}
 
+	undo := t.defines["undo"] != ""
+
+	// Actions are identified by constants named after their rule,
+	// and their index within the rule, like actionStmt_0.
+	actionNames := make([]string, len(t.Actions))
+	nRuleActions := make(map[*rule]int)
+	for i, a := range t.Actions {
+		name := fmt.Sprintf("action%s_%d", a.rule.GoString(), nRuleActions[a.rule])
+		if prefix := t.defines["prefix"]; prefix != "" {
+			name = prefixName(prefix, name)
+		}
+		actionNames[i] = name
+		nRuleActions[a.rule]++
+	}
+	for _, d := range initialSizes {
+		if n, err := strconv.Atoi(t.defines[d.name]); err != nil || n < 1 {
+			t.warnf("invalid initial size of %s: %q, using %s", d.name, t.defines[d.name], d.def)
+			t.defines[d.name] = d.def
+		}
+	}
+	if d := t.defines["maxdepth"]; d != "" {
+		if n, err := strconv.Atoi(d); err != nil || n < 1 {
+			t.warnf("invalid maximum depth: %q, not limiting the depth", d)
+			t.defines["maxdepth"] = ""
+		}
+	}
+	// With %spans, or %captures, Parse commits after the rule has
+	// matched, so that the spans of the rules enclosing the last
+	// commit, and those of grammars without commits, are recorded.
+	// Without thunks, a commit has nothing to do, and is omitted.
+	finalCommit := !noThunks && (t.defines["spans"] != "" || t.defines["captures"] != "")
+	hasCommit := !noThunks && (counts[TypeCommit] > 0 || len(partialItems) != 0 || finalCommit)
+	if t.defines["memo"] != "" && (counts[TypeIndent] > 0 || counts[TypeState] > 0 || undo) {
+		t.warnf("memoization disabled, as rules depend on the indentation or the user state")
+		t.defines["memo"] = ""
+	}
+	immediate := counts[TypeError] > 0 // doerr is needed for error or immediate actions
+	for _, a := range t.Actions {
+		if a.isImmediate {
+			immediate = true
+		}
+	}
 	w := newWriter(out)
 	w.elimRestore = O.elimRestore
+	w.noThunks = noThunks
+	w.flat = iterative
+	if counts[TypeIndent] > 0 {
+		w.saved = append(w.saved, savedVar{"indentTop", "indentTop", "indentTop = %s"})
+	}
+	if counts[TypeState] > 0 {
+		w.saved = append(w.saved, savedVar{"stateTop", "p.stateTop", "p.stateTop = %s"})
+	}
+	if undo {
+		w.saved = append(w.saved, savedVar{"undo", "len(p.undo)", "p.backtrack(%s)"})
+	}
+	w.rename = rename
 	print := func(format string, a ...interface{}) {
 		if !w.dryRun {
 			fmt.Fprintf(w, format, a...)
 		}
 	}
 
-	var printRule func(node Node)
 	var compile func(expression Node, ko *label) (chgFlags, chgFlags)
-	printRule = func(node Node) {
-		switch node.GetType() {
-		case TypeRule:
-			print("%v <- ", node)
-			expression := node.(Rule).GetExpression()
-			if expression != nilNode {
-				printRule(expression)
-			}
-		case TypeDot:
-			print(".")
-		case TypeName:
-			print("%v", node)
-		case TypeCharacter,
-			TypeString:
-			print("'%v'", node)
-		case TypeClass:
-			print("[%v]", node)
-		case TypePredicate:
-			print("&{%v}", node)
-		case TypeAction:
-			print("{%v}", node)
-		case TypeCommit:
-			print("commit")
-		case TypeBegin:
-			print("<")
-		case TypeEnd:
-			print(">")
-		case TypeAlternate:
-			print("(")
-			list := node.(List)
-			element := list.Front()
-			printRule(element.Value.(Node))
-			for element = element.Next(); element != nil; element = element.Next() {
-				print(" / ")
-				printRule(element.Value.(Node))
+	// ruleText returns the text of a rule or expression, as written
+	// by FprintGrammar
+	ruleText := func(node Node) string {
+		var b bytes.Buffer
+		FprintGrammar(&b, node)
+		return b.String()
+	}
+	// armComment writes a comment containing the text of the alternative
+	// node, as in the grammar, to an arm of a switch statement created
+	// for an unordered alternate, so that the code can be related to
+	// the grammar again
+	armComment := func(node Node) {
+		w.lnPrint("/* %s */", strings.Replace(ruleText(node), "*/", "* /", -1))
+	}
+	// With %ambiguity, the choices numbered in choiceIds, see below,
+	// are probed, unless probing is set while compiling the branches
+	// to be probed.
+	choiceIds := make(map[Node]int)
+	var probing bool
+	// ids of the alternates of keywords, matched by matchKeywords,
+	// and the tables of their literals, see keywordTable
+	keywordIds := make(map[Node]int)
+	var keywordTables []string
+	var yyposDepth int // nesting of variables yyposBegin<n>, in flat code
+	spans := t.defines["spans"]
+	var current *rule // rule whose expression is being compiled, for spans
+	var ruleKo *label // label of the rule function being compiled, saving thunkPosition0
+	// commitItem commits after an item of a repetition in partialItems
+	commitItem := func(rep Node) {
+		if partialItems[rep] {
+			w.lnPrint("commit(thunkPosition%d)", 0)
+			if w.dryRun {
+				w.saveFlags[ruleKo.id].thPos = true
 			}
-			print(")")
-		case TypeUnorderedAlternate:
-			print("(")
-			element := node.(List).Front()
-			printRule(element.Value.(Node))
-			for element = element.Next(); element != nil; element = element.Next() {
-				print(" | ")
-				printRule(element.Value.(Node))
-			}
-			print(")")
-		case TypeSequence:
-			print("(")
-			element := node.(List).Front()
-			printRule(element.Value.(Node))
-			for element = element.Next(); element != nil; element = element.Next() {
-				print(" ")
-				printRule(element.Value.(Node))
-			}
-			print(")")
-		case TypePeekFor:
-			print("&")
-			printRule(node.(List).Front().Value.(Node))
-		case TypePeekNot:
-			print("!")
-			printRule(node.(List).Front().Value.(Node))
-		case TypeQuery:
-			printRule(node.(List).Front().Value.(Node))
-			print("?")
-		case TypeStar:
-			printRule(node.(List).Front().Value.(Node))
-			print("*")
-		case TypePlus:
-			printRule(node.(List).Front().Value.(Node))
-			print("+")
-		default:
-			fmt.Fprintf(os.Stderr, "illegal node type: %v\n", node.GetType())
 		}
 	}
 	compileExpression := func(rule *rule, ko *label) (cko, cok chgFlags) {
+		outer := current
+		current = rule
+		defer func() { current = outer }()
 		nvar := len(rule.variables)
 		if nvar > 0 {
 			w.lnPrint("doarg(yyPush, %d)", nvar)
@@ -1033,6 +2099,18 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 		}
 		return
 	}
+	// predicateCode returns the condition of a semantic predicate,
+	// within a function literal declaring the variables it reads
+	predicateCode := func(node Node) string {
+		code := userCode(node.String())
+		if current == nil {
+			return code
+		}
+		if decls := readVariables(current.variables, code, rename); len(decls) != 0 {
+			code = "func() bool { " + strings.Join(decls, "; ") + "; return " + code + " }()"
+		}
+		return code
+	}
 	canCompilePeek := func(node Node, jumpIfTrue bool, label *label) bool {
 		if !O.peek {
 			return false
@@ -1042,13 +2120,13 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 			label.cJump(jumpIfTrue, "(position < len(p.Buffer))")
 			stats.Peek.Dot++
 		case TypeCharacter:
-			label.cJump(jumpIfTrue, "peekChar('%v')", node)
+			label.cJump(jumpIfTrue, "peekChar(%s)", goChar(node.String()))
 			stats.Peek.Char++
 		case TypeClass:
 			label.cJump(jumpIfTrue, "peekClass(%d)", t.Classes[node.String()].Index)
 			stats.Peek.Class++
 		case TypePredicate:
-			label.cJump(jumpIfTrue, "(%v)", node)
+			label.cJump(jumpIfTrue, "(%v)", predicateCode(node))
 		default:
 			return false
 		}
@@ -1061,7 +2139,7 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 		}
 		switch node.GetType() {
 		case TypeRule:
-			fmt.Fprintf(os.Stderr, "internal error #1 (%v)\n", node)
+			t.fail("internal error #1 (%v)", node)
 		case TypeDot:
 			ko.cJump(false, "matchDot()")
 			stats.Match.Dot++
@@ -1070,26 +2148,58 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 			varp := node.(*name).varp
 			name := node.String()
 			rule := t.rules[name]
-			if t.inline && t.rulesCount[name] == 1 {
+			yyspan := varp != nil && t.defines["yyspan"] != ""
+			yyposBegin := "yyposBegin"
+			if yyspan {
+				if w.flat {
+					// the expression of an inlined rule may record spans too
+					yyposBegin = fmt.Sprintf("yyposBegin%d", yyposDepth)
+					yyposDepth++
+				}
+				w.begin()
+				w.declare("position", yyposBegin)
+			}
+			if inlined(name) {
 				chgko, chgok = compileExpression(rule, ko)
 			} else {
-				ko.cJump(false, "p.rules[rule%s]()", rule.GoString())
-				if len(rule.variables) != 0 || rule.hasActions {
+				if w.flat {
+					w.call(rule, ko)
+				} else {
+					ko.cJump(false, "p.rules[rule%s]()", rule.GoString())
+				}
+				if len(rule.variables) != 0 || rule.hasActions || spans != "" {
 					chgok.thPos = true
 				}
 				chgok.pos = true // safe guess
 			}
+			if yyspan {
+				w.lnPrint("dopos(%s, position)", yyposBegin)
+				w.end()
+				if w.flat {
+					yyposDepth--
+				}
+			}
 			if varp != nil {
 				w.lnPrint("doarg(yySet, %d)", varp.offset)
 				chgok.thPos = true
 			}
 		case TypeCharacter:
-			ko.cJump(false, "matchChar('%v')", node)
+			ko.cJump(false, "matchChar(%s)", goChar(node.String()))
 			stats.Match.Char++
 			chgok.pos = true
 		case TypeString:
 			if s := node.String(); s != "" {
-				ko.cJump(false, "matchString(\"%s\")", s)
+				if O.stringGuard {
+					// if the first byte doesn't match, matchString only
+					// needs to be called to record the expected string
+					c := s[0]
+					if c == '\\' {
+						c, _ = unescapeByte(s[1:])
+					}
+					ko.cJump(false, "((position < len(p.Buffer) && p.Buffer[position] == %q || position >= p.Max) && matchString(%s))", rune(c), goString(s))
+				} else {
+					ko.cJump(false, "matchString(%s)", goString(s))
+				}
 				stats.Match.String++
 				chgok.pos = true
 			}
@@ -1097,33 +2207,114 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 			ko.cJump(false, "matchClass(%d)", t.Classes[node.String()].Index)
 			chgok.pos = true
 		case TypePredicate:
-			ko.cJump(false, "(%v)", node)
+			ko.cJump(false, "(%v)", predicateCode(node))
+			if undo {
+				chgok.pos = true // the predicate may have registered a function to undo its effects
+			}
+		case TypeBytes:
+			ko.cJump(false, "matchBytes(%v)", userCode(node.String()))
+			stats.Match.Bytes++
+			chgok.pos = true
+		case TypeIndent:
+			switch node.String() {
+			case "%indent":
+				ko.cJump(false, "pushIndent()")
+				stats.Indent.Push++
+			case "%dedent":
+				ko.cJump(false, "popIndent()")
+				stats.Indent.Pop++
+			case "%samedent":
+				ko.cJump(false, "sameIndent()")
+				stats.Indent.Same++
+			}
+			chgok.pos = true // the indentation is saved and restored together with the position
+		case TypeState:
+			if node.String() == "" {
+				ko.cJump(false, "p.popState()")
+			} else {
+				ko.cJump(false, "p.pushState(%v)", node)
+			}
+			chgok.pos = true
+		case TypeAnchor:
+			switch node.String() {
+			case `\A`:
+				if t.defines["bom"] != "" {
+					ko.cJump(false, "(position == 0 || position == 3 && p.Buffer[:3] == \"\\xef\\xbb\\xbf\")")
+				} else {
+					ko.cJump(false, "(position == 0)")
+				}
+			case `\z`:
+				ko.cJump(false, "(position == len(p.Buffer))")
+			case "^":
+				ko.cJump(false, "(position == 0 || p.Buffer[position-1] == '\\n')")
+			case `\b`:
+				ko.cJump(false, "atWordBoundary()")
+				stats.WordBoundary++
+			}
 		case TypeAction:
-			w.lnPrint("do(%d)", node.(Action).GetId())
+			if node.(*action).isImmediate {
+				w.lnPrint("doerr(%s)", actionNames[node.(Action).GetId()])
+				if undo {
+					chgok.pos = true // see TypePredicate
+				}
+				break
+			}
+			w.lnPrint("do(%s)", actionNames[node.(Action).GetId()])
 			chgok.thPos = true
 		case TypeCommit:
-			ko.cJump(false, "(commit(thunkPosition0))")
+			if w.noThunks {
+				break
+			}
+			ko.cJump(false, "(commit(thunkPosition%d))", 0)
+			if w.dryRun {
+				w.saveFlags[ruleKo.id].thPos = true // even if the rule cannot fail
+			}
 			chgko.thPos = true
 		case TypeBegin:
-			if t.Actions != nil {
+			if !w.noThunks {
 				w.lnPrint("begin = position")
 			}
 		case TypeEnd:
-			if t.Actions != nil {
+			if !w.noThunks {
 				w.lnPrint("end = position")
+				if spans != "" {
+					w.lnPrint("dospan(rule%s, begin, end)", current.GoString())
+					chgok.thPos = true
+				}
 			}
 		case TypeAlternate:
 			list := node.(List)
+			if _, probed := choiceIds[node]; O.keywords && !probed && isKeywordSet(list) {
+				id, ok := keywordIds[node]
+				if !ok {
+					id = len(keywordTables)
+					keywordIds[node] = id
+					keywordTables = append(keywordTables, keywordTable(list))
+					stats.keywordTables++
+				}
+				ko.cJump(false, "matchKeywords(%d)", id)
+				chgok.pos = true
+				break
+			}
 			ok := w.newLabel()
 			element := list.Front()
-			if ok.unsafe() {
+			id, probed := choiceIds[node]
+			probed = probed && !probing
+			matched := fmt.Sprintf("matched%d", ok.num) // index of the branch that has matched
+			if ok.unsafe() || probed {
 				w.begin()
 				ok.save()
 			}
+			if probed {
+				w.declare("0", matched)
+			}
 			var next *label
-			for element.Next() != nil {
+			for i := 0; element.Next() != nil; i++ {
 				next = w.newLabel()
 				cko, _ := updateFlags(compile(element.Value.(Node), next))
+				if probed {
+					w.lnPrint("%s = %d", matched, i)
+				}
 				ok.jump()
 				if next.used {
 					ok.lrestore(next, cko.pos, cko.thPos)
@@ -1132,21 +2323,78 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 			}
 			if next == nil || next.used {
 				updateFlags(compile(element.Value.(Node), ko))
+				if probed {
+					w.lnPrint("%s = %d", matched, list.Len()-1)
+				}
 			}
-			if ok.unsafe() {
-				w.end()
+			if !probed {
+				if ok.unsafe() {
+					w.end()
+				}
+				if ok.used {
+					ok.label()
+				}
+				break
 			}
+			// After the choice has matched, the branches following the
+			// one that has matched are applied at the same position, like
+			// lookaheads, counting those that match too. The state at the
+			// end of the match is restored afterwards.
 			if ok.used {
 				ok.label()
 			}
+			skip, end := w.newLabel(), w.newLabel()
+			skip.cJump(true, "p.probing != 0")
+			end.saveBlock()
+			w.lnPrint("p.probing++")
+			probing = true
+			element = list.Front().Next()
+			for j := 1; element != nil; j++ {
+				next := w.newLabel()
+				next.cJump(true, "%s >= %d", matched, j)
+				ok.lrestore(nil, true, false)
+				if !w.noThunks {
+					w.lnPrint("thunkPosition = thunkPosition%d", end.sid) // keeping the actions of the match
+				}
+				compile(element.Value.(Node), next)
+				w.lnPrint("p.overlaps[[3]int{%d, %s, %d}]++", id, matched, j)
+				next.label()
+				element = element.Next()
+			}
+			probing = false
+			w.lnPrint("p.probing--")
+			end.lrestore(nil, true, true)
+			skip.label()
+			w.end()
 		case TypeUnorderedAlternate:
 			list := node.(List)
 			done, ok := ko, w.newLabel()
 			w.begin()
 			done.cJump(true, "position == len(p.Buffer)")
-			w.lnPrint("switch p.Buffer[position] {")
+			table := O.dispatchTable && list.Len() >= tableCases && list.Len() < 256
+			ranges := !table && denseCases(list)
+			switch {
+			case table:
+				dispatch := fmt.Sprintf("dispatch%d", ok.num)
+				stats.dispatchTables++
+				w.lnPrint("// the index of the branch of each byte, or 0")
+				w.lnPrint("const %s = \"\" +", dispatch)
+				lines := dispatchTable(list)
+				for i, line := range lines {
+					if i == len(lines)-1 {
+						w.lnPrint("\t\"%s\"", line)
+					} else {
+						w.lnPrint("\t\"%s\" +", line)
+					}
+				}
+				w.lnPrint("switch %s[p.Buffer[position]] {", dispatch)
+			case ranges:
+				w.lnPrint("switch yyc := p.Buffer[position]; {")
+			default:
+				w.lnPrint("switch p.Buffer[position] {")
+			}
 			element := list.Front()
-			for ; element != nil; element = element.Next() {
+			for i := 1; element != nil; element, i = element.Next(), i+1 {
 				sequence := element.Value.(List).Front()
 				class := sequence.Value.(List).Front().Value.(Node).(Token).GetClass()
 				node := sequence.Next().Value.(Node)
@@ -1155,53 +2403,20 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 					if class.len() > 2 {
 						w.lnPrint("default:")
 						w.indent++
+						armComment(node)
 						updateFlags(compile(node, done))
 						w.indent--
 						break
 					}
 				}
 
-				w.lnPrint("case")
-				comma := false
-				for d := 0; d < 256; d++ {
-					if class.has(uint8(d)) {
-						if comma {
-							print(",")
-						}
-						s := ""
-						switch uint8(d) {
-						case '\a':
-							s = `\a` /* bel */
-						case '\b':
-							s = `\b` /* bs */
-						case '\f':
-							s = `\f` /* ff */
-						case '\n':
-							s = `\n` /* nl */
-						case '\r':
-							s = `\r` /* cr */
-						case '\t':
-							s = `\t` /* ht */
-						case '\v':
-							s = `\v` /* vt */
-						case '\\':
-							s = `\\` /* \ */
-						case '\'':
-							s = `\'` /* ' */
-						default:
-							switch {
-							case d >= 0 && d < 32 || d >= 0x80:
-								s = fmt.Sprintf("\\%03o", d)
-							default:
-								s = fmt.Sprintf("%c", d)
-							}
-						}
-						print(" '%s'", s)
-						comma = true
-					}
+				if table {
+					w.lnPrint("case %d:", i)
+				} else {
+					w.lnPrint("case %s:", caseLabels(class, ranges))
 				}
-				print(":")
 				w.indent++
+				armComment(node)
 				if O.unorderedFirstItem {
 					updateFlags(compileOptFirst(w, node, done, compile))
 				} else {
@@ -1310,7 +2525,7 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 			sub := node.(List).Front().Value.(Node)
 			switch sub.GetType() {
 			case TypeCharacter:
-				w.lnPrint("matchChar('%v')", sub)
+				w.lnPrint("matchChar(%s)", goChar(sub.String()))
 				chgok.pos = true
 				return
 			case TypeDot:
@@ -1338,27 +2553,86 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 			again.label()
 			out.saveBlock()
 			cko, cok := compile(node.(List).Front().Value.(Node), out)
+			commitItem(node)
 			again.jump()
 			out.restore(cko.pos, cko.thPos)
 			chgok = cok
+			if partialItems[node] {
+				chgok.thPos = true
+			}
 		case TypePlus:
 			again := w.newLabel()
 			out := w.newLabel()
-			updateFlags(compile(node.(List).Front().Value.(Node), ko))
+			if item := node.(List).Front().Value.(Node); w.knownFirst == node {
+				w.knownFirst = nil
+				updateFlags(compileOptFirst(w, item, ko, compile))
+			} else {
+				updateFlags(compile(item, ko))
+			}
+			commitItem(node)
+			if partialItems[node] {
+				chgok.thPos = true
+			}
 			again.label()
 			out.saveBlock()
 			cko, _ := compile(node.(List).Front().Value.(Node), out)
+			commitItem(node)
 			again.jump()
 			if out.used {
 				out.restore(cko.pos, cko.thPos)
 			}
+		case TypeError:
+			l := node.(List)
+			eko := w.newLabel()
+			eok := w.newLabel()
+			chgko, chgok = compile(l.Front().Value.(Node), eko)
+			if eko.used {
+				eok.jump()
+				eko.label()
+				w.lnPrint("doerr(%s)", actionNames[l.Front().Next().Value.(*action).id])
+				ko.jump()
+				eok.label()
+			}
 		case TypeNil:
 		default:
-			fmt.Fprintf(os.Stderr, "illegal node type: %v\n", node.GetType())
+			t.fail("illegal node type: %v", node.GetType())
 		}
 		return
 	}
 
+	// The ordered choices probed with %ambiguity are numbered in the
+	// order of the rules containing them; a choice shared by several
+	// rules, as the expression of an inlined rule, is probed as one.
+	type choice struct {
+		Rule     string
+		Branches []string
+	}
+	var choices []choice
+	if ambiguity {
+		for el := t.Front(); el != nil; el = el.Next() {
+			r, ok := el.Value.(*rule)
+			if !ok || r.expression == nil {
+				continue
+			}
+			Inspect(r.GetExpression(), func(node Node) bool {
+				if node == nil || node.GetType() != TypeAlternate || node.(List).Len() < 2 {
+					return true
+				}
+				if _, ok := choiceIds[node]; !ok {
+					c := choice{Rule: r.String()}
+					for el := node.(List).Front(); el != nil; el = el.Next() {
+						var b bytes.Buffer
+						writeExpression(&b, el.Value.(Node), precPrefix, false)
+						c.Branches = append(c.Branches, b.String())
+					}
+					choiceIds[node] = len(choices)
+					choices = append(choices, c)
+				}
+				return true
+			})
+		}
+	}
+
 	// dry compilation
 	// figure out which items need to restore position resp. thunkPosition,
 	// storing into w.saveFlags
@@ -1373,10 +2647,12 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 		if expression == nilNode {
 			continue
 		}
+		w.ruleLabels = w.nLabels
 		ko := w.newLabel()
 		ko.sid = 0
-		if count, ok := t.rulesCount[rule.String()]; !ok {
-		} else if t.inline && count == 1 && ko.id != 0 {
+		ruleKo = ko
+		if _, ok := t.rulesCount[rule.String()]; !ok {
+		} else if inlined(rule.String()) && ko.id != 0 {
 			continue
 		}
 		ko.save()
@@ -1386,22 +2662,72 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 		}
 	}
 	w.setDry(false)
-	if Verbose {
-		log.Printf("%+v\n", stats)
+	t.report.Stats = stats.values()
+	// actionBits returns the width of the unsigned integer type
+	// holding action ids, including those of yyPush, yyPop, yySet,
+	// and yyPos, which follow the ids of the grammar's actions.
+	actionBits := func() (bits int) {
+		for n := len(t.Actions) + 3; n != 0; n >>= 1 {
+			bits++
+		}
+		switch {
+		case bits <= 8:
+			bits = 8
+		case bits <= 16:
+			bits = 16
+		case bits <= 32:
+			bits = 32
+		default:
+			bits = 64
+		}
+		return
+	}
+	// classComment describes a row of the classes table by the
+	// class as written in the grammar, and the rules using it
+	var classUsers map[string][]string
+	classComment := func(text string) string {
+		if classUsers == nil {
+			classUsers = make(map[string][]string)
+			for el := t.Front(); el != nil; el = el.Next() {
+				r, ok := el.Value.(*rule)
+				if !ok {
+					continue
+				}
+				Inspect(r, func(n Node) bool {
+					if n != nil && n.GetType() == TypeClass {
+						users := classUsers[n.String()]
+						if len(users) == 0 || users[len(users)-1] != r.String() {
+							classUsers[n.String()] = append(users, r.String())
+						}
+					}
+					return true
+				})
+			}
+		}
+		c := strings.NewReplacer("\n", `\n`, "\r", `\r`).Replace("[" + text + "]")
+		if users := classUsers[text]; len(users) != 0 {
+			c += ": " + strings.Join(users, ", ")
+		}
+		return c
 	}
 	tpl := template.New("parser")
 	tpl.Funcs(template.FuncMap{
 		"len":      itemLength,
 		"def":      func(key string) string { return t.defines[key] },
-		"id":	func(identifier string) string {
-			if t.defines["noexport"] != "" {
-				return identifier
-			}
-			return strings.Title(identifier)
-		},
+		"id":       t.ident,
+		"code":     func(a *action) string { return a.code(rename) },
 		"stats":    func() *statValues { return &stats },
 		"nvar":     func() int { return nvar },
 		"numRules": func() int { return len(t.rules) },
+		"hasErrorActions": func() bool { return immediate },
+		"startRule": func() string {
+			r, ok := t.rules[t.StartRule()]
+			if !ok || r.expression == nil {
+				t.warnf("start rule '%v' not defined", t.StartRule())
+				r = t.rules[t.FirstRule()]
+			}
+			return r.GoString()
+		},
 		"sortedRules": func() (r []*rule) {
 			for el := t.Front(); el != nil; el = el.Next() {
 				node := el.Value.(Node)
@@ -1412,32 +2738,81 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 			}
 			return
 		},
-		"hasCommit": func() bool { return counts[TypeCommit] > 0 },
-		"actionBits": func() (bits int) {
-			for n := len(t.Actions); n != 0; n >>= 1 {
-				bits++
+		"hasCommit":  func() bool { return hasCommit },
+		"finalCommit": func() bool { return finalCommit },
+		"thunks":     func() bool { return !w.noThunks },
+		"readsVariables": func() bool { return readsVariables },
+		"hasIndentation": func() bool {
+			return stats.Indent.Push+stats.Indent.Pop+stats.Indent.Same != 0
+		},
+		"yyspan":     func() []string { return strings.Fields(t.defines["yyspan"]) },
+		"valueKind":  func() string { return valueKind },
+		"actionBits": actionBits,
+		"split":      func() bool { return len(parts) != 0 },
+		"classComment": classComment,
+		"ruleText": func(r *rule) string {
+			return strings.NewReplacer("\n", `\n`, "\r", `\r`).Replace(ruleText(r))
+		},
+		"classStrings": func() bool { return O.classStrings },
+		"classIndex":   func(text string) int { return t.Classes[text].Index },
+		"tokenRules": func() (r []*rule) {
+			for el := t.Front(); el != nil; el = el.Next() {
+				if rule, ok := el.Value.(*rule); ok && t.tokens[rule.String()] && rule.expression != nil {
+					r = append(r, rule)
+				}
 			}
-			switch {
-			case bits < 8:
-				bits = 8
-			case bits < 16:
-				bits = 16
-			case bits < 32:
-				bits = 32
-			case bits < 64:
-				bits = 64
+			return
+		},
+		"tracing": func() bool { return t.defines["trace"] != "" || len(t.traced) != 0 },
+		"choices": func() []choice { return choices },
+		"privateRules": func() (r []*rule) {
+			for el := t.Front(); el != nil; el = el.Next() {
+				if rule, ok := el.Value.(*rule); ok && t.private[rule.String()] && rule.expression != nil && rule.String() != t.StartRule() {
+					r = append(r, rule)
+				}
 			}
 			return
 		},
+		"classTexts": func() []string {
+			texts := make([]string, len(t.Classes))
+			for text, c := range t.Classes {
+				texts[c.Index] = text
+			}
+			return texts
+		},
+		"actionName": func(a *action) string { return actionNames[a.id] },
+		"thunkOffset": func() string {
+			if t.defines["commit"] == "nested" {
+				return rename("-thunkBase")
+			}
+			return ""
+		},
+		"keywordTables": func() []string { return keywordTables },
 	})
-	if _, err := tpl.Parse(parserTemplate); err != nil {
-		log.Fatal(err)
+	if _, err := tpl.Parse(renameTemplate(parserTemplate, rename)); err != nil {
+		t.fail("%v", err)
 	}
 	if err := tpl.Execute(w, t); err != nil {
-		log.Fatal(err)
+		t.fail("%v", err)
 	}
 
 	/* now for the real compile pass */
+	ruleStack := t.defines["rulestack"] != ""
+	metrics := t.defines["metrics"] != ""
+	maxDepth := t.defines["maxdepth"] != ""
+	// ruleSpans reports whether the span of a rule is recorded
+	ruleSpans := func(r *rule) bool {
+		return !w.noThunks && (spans == "rules" || spans == "tokens" && t.tokens[r.name])
+	}
+	var ruleCode []*bytes.Buffer
+	// In flat code, the rules are written to body, which becomes the
+	// body of function run, and the functions of p.rules call run.
+	var body bytes.Buffer
+	var ruleFuncs []string
+	if w.flat {
+		w.Writer = &body
+		w.indent = 1
+	}
 	for element := t.Front(); element != nil; element = element.Next() {
 		node := element.Value.(Node)
 		if node.GetType() != TypeRule {
@@ -1446,35 +2821,169 @@ func (t *Tree) Compile(out io.Writer, optiFlags string) {
 		rule := node.(*rule)
 		expression := rule.GetExpression()
 		if expression == nilNode {
-			fmt.Fprintf(os.Stderr, "rule '%v' used but not defined\n", rule)
-			w.lnPrint("nil,")
+			switch {
+			case w.flat:
+				ruleFuncs = append(ruleFuncs, "nil,")
+			case parts == nil:
+				w.lnPrint("nil,")
+			}
 			continue
 		}
+		w.ruleLabels = w.nLabels
+		w.locals = w.locals[:0]
 		ko := w.newLabel()
 		ko.sid = 0
-		w.lnPrint("/* %v ", rule.GetId())
-		printRule(rule)
-		print(" */")
-		if count, ok := t.rulesCount[rule.String()]; !ok {
-			fmt.Fprintf(os.Stderr, "rule '%v' defined but not used\n", rule)
-		} else if t.inline && count == 1 && ko.id != 0 {
-			w.lnPrint("nil,")
+		ruleKo = ko
+		if parts != nil {
+			b := new(bytes.Buffer)
+			ruleCode = append(ruleCode, b)
+			w.Writer = b
+			w.indent = 1
+		}
+		w.lnPrint("/* %v %s */", rule.GetId(), strings.Replace(ruleText(rule), "*/", "* /", -1))
+		if _, ok := t.rulesCount[rule.String()]; !ok {
+			// imported grammars, like libraries, may define rules not needed
+			if !t.tokens[rule.String()] && rule.file == "" {
+				t.warnf("rule '%v' defined but not used", rule)
+			}
+		} else if inlined(rule.String()) && ko.id != 0 {
+			switch {
+			case w.flat:
+				ruleFuncs = append(ruleFuncs, "nil,")
+			case parts == nil:
+				w.lnPrint("nil,")
+			default:
+				ruleCode = ruleCode[:len(ruleCode)-1]
+			}
 			continue
 		}
-		w.lnPrint("func() bool {")
+		switch {
+		case w.flat:
+			ruleFuncs = append(ruleFuncs, fmt.Sprintf(w.rename("func() bool { return run(rule%s) },"), rule.GoString()))
+			w.rules = append(w.rules, rule)
+			w.lnPrint("r%d:", rule.GetId())
+		case parts == nil:
+			w.lnPrint("func() bool {")
+		default:
+			w.lnPrint("p.rules[rule%s] = func() bool {", rule.GoString())
+		}
 		w.indent++
+		if ruleStack {
+			w.lnPrint("p.ruleStack = append(p.ruleStack, rule%s)", rule.GoString())
+		}
+		if metrics {
+			w.lnPrint("p.ruleCalls[rule%s]++", rule.GoString())
+			w.lnPrint("if p.Profile {")
+			w.lnPrint("\tp.profile.enter(rule%s)", rule.GoString())
+			w.lnPrint("}")
+		}
+		if maxDepth {
+			w.lnPrint("if p.depth++; p.depth > p.MaxDepth {")
+			w.lnPrint("\tpanic(%s)", t.ident("errTooDeep"))
+			w.lnPrint("}")
+		}
+		traced := t.traced[rule.String()]
+		if traced {
+			w.lnPrint("if p.Tracer != nil {")
+			w.lnPrint("\tp.Tracer.BeginRule(%q, position)", rule)
+			w.lnPrint("}")
+		}
+		if ruleSpans(rule) {
+			w.declare("position", "spanBegin")
+		}
 		ko.save()
 		cko, _ := compileExpression(rule, ko)
-		w.lnPrint("return true")
+		if ruleStack {
+			w.lnPrint("p.ruleStack = p.ruleStack[:len(p.ruleStack)-1]")
+		}
+		if ruleSpans(rule) {
+			w.lnPrint("dospan(rule%s, spanBegin, position)", rule.GoString())
+		}
+		if traced {
+			w.lnPrint("if p.Tracer != nil {")
+			w.lnPrint("\tp.Tracer.EndRule(%q, position, true)", rule)
+			w.lnPrint("}")
+		}
+		if metrics {
+			w.lnPrint("if p.Profile {")
+			w.lnPrint("\tp.profile.leave()")
+			w.lnPrint("}")
+		}
+		if maxDepth {
+			w.lnPrint("p.depth--")
+		}
+		w.ret(true)
 		if ko.used {
 			ko.restore(cko.pos, cko.thPos)
-			w.lnPrint("return false")
+			if ruleStack {
+				w.lnPrint("p.ruleStack = p.ruleStack[:len(p.ruleStack)-1]")
+			}
+			if metrics {
+				w.lnPrint("p.ruleFails[rule%s]++", rule.GoString())
+				w.lnPrint("if p.Profile {")
+				w.lnPrint("\tp.profile.leave()")
+				w.lnPrint("}")
+			}
+			if traced {
+				w.lnPrint("if p.Tracer != nil {")
+				w.lnPrint("\tp.Tracer.EndRule(%q, position, false)", rule)
+				w.lnPrint("}")
+			}
+			if maxDepth {
+				w.lnPrint("p.depth--")
+			}
+			w.ret(false)
 		}
 		w.indent--
-		w.lnPrint("},")
+		switch {
+		case w.flat:
+		case parts == nil:
+			w.lnPrint("},")
+		default:
+			w.lnPrint("}")
+		}
+	}
+	w.Writer = out
+	if w.flat {
+		w.printRun(body.Bytes(), ruleFuncs)
+		print("\n}\n")
+	} else if parts == nil {
+		print("\n\t}")
+		if t.defines["memo"] != "" {
+			print("%s", rename("\n\tmemoize()"))
+		}
+		print("\n}\n")
+	} else {
+		fields := t.stateFields(actionBits(), !w.noThunks, hasCommit, immediate, nvar > 0, readsVariables)
+		printStateValue(out, fields, rename)
+		for i := range parts {
+			fmt.Fprintf(out, "\n\tp.initRules%d(s)", i+1)
+		}
+		if t.defines["memo"] != "" {
+			fmt.Fprint(out, rename("\n\tmemoize()"))
+		}
+		fmt.Fprintf(out, "\n}\n")
+		printStateType(out, fields, rename)
+
+		consts := make(map[string]int)
+		if nvar > 0 {
+			consts["yyPush"] = len(t.Actions)
+			consts["yyPop"] = len(t.Actions) + 1
+			consts["yySet"] = len(t.Actions) + 2
+			consts["yyPos"] = len(t.Actions) + 3
+		}
+		n := len(ruleCode)
+		for i, part := range parts {
+			var code bytes.Buffer
+			for _, b := range ruleCode[i*n/len(parts) : (i+1)*n/len(parts)] {
+				code.Write(qualify(b.Bytes(), fields, consts, rename))
+			}
+			t.printPartHeader(part)
+			fmt.Fprintf(part, rename("\nfunc (p *%s) initRules%d(s *yyRuleState) {"), t.defines["Peg"], i+1)
+			code.WriteTo(part)
+			fmt.Fprintf(part, "\n}\n")
+		}
 	}
-	print("\n\t}")
-	print("\n}\n")
 
 	for _, s := range t.trailers {
 		print("%s", s)
@@ -1499,19 +3008,26 @@ func compileOptFirst(w *writer, node Node, ko *label, compile func(Node, *label)
 		chgok.pos = true
 		stats.optFirst.class++
 	case TypeString:
-		if s := node.String(); len(s) == 2 {
-			w.lnPrint("position++ // matchString(`%s`)", s)
-			ko.cJump(false, "matchChar('%c')", s[1])
+		if s := unescape(node.String()); len(s) == 2 {
+			w.lnPrint("position++ // matchString(%s)", strconv.Quote(s))
+			ko.cJump(false, "matchChar(%s)", goChar(s[1:]))
 			chgok.pos = true
 			stats.Match.Char++
 			stats.optFirst.str++
 		} else if s != "" {
 			w.lnPrint("position++")
-			ko.cJump(false, "matchString(\"%s\")", s[1:])
+			ko.cJump(false, "matchString(%s)", strconv.Quote(s[1:]))
 			chgok.pos = true
 			stats.Match.String++
 			stats.optFirst.str++
 		}
+	case TypePlus:
+		// the first repetition of a character, or a class, matches
+		switch node.(List).Front().Value.(Node).GetType() {
+		case TypeCharacter, TypeClass:
+			w.knownFirst = node
+		}
+		chgko, chgok = compile(node, ko)
 	case TypeSequence:
 		front := node.(List).Front()
 		for element := front; element != nil; element = element.Next() {
@@ -1555,14 +3071,43 @@ func updateChgFlags(ko, ok, newko, newok chgFlags) (chgFlags, chgFlags) {
 	return ko, ok
 }
 
+// A savedVar describes state that is saved and restored together with
+// the position: a variable name, used with a label number appended,
+// an expression for its value, and the format of a statement
+// restoring it from the variable.
+type savedVar struct {
+	name, get, set string
+}
+
 type writer struct {
 	io.Writer
 	indent      int
 	nLabels     int
+	ruleLabels  int // number of labels preceding the current rule
 	dryRun      bool
 	savedIndent int
 	saveFlags   []saveFlags
 	elimRestore bool
+	saved       []savedVar // state saved and restored together with position
+	rename      func(string) string
+
+	// Without actions, there are no thunks, and no thunkPosition to
+	// be saved.
+	noThunks bool
+
+	// In flat code, used in iterative mode, the rules are not
+	// functions, but parts of a single function without blocks,
+	// whose local variables are declared at its beginning.
+	flat     bool
+	locals   []string        // variables of the current rule, saved at calls
+	declared map[string]bool // variables of all rules
+	vars     []string        // the same, in the order of their declaration
+	nCalls   int             // number of call sites, each having a return label
+	rules    []*rule         // rules having an entry label
+
+	// a repetition, whose first item is known to match, when
+	// compiling the first item of a case of a switch statement
+	knownFirst Node
 }
 
 type saveFlags struct {
@@ -1570,15 +3115,139 @@ type saveFlags struct {
 }
 
 func newWriter(out io.Writer) *writer {
-	return &writer{Writer: out, indent: 2}
+	return &writer{Writer: out, indent: 2, rename: func(s string) string { return s }}
 }
 
 func (w *writer) begin() {
+	if w.flat {
+		return
+	}
 	w.lnPrint("{")
 	w.indent++
 }
 
 func (w *writer) end() {
+	if w.flat {
+		return
+	}
+	w.indent--
+	w.lnPrint("}")
+}
+
+// declare prints the declaration of local variables, initialized
+// to value, like "position1, thunkPosition1 := position, thunkPosition".
+// In flat code, the variables are only assigned, and recorded, to be
+// declared at the beginning of the function.
+func (w *writer) declare(value string, names ...string) {
+	op := ":="
+	if w.flat {
+		op = "="
+	}
+	w.lnPrint("%s %s %s", w.rename(strings.Join(names, ", ")), op, w.rename(value))
+	if !w.flat || w.dryRun {
+		return
+	}
+	if w.declared == nil {
+		w.declared = make(map[string]bool)
+	}
+	for _, name := range names {
+		if !w.declared[name] {
+			w.declared[name] = true
+			w.vars = append(w.vars, name)
+		}
+		local := false
+		for _, l := range w.locals {
+			local = local || l == name
+		}
+		if !local {
+			w.locals = append(w.locals, name)
+		}
+	}
+}
+
+// ret prints the return of the result of the current rule.
+func (w *writer) ret(ok bool) {
+	if w.flat {
+		w.lnPrint("callOk = %v", ok)
+		w.lnPrint("goto ret")
+		return
+	}
+	w.lnPrint("return %v", ok)
+}
+
+/*
+call prints, in flat code, an application of rule r, which continues
+at label ko, if the rule fails: the local variables of the current
+rule, followed by the number of the call site, are pushed onto the
+stack calls, and the code of r is entered; the code after label ret
+pops the number, and jumps to the label of the call site, where the
+variables are restored.
+*/
+func (w *writer) call(r *rule, ko *label) {
+	if !w.dryRun {
+		n := w.nCalls
+		w.nCalls++
+		w.lnPrint("calls = append(calls, %s)", strings.Join(append(w.locals[:len(w.locals):len(w.locals)], strconv.Itoa(n)), ", "))
+		w.lnPrint("goto r%d", r.GetId())
+		w.indent--
+		w.lnPrint("c%d:", n)
+		w.indent++
+		if k := len(w.locals); k != 0 {
+			values := make([]string, k)
+			for i := range values {
+				values[i] = fmt.Sprintf("calls[callTop+%d]", i)
+			}
+			values[0] = "calls[callTop]"
+			w.lnPrint("callTop = len(calls) - %d", k)
+			w.lnPrint("%s = %s", strings.Join(w.locals, ", "), strings.Join(values, ", "))
+			w.lnPrint("calls = calls[:callTop]")
+		}
+	}
+	ko.cJump(false, "callOk")
+}
+
+// printRun prints function run, in which the code of the rules is
+// flat, followed by the functions of p.rules calling it.
+func (w *writer) printRun(body []byte, ruleFuncs []string) {
+	w.indent = 1
+	w.lnPrint("// run applies a rule, without nesting calls of Go functions,")
+	w.lnPrint("// so that the Go stack does not grow with the nesting of the input.")
+	w.lnPrint("run := func(rule int) (callOk bool) {")
+	w.indent++
+	w.lnPrint("var callTop int")
+	if len(w.vars) != 0 {
+		w.lnPrint("var %s int", strings.Join(w.vars, ", "))
+	}
+	w.lnPrint("callBase := len(calls) // run may be called by actions, or predicates")
+	w.lnPrint("switch rule {")
+	for _, r := range w.rules {
+		w.lnPrint("case rule%s:", r.GoString())
+		w.lnPrint("\tgoto r%d", r.GetId())
+	}
+	w.lnPrint("}")
+	w.Write(body)
+	w.indent--
+	w.lnPrint("ret:")
+	w.indent++
+	w.lnPrint("if len(calls) == callBase {")
+	w.lnPrint("\treturn")
+	w.lnPrint("}")
+	w.lnPrint("callTop = len(calls) - 1")
+	w.lnPrint("calls, callTop = calls[:callTop], calls[callTop]")
+	w.lnPrint("switch callTop {")
+	for i := 0; i < w.nCalls; i++ {
+		w.lnPrint("case %d:", i)
+		w.lnPrint("\tgoto c%d", i)
+	}
+	w.lnPrint("}")
+	w.lnPrint("panic(\"invalid call site\")")
+	w.indent--
+	w.lnPrint("}")
+	w.lnPrint("p.rules = [...]func() bool{")
+	w.indent++
+	for _, f := range ruleFuncs {
+		w.lnPrint("%s", f)
+	}
 	w.indent--
 	w.lnPrint("}")
 }
@@ -1593,8 +3262,15 @@ func (w *writer) setDry(on bool) {
 	}
 }
 
+/*
+A label has an id, unique within the parser, that is used as an index
+of saveFlags, and a number, counting the labels of the current rule,
+that is used in the generated code, so that a change of one rule does
+not affect the code of other ones. If its sid (save id) is zero,
+the label uses the variables saved at the entry of a rule.
+*/
 type label struct {
-	id, sid int
+	id, num, sid int
 	*writer
 	used           bool
 	savedBlockOpen bool
@@ -1606,17 +3282,21 @@ func (w *writer) newLabel() *label {
 	if w.dryRun {
 		w.saveFlags = append(w.saveFlags, saveFlags{})
 	}
-	return &label{id: i, sid: i, writer: w}
+	l := &label{id: i, num: i - w.ruleLabels, sid: i - w.ruleLabels, writer: w}
+	if w.flat {
+		l.num = i // labels are unique within the function
+	}
+	return l
 }
 
 func (w *label) label() {
 	w.indent--
-	w.lnPrint("l%d:", w.id)
+	w.lnPrint("l%d:", w.num)
 	w.indent++
 }
 
 func (w *label) jump() {
-	w.lnPrint("goto l%d", w.id)
+	w.lnPrint("goto l%d", w.num)
 	w.used = true
 }
 
@@ -1630,19 +3310,28 @@ func (w *label) saveBlock() {
 }
 func (w *label) save() {
 	save := w.saveFlags[w.id]
+	if w.noThunks {
+		save.thPos = false
+	}
+	pos, thPos := fmt.Sprintf(w.rename("position%d"), w.sid), fmt.Sprintf(w.rename("thunkPosition%d"), w.sid)
 	switch {
 	case save.pos && save.thPos:
-		w.lnPrint("position%d, thunkPosition%d := position, thunkPosition", w.sid, w.sid)
+		w.declare("position, thunkPosition", pos, thPos)
 	case !save.pos && save.thPos:
-		w.lnPrint("thunkPosition%d := thunkPosition", w.sid)
+		w.declare("thunkPosition", thPos)
 	case save.pos:
-		w.lnPrint("position%d := position", w.sid)
+		w.declare("position", pos)
+	}
+	if save.pos {
+		for _, v := range w.saved {
+			w.declare(v.get, fmt.Sprintf("%s%d", v.name, w.sid))
+		}
 	}
 }
 
 func (w *label) unsafe() bool {
 	save := w.saveFlags[w.id]
-	return save.pos || save.thPos
+	return save.pos || save.thPos && !w.noThunks
 }
 
 func (w *label) restore(savePos, saveThPos bool) {
@@ -1658,6 +3347,9 @@ func (w *label) lrestore(label *label, savePos, saveThPos bool) {
 		savePos = true
 		saveThPos = true
 	}
+	if w.noThunks {
+		saveThPos = false
+	}
 	switch {
 	case savePos && saveThPos:
 		w.lnPrint("position, thunkPosition = position%d, thunkPosition%d", w.sid, w.sid)
@@ -1671,6 +3363,11 @@ func (w *label) lrestore(label *label, savePos, saveThPos bool) {
 		stats.elimRestore.thunkPos++
 		stats.elimRestore.pos++
 	}
+	if savePos {
+		for _, v := range w.saved {
+			w.lnPrint(v.set, fmt.Sprintf("%s%d", v.name, w.sid))
+		}
+	}
 	if w.dryRun {
 		save := &w.saveFlags[w.id]
 		if !save.pos {
@@ -1698,7 +3395,7 @@ func (w *label) cJump(jumpIfTrue bool, format string, a ...interface{}) {
 	}
 	w.lnPrint(format, a...)
 	fmt.Fprint(w, " {")
-	w.lnPrint("\tgoto l%d", w.id)
+	w.lnPrint("\tgoto l%d", w.num)
 	w.lnPrint("}")
 }
 
@@ -1710,12 +3407,12 @@ func (w *writer) lnPrint(format string, a ...interface{}) {
 	for i := 0; i < w.indent; i++ {
 		s += "\t"
 	}
-	fmt.Fprintf(w, s+format, a...)
+	fmt.Fprintf(w, s+w.rename(format), a...)
 }
 
 type statValues struct {
 	Peek, Match struct {
-		Char, Class, Dot, String int
+		Char, Class, Dot, String, Bytes int
 	}
 	elimRestore struct {
 		pos, thunkPos int
@@ -1723,8 +3420,15 @@ type statValues struct {
 	optFirst struct {
 		char, dot, str, class int
 	}
-	seqIfNot    int
-	inlineLeafs int
+	seqIfNot     int
+	inlineLeafs  int
+	WordBoundary int
+	Indent       struct {
+		Push, Pop, Same int
+	}
+	hoisted        int // actions removed by hoistActions
+	dispatchTables int
+	keywordTables  int
 }
 
 var stats statValues
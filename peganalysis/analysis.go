@@ -0,0 +1,321 @@
+/*
+Package peganalysis provides static analyses of grammar trees of
+package peg, like those Compile performs to warn about problems,
+and to optimize the generated parser: which expressions may match
+the empty string, the sets of characters matches may start with,
+which rules are reachable from the start rule, and which are left
+recursive. Lint tools, and editors, may use them to check grammars
+without generating a parser.
+
+The analyses work on the tree as constructed by a parser of the
+grammar, i.e. before it has been compiled.
+*/
+package peganalysis
+
+import (
+	"github.com/knieriem/peg"
+	"strings"
+)
+
+// A Set is a set of bytes.
+type Set [32]uint8
+
+func (s *Set) Add(c byte)      { s[c>>3] |= 1 << (c & 7) }
+func (s *Set) Has(c byte) bool { return s[c>>3]&(1<<(c&7)) != 0 }
+
+// union adds the members of u to s, and reports whether s has changed.
+func (s *Set) union(u *Set) (changed bool) {
+	for i, v := range u {
+		if v&^s[i] != 0 {
+			s[i] |= v
+			changed = true
+		}
+	}
+	return
+}
+
+// Len returns the number of members of s.
+func (s *Set) Len() (n int) {
+	for c := 0; c < 256; c++ {
+		if s.Has(byte(c)) {
+			n++
+		}
+	}
+	return
+}
+
+// String returns the members of s like the text of a class,
+// with ranges of consecutive bytes, e.g. "0-9a-z".
+func (s *Set) String() string {
+	var b strings.Builder
+	char := func(c int) {
+		switch {
+		case c == '\\' || c == ']' || c == '-':
+			b.WriteString(`\` + string(rune(c)))
+		case c < ' ' || c >= 0x7F || c == '^' && b.Len() == 0:
+			b.WriteString(`\` + string(rune('0'+c>>6)) + string(rune('0'+c>>3&7)) + string(rune('0'+c&7)))
+		default:
+			b.WriteByte(byte(c))
+		}
+	}
+	for c := 0; c < 256; c++ {
+		if !s.Has(byte(c)) {
+			continue
+		}
+		lo := c
+		for c+1 < 256 && s.Has(byte(c+1)) {
+			c++
+		}
+		char(lo)
+		if c > lo {
+			if c > lo+1 {
+				b.WriteByte('-')
+			}
+			char(c)
+		}
+	}
+	return b.String()
+}
+
+// An Analysis holds the results of the analyses of a tree,
+// which are computed by New.
+type Analysis struct {
+	t        *peg.Tree
+	rules    map[string]peg.Rule
+	order    []string // names of the rules, in definition order
+	nullable map[string]bool
+	first    map[string]*Set
+}
+
+// New analyses the rules of t.
+func New(t *peg.Tree) *Analysis {
+	a := &Analysis{t: t, rules: make(map[string]peg.Rule), nullable: make(map[string]bool), first: make(map[string]*Set)}
+	for el := t.Front(); el != nil; el = el.Next() {
+		if r, ok := el.Value.(peg.Rule); ok {
+			a.rules[r.String()] = r
+			a.order = append(a.order, r.String())
+			a.first[r.String()] = new(Set)
+		}
+	}
+	// Both properties of rules are computed as least fixed points,
+	// starting with non-nullable rules, and empty first sets.
+	for changed := true; changed; {
+		changed = false
+		for _, name := range a.order {
+			e := a.rules[name].GetExpression()
+			if !a.nullable[name] && a.Nullable(e) {
+				a.nullable[name] = true
+				changed = true
+			}
+			var s Set
+			a.addFirst(&s, e)
+			if a.first[name].union(&s) {
+				changed = true
+			}
+		}
+	}
+	return a
+}
+
+// Rules returns the names of the rules, in the order of their definition.
+func (a *Analysis) Rules() []string { return a.order }
+
+/*
+Nullable reports whether node, an expression, or a rule, may
+succeed without consuming input. References to undefined rules
+are considered not nullable.
+*/
+func (a *Analysis) Nullable(node peg.Node) bool {
+	switch node.GetType() {
+	case peg.TypeRule, peg.TypeName:
+		return a.nullable[node.String()]
+	case peg.TypeDot, peg.TypeClass:
+		return false
+	case peg.TypeCharacter, peg.TypeString:
+		return peg.Unescape(node.String()) == ""
+	case peg.TypeAlternate, peg.TypeUnorderedAlternate:
+		for el := node.(peg.List).Front(); el != nil; el = el.Next() {
+			if a.Nullable(el.Value.(peg.Node)) {
+				return true
+			}
+		}
+		return false
+	case peg.TypeSequence:
+		for el := node.(peg.List).Front(); el != nil; el = el.Next() {
+			if !a.Nullable(el.Value.(peg.Node)) {
+				return false
+			}
+		}
+		return true
+	case peg.TypePlus, peg.TypeError:
+		return a.Nullable(node.(peg.List).Front().Value.(peg.Node))
+	}
+	// predicates, options, repetitions, actions, and other
+	// primitives, which may not consume input
+	return true
+}
+
+/*
+First returns the set of characters a non-empty match of node,
+an expression, or a rule, may start with. Together with Nullable,
+it tells which characters may follow the position where node is
+applied, if it succeeds.
+*/
+func (a *Analysis) First(node peg.Node) *Set {
+	s := new(Set)
+	a.addFirst(s, node)
+	return s
+}
+
+func (a *Analysis) addFirst(s *Set, node peg.Node) {
+	switch node.GetType() {
+	case peg.TypeRule, peg.TypeName:
+		if f, ok := a.first[node.String()]; ok {
+			s.union(f)
+		}
+	case peg.TypeDot:
+		for c := 0; c < 256; c++ {
+			s.Add(byte(c))
+		}
+	case peg.TypeClass:
+		if e, ok := a.t.Classes[node.String()]; ok {
+			for c := 0; c < 256; c++ {
+				if e.Class[c>>3]&(1<<(uint(c)&7)) != 0 {
+					s.Add(byte(c))
+				}
+			}
+		}
+	case peg.TypeCharacter, peg.TypeString:
+		if text := peg.Unescape(node.String()); text != "" {
+			s.Add(text[0])
+		}
+	case peg.TypeAlternate, peg.TypeUnorderedAlternate:
+		for el := node.(peg.List).Front(); el != nil; el = el.Next() {
+			a.addFirst(s, el.Value.(peg.Node))
+		}
+	case peg.TypeSequence:
+		for el := node.(peg.List).Front(); el != nil; el = el.Next() {
+			e := el.Value.(peg.Node)
+			a.addFirst(s, e)
+			if !a.Nullable(e) {
+				break
+			}
+		}
+	case peg.TypeQuery, peg.TypeStar, peg.TypePlus, peg.TypeError:
+		a.addFirst(s, node.(peg.List).Front().Value.(peg.Node))
+	}
+}
+
+/*
+Reachable returns the names of the rules that are reachable from
+the given rules, including these. If none are given, the first
+rule, and the start rule, if declared using %start, are used,
+like by Compile, which warns about rules not reached.
+*/
+func (a *Analysis) Reachable(start ...string) map[string]bool {
+	if len(start) == 0 {
+		start = []string{a.t.FirstRule(), a.t.StartRule()}
+	}
+	reached := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		r, ok := a.rules[name]
+		if !ok || reached[name] {
+			return
+		}
+		reached[name] = true
+		peg.Inspect(r.GetExpression(), func(n peg.Node) bool {
+			if n != nil && n.GetType() == peg.TypeName {
+				visit(n.String())
+			}
+			return true
+		})
+	}
+	for _, name := range start {
+		visit(name)
+	}
+	return reached
+}
+
+// LeftCalls returns the names of the rules that node, an
+// expression, or the expression of a rule, may apply at the position
+// where it is applied itself, i.e. before consuming input.
+func (a *Analysis) LeftCalls(node peg.Node) []string {
+	var names []string
+	seen := make(map[string]bool)
+	var visit func(node peg.Node)
+	visit = func(node peg.Node) {
+		switch node.GetType() {
+		case peg.TypeRule:
+			visit(node.(peg.Rule).GetExpression())
+		case peg.TypeName:
+			if !seen[node.String()] {
+				seen[node.String()] = true
+				names = append(names, node.String())
+			}
+		case peg.TypeAlternate, peg.TypeUnorderedAlternate:
+			for el := node.(peg.List).Front(); el != nil; el = el.Next() {
+				visit(el.Value.(peg.Node))
+			}
+		case peg.TypeSequence:
+			for el := node.(peg.List).Front(); el != nil; el = el.Next() {
+				e := el.Value.(peg.Node)
+				visit(e)
+				if !a.Nullable(e) {
+					break
+				}
+			}
+		case peg.TypeQuery, peg.TypeStar, peg.TypePlus, peg.TypeError, peg.TypePeekFor, peg.TypePeekNot:
+			visit(node.(peg.List).Front().Value.(peg.Node))
+		}
+	}
+	visit(node)
+	return names
+}
+
+/*
+LeftRecursion returns the cycles of left recursive rules, each
+as a path of rule names starting and ending with the same rule,
+like [A B A]: A may apply B, and B may apply A, without consuming
+input in between, so that the parser would not terminate. Each
+cycle is reported once, starting with the rule defined first, and
+is one of the shortest ones through this rule.
+*/
+func (a *Analysis) LeftRecursion() (cycles [][]string) {
+	calls := make(map[string][]string)
+	index := make(map[string]int)
+	for i, name := range a.order {
+		calls[name] = a.LeftCalls(a.rules[name])
+		index[name] = i
+	}
+	for _, start := range a.order {
+		// breadth-first search for the shortest path back to start,
+		// only passing rules defined after it, so that each cycle
+		// is found from its first rule only
+		prev := map[string]string{start: ""}
+		queue := []string{start}
+		var path []string
+	search:
+		for len(queue) != 0 {
+			name := queue[0]
+			queue = queue[1:]
+			for _, next := range calls[name] {
+				if next == start {
+					for n := name; n != ""; n = prev[n] {
+						path = append([]string{n}, path...)
+					}
+					path = append(path, start)
+					break search
+				}
+				if _, ok := prev[next]; !ok && a.rules[next] != nil && index[next] > index[start] {
+					prev[next] = name
+					queue = append(queue, next)
+				}
+			}
+		}
+		if path != nil {
+			cycles = append(cycles, path)
+		}
+	}
+	return
+}
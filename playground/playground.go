@@ -0,0 +1,103 @@
+/*
+Package playground implements a small web page, where a grammar and
+a sample input can be edited. The input is matched against the grammar
+using the interpreter of package peg, and the resulting parse tree,
+and optionally a trace of all rule invocations, is displayed.
+*/
+package playground
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/knieriem/peg"
+	"html/template"
+	"net/http"
+)
+
+// A Loader builds a Tree from the text of a grammar,
+// using the parser of a specific grammar syntax.
+type Loader func(grammar string) (*peg.Tree, error)
+
+type page struct {
+	Grammar, Input, Start string
+	Trace                 bool
+	Result, Error         string
+}
+
+// Handler returns a http.Handler serving the playground page. The
+// grammar text area is prefilled with the contents of example.
+func Handler(load Loader, example string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := &page{Grammar: example}
+		if r.Method == "POST" {
+			p.Grammar = r.FormValue("grammar")
+			p.Input = r.FormValue("input")
+			p.Start = r.FormValue("start")
+			p.Trace = r.FormValue("trace") != ""
+			p.run(load)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := pageTemplate.Execute(w, p); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+func (p *page) run(load Loader) {
+	defer func() {
+		if e := recover(); e != nil {
+			p.Error = fmt.Sprint("grammar: ", e)
+		}
+	}()
+	t, err := load(p.Grammar)
+	if err != nil {
+		p.Error = fmt.Sprint("grammar: ", err)
+		return
+	}
+	if p.Start == "" {
+		p.Start = t.StartRule()
+	}
+	var b bytes.Buffer
+	ip := peg.NewInterpreter(t)
+	if p.Trace {
+		ip.Trace = &b
+	}
+	m, err := ip.Parse(p.Start, p.Input)
+	if err != nil {
+		p.Error = fmt.Sprint("input: ", err)
+	} else if m.End != len(p.Input) {
+		p.Error = fmt.Sprintf("input: only %d of %d bytes matched", m.End, len(p.Input))
+	}
+	if m != nil {
+		if b.Len() != 0 {
+			b.WriteString("\n")
+		}
+		m.Fprint(&b, p.Input)
+	}
+	p.Result = b.String()
+}
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>peg playground</title>
+<style>
+textarea { width: 100%; font-family: monospace; }
+pre.error { color: #b00; }
+</style>
+</head>
+<body>
+<form method="POST">
+<p>Grammar:<br>
+<textarea name="grammar" rows="20">{{.Grammar}}</textarea>
+<p>Input:<br>
+<textarea name="input" rows="6">{{.Input}}</textarea>
+<p>Start rule: <input name="start" value="{{.Start}}">
+<label><input type="checkbox" name="trace"{{if .Trace}} checked{{end}}> trace</label>
+<input type="submit" value="Parse">
+</form>
+{{with .Error}}<pre class="error">{{.}}</pre>{{end}}
+{{with .Result}}<pre>{{.}}</pre>{{end}}
+</body>
+</html>
+`))
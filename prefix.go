@@ -0,0 +1,130 @@
+package peg
+
+import (
+	"bytes"
+	"go/scanner"
+	gotoken "go/token"
+	"strings"
+)
+
+/*
+Identifiers of the generated code that may collide with identifiers
+of user code, like rule constants, types, and the local variables
+and helper functions of Init, can be renamed using the "prefix"
+define. The prefix replaces a leading "yy", or is prepended
+otherwise. The identifiers yy and yytext, which are used by
+actions, are not renamed.
+*/
+var prefixedNames = []string{
+	"rule", "ruleNames", "ruleChain",
+	"position", "thunkPosition", "begin", "end",
+	"thunk", "thunks", "do", "doarg", "doerr", "dospan", "dopos", "commit", "actions",
+	"classes", "matchDot", "matchChar", "peekChar", "matchString", "matchClass", "peekClass", "inClass", "matchBytes", "atWordBoundary", "keywords", "matchKeywords",
+	"indents", "indentTop", "indentColumn", "pushIndent", "popIndent", "sameIndent",
+	"memo", "memoList", "memoKey", "memoEntry", "memoize", "commits", "thunkBase",
+	"yyp", "yyval", "yyvalue", "yyPush", "yyPop", "yySet", "yyPos", "yyRuleState", "yyExpected", "yyStateEntry", "yyChoices", "yyProfile", "yyFrame", "classNames",
+}
+
+func prefixName(prefix, name string) string {
+	if strings.HasPrefix(name, "yy") {
+		return prefix + name[2:]
+	}
+	return prefix + name
+}
+
+// ident returns the name of an identifier of the generated code,
+// which is exported, unless %noexport is given, and prefixed.
+func (t *Tree) ident(identifier string) string {
+	if t.defines["noexport"] == "" {
+		identifier = strings.Title(identifier)
+	}
+	return t.defines["prefix"] + identifier
+}
+
+// renamer returns a function that applies the prefix
+// to generated identifiers within a piece of Go code.
+func (t *Tree) renamer() func(string) string {
+	prefix := t.defines["prefix"]
+	if prefix == "" {
+		return func(s string) string { return s }
+	}
+	names := make(map[string]string, len(prefixedNames))
+	for _, name := range prefixedNames {
+		names[name] = prefixName(prefix, name)
+	}
+	return func(src string) string {
+		return renameIdents(src, names)
+	}
+}
+
+// userRenamer returns a function that applies the prefix to the
+// generated identifiers that semantic predicates, and the expressions
+// of @{ }, may refer to, like begin and end, the offsets of the last
+// capture, so that they keep working with a prefix. Actions receive
+// begin as a parameter instead.
+func (t *Tree) userRenamer() func(string) string {
+	prefix := t.defines["prefix"]
+	if prefix == "" {
+		return func(s string) string { return s }
+	}
+	names := make(map[string]string, 2)
+	for _, name := range []string{"begin", "end"} {
+		names[name] = prefixName(prefix, name)
+	}
+	return func(src string) string {
+		return renameIdents(src, names)
+	}
+}
+
+// renameIdents replaces identifiers in src, that are not
+// the selector of a qualified identifier, using the names map.
+func renameIdents(src string, names map[string]string) string {
+	var (
+		s    scanner.Scanner
+		b    bytes.Buffer
+		last int
+		prev gotoken.Token
+	)
+	fset := gotoken.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+	s.Init(file, []byte(src), func(gotoken.Position, string) {}, 0)
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == gotoken.EOF {
+			break
+		}
+		if tok == gotoken.IDENT && prev != gotoken.PERIOD {
+			if repl, ok := names[lit]; ok {
+				off := file.Offset(pos)
+				b.WriteString(src[last:off])
+				b.WriteString(repl)
+				last = off + len(lit)
+			}
+		}
+		prev = tok
+	}
+	b.WriteString(src[last:])
+	return b.String()
+}
+
+// renameTemplate applies rename to the text
+// of a template, leaving its actions untouched.
+func renameTemplate(text string, rename func(string) string) string {
+	var b bytes.Buffer
+	for {
+		i := strings.Index(text, "{{")
+		if i == -1 {
+			break
+		}
+		j := strings.Index(text[i:], "}}")
+		if j == -1 {
+			break
+		}
+		j += i + 2
+		b.WriteString(rename(text[:i]))
+		b.WriteString(text[i:j])
+		text = text[j:]
+	}
+	b.WriteString(rename(text))
+	return b.String()
+}
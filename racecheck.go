@@ -0,0 +1,92 @@
+package peg
+
+import (
+	"io"
+	"strings"
+	"text/template"
+)
+
+/*
+WriteRaceCheck writes a test to w, for the package of the generated
+parser, that parses inputs in several goroutines at once, each using
+its own parser. Generated parsers keep all of their state in the parser
+value, and in closures created by Init; the only package-level
+variables are tables, and error values, that are never modified.
+So distinct parsers may run concurrently, unless actions, predicates,
+or the user state share data, which the race detector will find, if the test is run
+using "go test -race". The inputs are read from the files in
+directory testdata/racecheck; the empty input is parsed too.
+Each parser must produce the same result as when parsing the
+input alone.
+*/
+func (t *Tree) WriteRaceCheck(w io.Writer) error {
+	tmpl := template.Must(template.New("racecheck").Parse(raceCheckTemplate))
+	return tmpl.Execute(w, map[string]string{
+		"Package": t.PackageName(),
+		"Peg":     t.defines["Peg"],
+		"Test":    "Test" + strings.Title(t.defines["Peg"]) + "Race",
+	})
+}
+
+var raceCheckTemplate = `// Code generated by the -racecheck option of peg or leg; DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// {{.Test}} parses the empty input, and the files in testdata/racecheck,
+// in parallel, using a separate {{.Peg}} for each goroutine.
+// Run it using "go test -race".
+func {{.Test}}(t *testing.T) {
+	const goroutines, rounds = 8, 4
+
+	names := []string{"empty input"}
+	inputs := []string{""}
+	files, err := filepath.Glob(filepath.Join("testdata", "racecheck", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, file)
+		inputs = append(inputs, string(b))
+	}
+	parse := func(input string) string {
+		p := &{{.Peg}}{Buffer: input}
+		p.Init()
+		if err := p.Parse(); err != nil {
+			return err.Error()
+		}
+		return "ok"
+	}
+	want := make([]string, len(inputs))
+	for i, input := range inputs {
+		want[i] = parse(input)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				for j := range inputs {
+					i := (g + j) % len(inputs) // vary the order between goroutines
+					if got := parse(inputs[i]); got != want[i] {
+						t.Errorf("%s: result %q in goroutine %d differs from %q", names[i], got, g, want[i])
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+`
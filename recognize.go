@@ -0,0 +1,116 @@
+package peg
+
+import (
+	"fmt"
+)
+
+/*
+stripActions turns the grammar into that of a recognizer, as
+generated with %recognize: actions, including immediate and error
+actions, commits, captures < >, and the variables of semantic values
+are removed, so that the parser needs neither a queue of thunks,
+nor a stack of values. Predicates, and changes of the user state,
+are kept, as they take part in matching.
+
+If captures is set, as with %captures, commits and captures are kept,
+and the end of each capture is followed by a generated action, which
+appends the text matched to the Captures of the parser.
+
+As there are no values, predicates referring to variables are
+reported as errors.
+*/
+func (t *Tree) stripActions(captures bool) {
+	// strip returns the node replacing node, or nil, if it is removed;
+	// where an expression is required, the empty string replaces it
+	var strip func(node Node) Node
+	var current *rule
+	var vars map[string]bool // of the current rule, reported once
+	failed := false
+	orEmpty := func(node Node) Node {
+		if node == nil {
+			return &token{Type: TypeString}
+		}
+		return node
+	}
+	strip = func(node Node) Node {
+		switch node.GetType() {
+		case TypeCommit, TypeBegin:
+			if !captures {
+				return nil
+			}
+		case TypeEnd:
+			if !captures {
+				return nil
+			}
+			a := &action{text: t.captureCode(current), id: len(t.Actions), rule: current}
+			a.source = a.text
+			t.Actions = append(t.Actions, a)
+			current.hasActions = true
+			l := &nodeList{Type: TypeSequence}
+			l.PushBack(node)
+			l.PushBack(a)
+			return l
+		case TypeAction:
+			return nil
+		case TypePredicate:
+			for _, name := range identifiers(node.String()) {
+				if vars[name] {
+					t.compileErrorf("%srule '%v': predicate &{%s} refers to variable '%s', which is dropped, as there are no semantic values", t.rulePos(current), current, node, name)
+					vars[name] = false
+					failed = true
+				}
+			}
+		case TypeName:
+			node.(*name).varp = nil
+		case TypeError:
+			return strip(node.(List).Front().Value.(Node))
+		case TypeSequence:
+			l := node.(*nodeList)
+			for el := l.Front(); el != nil; {
+				next := el.Next()
+				if n := strip(el.Value.(Node)); n == nil {
+					l.Remove(el)
+				} else {
+					el.Value = n
+				}
+				el = next
+			}
+			if l.Len() == 0 {
+				return nil
+			}
+		case TypeAlternate, TypeUnorderedAlternate, TypePeekFor, TypePeekNot, TypeQuery, TypeStar, TypePlus:
+			for el := node.(List).Front(); el != nil; el = el.Next() {
+				el.Value = orEmpty(strip(el.Value.(Node)))
+			}
+		}
+		return node
+	}
+	t.Actions = nil
+	for el := t.Front(); el != nil; el = el.Next() {
+		r, ok := el.Value.(*rule)
+		if !ok || r.expression == nil || r.expression == nilNode {
+			continue
+		}
+		current = r
+		vars = make(map[string]bool, len(r.variables))
+		for _, v := range r.variables {
+			vars[v.name] = true
+		}
+		r.variables = nil
+		r.hasActions = false
+		r.expression = orEmpty(strip(r.expression))
+	}
+	if failed {
+		t.fail("predicates refer to variables")
+	}
+}
+
+// captureCode returns the code of the action recording
+// a capture of rule r, as generated with %captures.
+func (t *Tree) captureCode(r *rule) string {
+	ruleId := "rule" + r.GoString()
+	if prefix := t.defines["prefix"]; prefix != "" {
+		ruleId = prefixName(prefix, "rule") + r.GoString()
+	}
+	return fmt.Sprintf("p.Captures = append(p.Captures, %s{Rule: %s, Text: yytext, Begin: begin, End: begin + len(yytext)})", t.ident("capture"), ruleId)
+}
@@ -0,0 +1,83 @@
+package peg
+
+import (
+	"container/list"
+)
+
+// A reduction is an elementary simplification of a grammar: the
+// removal of a rule, or of an element of an alternation or sequence.
+type reduction struct {
+	rule *list.Element // of the tree, if the rule is removed
+	list *nodeList
+	el   *list.Element
+}
+
+// reductions enumerates the simplifications of the grammar, in
+// the order of the rules, and of the nodes within their expressions.
+// The first rule, and the start rule, are not removed.
+func (t *Tree) reductions() (rs []reduction) {
+	for el := t.Front(); el != nil; el = el.Next() {
+		r, ok := el.Value.(*rule)
+		if !ok || r.expression == nil {
+			continue
+		}
+		if r.name != t.FirstRule() && r.name != t.StartRule() {
+			rs = append(rs, reduction{rule: el})
+		}
+		Inspect(r.expression, func(node Node) bool {
+			if node == nil {
+				return true
+			}
+			switch node.GetType() {
+			case TypeAlternate, TypeSequence:
+				if l := node.(*nodeList); l.Len() > 1 {
+					for el := l.Front(); el != nil; el = el.Next() {
+						rs = append(rs, reduction{list: l, el: el})
+					}
+				}
+			}
+			return true
+		})
+	}
+	return
+}
+
+/*
+Reductions returns the number of elementary simplifications that
+can be made to the grammar, like removing an alternative, an element
+of a sequence, or a rule other than the first rule and the start
+rule. Together with Reduce, it allows tools to minimize a grammar,
+e.g. to isolate a bug of the generator.
+*/
+func (t *Tree) Reductions() int {
+	return len(t.reductions())
+}
+
+/*
+Reduce applies the simplifications numbered from to to-1, as
+enumerated by Reductions, to the tree, which must not have
+been compiled yet. An alternation or sequence keeps one of its
+elements, if all of them were to be removed, so that the result,
+written by WriteGrammar, is still a valid grammar, but it may
+refer to rules that have been removed. The remaining rules are
+renumbered, see Rules.
+*/
+func (t *Tree) Reduce(from, to int) {
+	rs := t.reductions()
+	if to > len(rs) {
+		to = len(rs)
+	}
+	for _, r := range rs[from:to] {
+		switch {
+		case r.rule != nil:
+			name := r.rule.Value.(*rule).name
+			delete(t.rules, name)
+			delete(t.private, name)
+			delete(t.tokens, name)
+			t.Remove(r.rule)
+		case r.list.Len() > 1:
+			r.list.Remove(r.el)
+		}
+	}
+	t.renumberRules()
+}
@@ -0,0 +1,144 @@
+package peg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+A Report holds the diagnostics of compiling a grammar, which Compile
+returns instead of writing them to the standard error output, so that
+programs embedding the generator can inspect them, or render them
+using WriteText, or WriteJSON. Errors ending the compilation, like
+left recursive rules, are returned by Compile separately.
+*/
+type Report struct {
+	// Warnings, like about rules defined but not used, in the order
+	// they have been found, without a trailing newline.
+	Warnings []string
+
+	// Optimization decisions worth a note, like the rules inlined,
+	// which are reported, if %inlinereport is defined.
+	Decisions []string
+
+	// Statistics of the generated code, like "Match.Char", the
+	// number of characters matched directly, or "hoisted", the
+	// number of actions removed by optimization flag h.
+	Stats map[string]int
+
+	// The time the compilation took.
+	Duration time.Duration
+
+	errors []string // recorded by compileErrorf
+}
+
+// warnf adds a warning to the report of the compilation in progress,
+// or writes it to the standard error output, if the tree is not
+// being compiled.
+func (t *Tree) warnf(format string, a ...interface{}) {
+	msg := strings.TrimSuffix(fmt.Sprintf(format, a...), "\n")
+	if t.report == nil {
+		fmt.Fprintln(os.Stderr, msg)
+		return
+	}
+	t.reportMu.Lock()
+	t.report.Warnings = append(t.report.Warnings, msg)
+	t.reportMu.Unlock()
+}
+
+// A compileError aborts the compilation, carrying its final message
+// up to CompileParts.
+type compileError struct{ msg string }
+
+// compileErrorf records an error of the compilation in progress,
+// which goes on, so that further errors are found, until fail
+// aborts it.
+func (t *Tree) compileErrorf(format string, a ...interface{}) {
+	t.reportMu.Lock()
+	t.report.errors = append(t.report.errors, strings.TrimSuffix(fmt.Sprintf(format, a...), "\n"))
+	t.reportMu.Unlock()
+}
+
+// fail aborts the compilation. CompileParts returns an error
+// consisting of the errors recorded by compileErrorf, one per line,
+// followed by the message.
+func (t *Tree) fail(format string, a ...interface{}) {
+	panic(compileError{fmt.Sprintf(format, a...)})
+}
+
+// err returns the error of a compilation aborted by fail.
+func (r *Report) err(e compileError) error {
+	return errors.New(strings.Join(append(r.errors, e.msg), "\n"))
+}
+
+// values returns the statistics as a map, as stored in a Report.
+func (s *statValues) values() map[string]int {
+	return map[string]int{
+		"Peek.Char":         s.Peek.Char,
+		"Peek.Class":        s.Peek.Class,
+		"Peek.Dot":          s.Peek.Dot,
+		"Peek.String":       s.Peek.String,
+		"Peek.Bytes":        s.Peek.Bytes,
+		"Match.Char":        s.Match.Char,
+		"Match.Class":       s.Match.Class,
+		"Match.Dot":         s.Match.Dot,
+		"Match.String":      s.Match.String,
+		"Match.Bytes":       s.Match.Bytes,
+		"elimRestore.pos":   s.elimRestore.pos,
+		"elimRestore.thunk": s.elimRestore.thunkPos,
+		"optFirst.char":     s.optFirst.char,
+		"optFirst.dot":      s.optFirst.dot,
+		"optFirst.str":      s.optFirst.str,
+		"optFirst.class":    s.optFirst.class,
+		"seqIfNot":          s.seqIfNot,
+		"inlineLeafs":       s.inlineLeafs,
+		"WordBoundary":      s.WordBoundary,
+		"Indent.Push":       s.Indent.Push,
+		"Indent.Pop":        s.Indent.Pop,
+		"Indent.Same":       s.Indent.Same,
+		"hoisted":           s.hoisted,
+		"dispatchTables":    s.dispatchTables,
+		"keywordTables":     s.keywordTables,
+	}
+}
+
+// WriteText writes the warnings, and decisions, of the report to w,
+// one per line. If verbose is set, the statistics, and the duration,
+// follow.
+func (r *Report) WriteText(w io.Writer, verbose bool) error {
+	var b strings.Builder
+	for _, s := range r.Warnings {
+		b.WriteString(s + "\n")
+	}
+	for _, s := range r.Decisions {
+		b.WriteString(s + "\n")
+	}
+	if verbose {
+		var keys []string
+		for k := range r.Stats {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteString("stats:")
+		for _, k := range keys {
+			fmt.Fprintf(&b, " %s=%d", k, r.Stats[k])
+		}
+		fmt.Fprintf(&b, "\ncompiled in %v\n", r.Duration)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteJSON writes the report to w as a JSON object, with the
+// duration in nanoseconds.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(r)
+}
@@ -0,0 +1,163 @@
+package peg
+
+import (
+	"fmt"
+	"go/parser"
+	gotoken "go/token"
+	"io"
+	"strconv"
+)
+
+/*
+If the generated parser is split into several files, rule functions
+are not contained in Init anymore, where they could access the
+parser's state directly. Instead, Init creates a value of type
+yyRuleState, holding pointers to the position variables and the
+helper functions, and passes it to one method per part that sets
+up that part's entries of the rules table.
+*/
+type stateField struct {
+	name, typ string
+	pointer   bool
+}
+
+// stateFields returns the fields of yyRuleState. Unless thunks is set,
+// the variables and functions queuing actions are omitted, as they are
+// not generated for grammars without actions, nor spans; do is only
+// generated for grammars with actions. Unless readsVariables is set,
+// yyvalue, reading the values of variables while parsing, is omitted.
+func (t *Tree) stateFields(bits int, thunks, hasCommit, hasErrorActions, hasVariables, readsVariables bool) (f []stateField) {
+	f = append(f, stateField{"position", "*int", true})
+	if thunks {
+		for _, name := range []string{"thunkPosition", "begin", "end"} {
+			f = append(f, stateField{name, "*int", true})
+		}
+	}
+	if stats.Indent.Push+stats.Indent.Pop+stats.Indent.Same != 0 {
+		f = append(f, stateField{"indentTop", "*int", true})
+	}
+	if stats.Indent.Push != 0 {
+		f = append(f, stateField{"pushIndent", "func() bool", false})
+	}
+	if stats.Indent.Pop != 0 {
+		f = append(f, stateField{"popIndent", "func() bool", false})
+	}
+	if stats.Indent.Same != 0 {
+		f = append(f, stateField{"sameIndent", "func() bool", false})
+	}
+	if thunks && t.Actions != nil {
+		f = append(f, stateField{"do", fmt.Sprintf("func(uint%d)", bits), false})
+	}
+	if thunks {
+		f = append(f, stateField{"doarg", fmt.Sprintf("func(uint%d, int)", bits), false})
+	}
+	if hasCommit {
+		f = append(f, stateField{"commit", "func(int) bool", false})
+	}
+	if hasErrorActions {
+		f = append(f, stateField{"doerr", fmt.Sprintf("func(uint%d)", bits), false})
+	}
+	if t.defines["spans"] != "" {
+		f = append(f, stateField{"dospan", "func(int, int, int)", false})
+	}
+	if hasVariables && t.defines["yyspan"] != "" {
+		f = append(f, stateField{"dopos", "func(int, int)", false})
+	}
+	if readsVariables {
+		f = append(f, stateField{"yyvalue", "func(int) " + t.defines["yystype"], false})
+	}
+	if stats.Match.Dot != 0 {
+		f = append(f, stateField{"matchDot", "func() bool", false})
+	}
+	if stats.Match.Char != 0 {
+		f = append(f, stateField{"matchChar", "func(byte) bool", false})
+	}
+	if stats.Peek.Char != 0 {
+		f = append(f, stateField{"peekChar", "func(byte) bool", false})
+	}
+	if stats.Match.String != 0 {
+		f = append(f, stateField{"matchString", "func(string) bool", false})
+	}
+	if stats.Match.Bytes != 0 {
+		f = append(f, stateField{"matchBytes", "func(int) bool", false})
+	}
+	if stats.WordBoundary != 0 {
+		f = append(f, stateField{"atWordBoundary", "func() bool", false})
+	}
+	if len(t.Classes) != 0 {
+		f = append(f, stateField{"matchClass", "func(uint) bool", false})
+		if stats.Peek.Class != 0 {
+			f = append(f, stateField{"peekClass", "func(uint) bool", false})
+		}
+	}
+	return
+}
+
+func printStateType(w io.Writer, fields []stateField, rename func(string) string) {
+	fmt.Fprint(w, rename("\ntype yyRuleState struct {\n"))
+	for _, f := range fields {
+		fmt.Fprintf(w, "\t%s %s\n", rename(f.name), f.typ)
+	}
+	fmt.Fprintf(w, "}\n")
+}
+
+func printStateValue(w io.Writer, fields []stateField, rename func(string) string) {
+	fmt.Fprint(w, rename("\n\ts := &yyRuleState{"))
+	for i, f := range fields {
+		if i > 0 {
+			fmt.Fprintf(w, ", ")
+		}
+		if f.pointer {
+			fmt.Fprintf(w, "&")
+		}
+		fmt.Fprintf(w, "%s", rename(f.name))
+	}
+	fmt.Fprintf(w, "}")
+}
+
+/*
+qualify rewrites references to the parser's state within the code
+of a rule function, so that the resulting code only depends on
+a variable s of type *yyRuleState. Constants are replaced
+by their values, as found in the consts map.
+*/
+func qualify(src []byte, fields []stateField, consts map[string]int, rename func(string) string) []byte {
+	names := make(map[string]string, len(fields))
+	for _, f := range fields {
+		name := rename(f.name)
+		if f.pointer {
+			names[name] = "(*s." + name + ")"
+		} else {
+			names[name] = "s." + name
+		}
+	}
+	for name, value := range consts {
+		names[rename(name)] = strconv.Itoa(value)
+	}
+	return []byte(renameIdents(string(src), names))
+}
+
+/*
+PackageName returns the name of the package the parser is
+generated for, either as defined in a peg grammar, or using
+Define, or as found within the package clause of a leg grammar's
+header. It returns "", if the package is unknown.
+*/
+func (t *Tree) PackageName() string {
+	if name := t.defines["package"]; name != "" {
+		return name
+	}
+	for _, h := range t.Headers {
+		f, err := parser.ParseFile(gotoken.NewFileSet(), "", h, parser.PackageClauseOnly)
+		if err == nil {
+			return f.Name.Name
+		}
+	}
+	return ""
+}
+
+// printPartHeader writes the package clause of a part of a split
+// parser; imports are added later by fixImports.
+func (t *Tree) printPartHeader(w io.Writer) {
+	fmt.Fprintf(w, "package %s\n", t.PackageName())
+}
@@ -0,0 +1,26 @@
+package peg
+
+import (
+	"embed"
+	"strings"
+)
+
+// StdPrefix starts the names of the grammar files of the standard
+// library, like "std/json.leg", which are part of the package, and
+// may be imported by leg grammars, e.g. as `%import json "std/json.leg"`.
+// The library consists of the leg grammars in directory stdlib.
+const StdPrefix = "std/"
+
+//go:embed stdlib/*.leg
+var stdlib embed.FS
+
+// IsStdFile reports whether name refers to a file of the standard library.
+func IsStdFile(name string) bool {
+	return strings.HasPrefix(name, StdPrefix)
+}
+
+// ReadStdFile returns the contents of a file of the standard library,
+// given by its name, like "std/json.leg".
+func ReadStdFile(name string) ([]byte, error) {
+	return stdlib.ReadFile("stdlib/" + strings.TrimPrefix(name, StdPrefix))
+}
@@ -7,7 +7,6 @@ import (
 )
 
 var parserTemplate = strings.Replace(`\
-{{range .Headers}}{{.}}{{end}}\
 {{with def "package"}}\
 package {{.}}
 
@@ -15,27 +14,692 @@ import (
 	"fmt"
 	"github.com/knieriem/peg"
 )
-{{end}}
+{{end}}\
+{{range .Headers}}{{.}}{{end}}
+// ids of the rules, as accepted by Parse
 const (\
 {{range sortedRules}}
+	// {{ruleText .}}
 	rule{{.GoString}}{{if not .GetId}} = iota{{end}}{{end}}
 )
 
+{{if .Actions}}
+// ids of the actions, in the order of their appearance in the grammar
+const (\
+{{range .Actions}}
+	{{actionName .}}{{if not .GetId}} = iota{{end}}{{end}}
+)
+{{end}}
+// {{id "s"}}tartRule is the rule applied by Parse by default.
+const {{id "s"}}tartRule = rule{{startRule}}
+
+var ruleNames = [...]string{{"{"}}\
+{{range sortedRules}}
+	rule{{.GoString}}: {{printf "%q" .String}},{{end}}
+}
+
+// {{id "r"}}uleName returns the name of the rule with the given id,
+// as it is written in the grammar.
+func {{id "r"}}uleName(id int) string {
+	if id >= 0 && id < len(ruleNames) {
+		return ruleNames[id]
+	}
+	return fmt.Sprintf("rule#%d", id)
+}
+
+// A {{def "Peg"}} parses the text in Buffer according to the grammar.
+// Init must be called before the first call of Parse. Distinct
+// parsers share no mutable state, so they may be used concurrently,
+// unless actions, or the user state, share data.
 type {{def "Peg"}} struct {
 	{{def "userstate"}}
 	Buffer string
+
+	// Min is the offset reached by the last commit, and Max the
+	// furthest offset at which an item has been expected, which
+	// locates the error, if Parse fails.
 	Min, Max int
 	rules [{{numRules}}]func() bool
+
+	// ResetBuffer, set by Init, replaces the buffer by a new text
+	// and resets the parser, so that Parse may be called again, without
+	// the cost of Init. It returns the part of the old buffer that
+	// has not been parsed yet.
 	ResetBuffer	func(string) string
+	seek	func(pos int)
+{{if def "recognize"}}\
+	offset	func() int
+{{end}}\
+{{if finalCommit}}\
+	finish	func() // commits after Parse has matched
+{{end}}\
+{{if nvar}}\
+	value	func() {{def "yystype"}}
+{{end}}\
+
+	// ErrorVerbosity selects the output of FprintError, which is
+	// {{id "e"}}rrorNormal by default. If ErrorColor is true, ANSI escape
+	// sequences are used to highlight the message and the position.
+	ErrorVerbosity	int
+	ErrorColor	bool
+	expected	[]yyExpected
+
+	ruleStack, failStack	[]int
+
+	// If Normalize is not nil, Init and ResetBuffer pass the input
+	// through it, and parse the returned text. The table, if not nil,
+	// maps each byte offset of the text to the corresponding offset
+	// within the original input, which is then used for error positions.
+	Normalize	func(s string) (text string, posMap []int)
+	original	string
+	posMap	[]int
+{{if def "parsefile"}}\
+	releaseFile	func() error
+{{end}}\
+{{if tokenRules}}\
+	matchToken	func(rule, pos int) (int, bool)
+{{end}}\
+{{if def "memo"}}\
+
+	// MemoLimit, if greater than zero, is the maximum number of
+	// rule results kept for memoization; the least recently used
+	// ones are dropped first.
+	MemoLimit	int
+{{end}}\
+{{if def "state"}}\
+	states	[]yyStateEntry
+	stateTop	int
+{{end}}\
+{{if def "undo"}}\
+	undo	[]func()
+{{end}}\
+{{if def "spans"}}\
+
+	// Spans lists the text matched by captures < >, and, if the
+	// parser has been generated with "spans" set to "rules", by
+	// rules, or, if set to "tokens", by the rules marked with @token,
+	// in the order in which they have been completed. Like actions,
+	// spans are recorded when a commit is reached, and when Parse
+	// has matched.
+	Spans	[]{{id "s"}}pan
+{{end}}\
+{{if def "captures"}}\
+
+	// Captures lists the text matched by captures < >, in the order
+	// in which they have been completed, if the parser has been
+	// generated with %captures. Like actions, they are recorded
+	// when a commit is reached, and when Parse has matched.
+	Captures	[]{{id "c"}}apture
+{{end}}\
+	metrics	{{id "m"}}etrics
+{{if def "metrics"}}\
+
+	// If MetricsSink is not nil, Parse reports to it how often each
+	// rule has been applied, and how long parsing has taken.
+	MetricsSink	{{id "m"}}etricsSink
+	ruleCalls, ruleFails	[{{numRules}}]int
+
+	// If Profile is true, Parse measures the time spent in each chain
+	// of rule applications, as written by WriteFolded.
+	Profile	bool
+	profile	yyProfile
+{{end}}\
+{{if tracing}}\
+
+	// If Tracer is not nil, calls of Parse, and applications of
+	// the rules marked with @trace, are reported to it.
+	Tracer	{{id "t"}}racer
+{{end}}\
+{{with def "maxdepth"}}\
+
+	// MaxDepth is the maximum number of nested rules, above which
+	// Parse fails with {{id "e"}}rrTooDeep; Init sets it to {{.}}, if zero.
+	MaxDepth	int
+	depth	int
+{{end}}\
+{{if def "ambiguity"}}\
+	probing	int
+	overlaps	map[[3]int]int // by choice, and branches, see Ambiguities
+{{end}}\
+}
+{{if def "maxdepth"}}
+// {{id "e"}}rrTooDeep is returned by Parse, if the input is nested too
+// deeply, i.e. if more than MaxDepth rules would have been nested.
+var {{id "e"}}rrTooDeep = errors.New("input nested too deeply")
+{{end}}\
+
+// {{id "m"}}etrics are counters of the memory used by a parser, as
+// returned by its Metrics method. Peaks are counted since Init, or
+// the last call of ResetBuffer; counters that do not apply to the
+// grammar, like those of memoization without %memo, remain zero.
+type {{id "m"}}etrics struct {
+	Thunks, ThunksCap	int // peak length, and capacity, of the queue of actions
+	Values, ValuesCap	int // peak height, and capacity, of the stack of semantic values
+	MemoEntries, MemoPeak	int // current, and peak number of memoized results
+}
+
+{{if tracing}}\
+// A {{id "t"}}racer receives the beginning and the end of each call of
+// Parse, and of each application of a rule marked with @trace, if
+// assigned to the Tracer field of a parser, e.g. to create the spans
+// of a tracing system. Calls are properly nested: each EndRule ends
+// the rule begun last, and within Parse only.
+type {{id "t"}}racer interface {
+	BeginParse(rule string)
+	EndParse(rule string, err error)
+
+	// BeginRule and EndRule receive the offset of the input the rule
+	// is applied at, and the offset after the match, or, if it has
+	// failed, after backtracking.
+	BeginRule(rule string, pos int)
+	EndRule(rule string, pos int, ok bool)
+}
+
+{{end}}\
+{{if def "metrics"}}\
+// A {{id "m"}}etricsSink receives the counters of each call of Parse,
+// if assigned to the MetricsSink field of a parser, e.g. to publish
+// them using expvar, or Prometheus. Rules that have been inlined are
+// not counted.
+type {{id "m"}}etricsSink interface {
+	// RuleCalls reports how often a rule has been applied,
+	// and how often it has failed; it is called for each
+	// rule applied at least once.
+	RuleCalls(rule string, calls, fails int)
+
+	// Parsed reports the rule Parse has been called with, the time
+	// it has taken, and the error, if it has failed.
+	Parsed(rule string, d time.Duration, err error)
+}
+
+// reportMetrics passes the counters of the last parse to the sink.
+func (p *{{def "Peg"}}) reportMetrics(id int, d time.Duration, err error) {
+	for i, n := range p.ruleCalls {
+		if n != 0 {
+			p.MetricsSink.RuleCalls({{id "r"}}uleName(i), n, p.ruleFails[i])
+		}
+	}
+	p.MetricsSink.Parsed({{id "r"}}uleName(id), d, err)
+}
+
+// yyProfile holds the time measured for the chains of rule
+// applications, each of which is a frame.
+type yyProfile struct {
+	frames []yyFrame
+	ids    map[[2]int]int // of the frames, by the caller's frame, and rule
+	stack  []int          // frames of the rules being applied
+}
+
+// A yyFrame is a chain of rule applications ending with rule, which
+// has been applied by the chain of the parent frame, or by Parse.
+type yyFrame struct {
+	parent, ruleId int
+	self         time.Duration // spent in rule, without the rules it has applied
+	start        time.Time     // of the current application
+	nested       time.Duration // spent in the rules applied by it
+}
+
+func (f *yyProfile) enter(rule int) {
+	parent := -1
+	if n := len(f.stack); n != 0 {
+		parent = f.stack[n-1]
+	}
+	key := [2]int{parent, rule}
+	id, ok := f.ids[key]
+	if !ok {
+		if f.ids == nil {
+			f.ids = make(map[[2]int]int)
+		}
+		id = len(f.frames)
+		f.ids[key] = id
+		f.frames = append(f.frames, yyFrame{parent: parent, ruleId: rule})
+	}
+	f.frames[id].start, f.frames[id].nested = time.Now(), 0
+	f.stack = append(f.stack, id)
+}
+
+func (f *yyProfile) leave() {
+	n := len(f.stack) - 1
+	fr := &f.frames[f.stack[n]]
+	f.stack = f.stack[:n]
+	d := time.Since(fr.start)
+	fr.self += d - fr.nested
+	if n != 0 {
+		f.frames[f.stack[n-1]].nested += d
+	}
+}
+
+/*
+WriteFolded writes the time profiled since Init to w, in the folded
+stack format read by flame graph tools, like flamegraph.pl, or
+speedscope: a line for each chain of rule applications, the names
+of the rules separated by ';', followed by the time, in nanoseconds,
+spent in the last rule itself, including the time of applications
+that have failed, so that backtracking shows up.
+*/
+func (p *{{def "Peg"}}) WriteFolded(w io.Writer) error {
+	var lines []string
+	for _, f := range p.profile.frames {
+		if f.self <= 0 {
+			continue
+		}
+		chain := {{id "r"}}uleName(f.ruleId)
+		for i := f.parent; i >= 0; i = p.profile.frames[i].parent {
+			chain = {{id "r"}}uleName(p.profile.frames[i].ruleId) + ";" + chain
+		}
+		lines = append(lines, fmt.Sprintf("%s %d\n", chain, f.self.Nanoseconds()))
+	}
+	sort.Strings(lines)
+	for _, l := range lines {
+		if _, err := io.WriteString(w, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+{{end}}\
+{{if def "ambiguity"}}\
+// yyChoices are the ordered choices probed for ambiguities: the name
+// of the rule containing each, and the texts of its branches.
+var yyChoices = [...]struct {
+	name     string
+	branches []string
+}{{"{"}}{{range choices}}
+	{{"{"}}{{printf "%q" .Rule}}, []string{{"{"}}{{range $i, $b := .Branches}}{{if $i}}, {{end}}{{printf "%q" $b}}{{end}}}},{{end}}
+}
+
+// An {{id "a"}}mbiguity tells how often a branch of an ordered choice
+// has matched, while a later branch, which has only been probed, would
+// have matched at the same position too, i.e. has been shadowed.
+type {{id "a"}}mbiguity struct {
+	Rule                      string // containing the choice
+	Choice                    int    // index of the choice, among those probed
+	Matched, Shadowed         int    // indices of the branches
+	MatchedText, ShadowedText string
+	Count                     int
+}
+
+func (a {{id "a"}}mbiguity) String() string {
+	return fmt.Sprintf("%s: %s shadows %s (%d times)", a.Rule, a.MatchedText, a.ShadowedText, a.Count)
+}
+
+// Ambiguities returns the ambiguities found since Init, the most
+// frequent ones first, e.g. to report the top offenders after a
+// corpus of inputs has been parsed, using ResetBuffer between them.
+func (p *{{def "Peg"}}) Ambiguities() (list []{{id "a"}}mbiguity) {
+	for k, n := range p.overlaps {
+		c := yyChoices[k[0]]
+		list = append(list, {{id "a"}}mbiguity{
+			Rule:         c.name,
+			Choice:       k[0],
+			Matched:      k[1],
+			Shadowed:     k[2],
+			MatchedText:  c.branches[k[1]],
+			ShadowedText: c.branches[k[2]],
+			Count:        n,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		switch {
+		case a.Count != b.Count:
+			return a.Count > b.Count
+		case a.Choice != b.Choice:
+			return a.Choice < b.Choice
+		case a.Matched != b.Matched:
+			return a.Matched < b.Matched
+		}
+		return a.Shadowed < b.Shadowed
+	})
+	return
+}
+
+{{end}}\
+// Metrics returns the counters of the memory used by the parser,
+// e.g. for capacity planning, or for finding leaks in long-running
+// services.
+func (p *{{def "Peg"}}) Metrics() {{id "m"}}etrics {
+	return p.metrics
+}
+{{if def "spans"}}
+// A {{id "s"}}pan describes the text p.Buffer[Begin:End] matched by a rule
+// or by a capture within a rule.
+type {{id "s"}}pan struct {
+	Rule       int
+	Begin, End int
+}
+{{end}}\
+{{if def "captures"}}
+// A {{id "c"}}apture is the text p.Buffer[Begin:End] matched by a
+// capture < > within a rule.
+type {{id "c"}}apture struct {
+	Rule       int
+	Text       string
+	Begin, End int
 }
 
-func (p *{{def "Peg"}}) Parse(ruleId int) (err error) {
-	if p.rules[ruleId]() {
+func (c {{id "c"}}apture) String() string {
+	return fmt.Sprintf("%s %d-%d %q", ruleNames[c.Rule], c.Begin, c.End, c.Text)
+}
+{{end}}\
+{{with def "state"}}
+// A yyStateEntry is an element of the tree of user states,
+// which is shared by all alternatives tried by the parser.
+type yyStateEntry struct {
+	value  {{.}}
+	parent int
+}
+
+// State returns the current user state, which is changed by the
+// %push and %pop expressions of the grammar, and restored on
+// backtracking. It may be accessed from actions and semantic
+// predicates, like in &{ p.State().depth < 10 }.
+func (p *{{def "Peg"}}) State() {{.}} {
+	return p.states[p.stateTop].value
+}
+
+// pushState makes v the current user state.
+func (p *{{def "Peg"}}) pushState(v {{.}}) bool {
+	p.states = append(p.states, yyStateEntry{v, p.stateTop})
+	p.stateTop = len(p.states) - 1
+	return true
+}
+
+// popState returns to the previous user state, if there is one.
+func (p *{{def "Peg"}}) popState() bool {
+	if p.stateTop == 0 {
+		return false
+	}
+	p.stateTop = p.states[p.stateTop].parent
+	return true
+}
+{{end}}\
+{{if def "undo"}}
+// OnBacktrack registers f to be called if the parser backtracks
+// to a position before the current one, dropping the alternative
+// it is currently trying. It allows semantic predicates to make
+// changes to the user state that are undone on backtracking, like in
+//	&{ p.addTypedef(name) && p.OnBacktrack(func() { delete(p.typedefs, name) }) }
+// OnBacktrack always returns true.
+func (p *{{def "Peg"}}) OnBacktrack(f func()) bool {
+	p.undo = append(p.undo, f)
+	return true
+}
+
+// backtrack calls the functions registered after the first n ones,
+// in reverse order, and removes them.
+func (p *{{def "Peg"}}) backtrack(n int) {
+	for i := len(p.undo) - 1; i >= n; i-- {
+		p.undo[i]()
+		p.undo[i] = nil
+	}
+	p.undo = p.undo[:n]
+}
+{{end}}\
+
+// Verbosity levels of FprintError
+const (
+	{{id "e"}}rrorNormal = iota // error message, and context lines
+	{{id "e"}}rrorTerse         // position of the error only
+	{{id "e"}}rrorVerbose       // additionally, a list of the items expected
+)
+
+// A yyExpected describes an item that has
+// been expected at the position of an error.
+type yyExpected struct {
+	kind  byte // one of '.', '\'', '"', '['
+	s     string
+	class uint
+}
+
+func (e yyExpected) String() string {
+	switch e.kind {
+	case '.':
+		return "any character"
+	case '[':
+{{if len .Classes}}		return classNames[e.class]
+{{else}}		return fmt.Sprintf("class #%d", e.class)
+{{end}}	case '"':
+		return fmt.Sprintf("%q", e.s)
+	}
+	return fmt.Sprintf("%q", e.s[0])
+}
+{{if len .Classes}}
+var classNames = [...]string{{"{"}}\
+{{range $text, $c := .Classes}}
+	{{$c.Index}}: {{printf "[%s]" $text | printf "%q"}},{{end}}
+}
+{{end}}
+// expect records an item that has been expected at position pos,
+// unless it has been recorded there already.
+func (p *{{def "Peg"}}) expect(pos int, e yyExpected) {
+{{if def "ambiguity"}}\
+	if p.probing != 0 {
+		return // failures of probed branches are not reported
+	}
+{{end}}\
+	if pos > p.Max {
+		p.Max = pos
+		p.expected = p.expected[:0]
+	}
+{{if def "rulestack"}}\
+	if len(p.expected) == 0 {
+		p.failStack = append(p.failStack[:0], p.ruleStack...)
+	}
+{{end}}\
+	for _, e1 := range p.expected {
+		if e1 == e {
+			return
+		}
+	}
+	p.expected = append(p.expected, e)
+}
+
+// Parse applies the rule ruleId to the buffer. If ruleId is
+// omitted, {{id "s"}}tartRule is applied.
+func (p *{{def "Peg"}}) Parse(ruleId ...int) (err error) {
+	id := {{id "s"}}tartRule
+	if len(ruleId) != 0 {
+		id = ruleId[0]
+	}
+{{with privateRules}}\
+	switch id {
+	case {{range $i, $r := .}}{{if $i}}, {{end}}rule{{$r.GoString}}{{end}}:
+		return fmt.Errorf("rule %s is private", {{id "r"}}uleName(id))
+	}
+{{end}}\
+{{if tracing}}\
+	if p.Tracer != nil {
+		p.Tracer.BeginParse({{id "r"}}uleName(id))
+		defer func() { p.Tracer.EndParse({{id "r"}}uleName(id), err) }()
+	}
+{{end}}\
+{{if def "metrics"}}\
+	if p.MetricsSink != nil {
+		p.ruleCalls, p.ruleFails = [{{numRules}}]int{}, [{{numRules}}]int{}
+		start := time.Now()
+		defer func() { p.reportMetrics(id, time.Since(start), err) }()
+	}
+	p.profile.stack = p.profile.stack[:0]
+{{end}}\
+{{if def "maxdepth"}}\
+	p.depth = 0
+{{if def "undo"}}\
+	undo := len(p.undo)
+{{end}}\
+	defer func() {
+		if e := recover(); e != nil {
+			if e != {{id "e"}}rrTooDeep {
+				panic(e)
+			}
+			// the rules have not been unwound
+			p.depth = 0
+{{if def "undo"}}\
+			p.backtrack(undo)
+{{end}}\
+			err = {{id "e"}}rrTooDeep
+		}
+	}()
+{{end}}\
+	if p.rules[id]() {
+{{if finalCommit}}\
+		p.finish()
+{{end}}\
 		return
 	}
 	return p.parseErr()
 }
 
+/*
+Resume continues parsing after an error at offset pos of the buffer,
+e.g. after a synchronizing token following Max, the offset of the
+error, applying rule ruleId like Parse. The results of the actions
+executed by commits are kept, while pending actions are dropped,
+so that a loop calling Resume after each error collects a list of
+diagnostics, together with the results of the parts of the input
+that could be parsed. The user state of %state, the indentation,
+and the memoized results are reset, as after Init; changes that
+functions registered with OnBacktrack would undo are kept.
+*/
+func (p *{{def "Peg"}}) Resume(pos int, ruleId ...int) error {
+	p.seek(pos)
+	return p.Parse(ruleId...)
+}
+{{if def "recognize"}}
+// Recognize applies rule ruleId like Parse, and reports whether it
+// has matched, and the number of bytes it has consumed.
+func (p *{{def "Peg"}}) Recognize(ruleId ...int) (n int, ok bool) {
+	from := p.offset()
+	if p.Parse(ruleId...) != nil {
+		return 0, false
+	}
+	return p.offset() - from, true
+}
+{{end}}\
+{{if nvar}}
+/*
+ParseValue applies rule ruleId like Parse, and returns the semantic
+value assigned to $$ by the last action executed, so that results
+need not be passed through fields of the parser. If the rule ends
+with a commit, this is the value of the rule.
+*/
+func (p *{{def "Peg"}}) ParseValue(ruleId ...int) (v {{def "yystype"}}, err error) {
+	if err = p.Parse(ruleId...); err == nil {
+		v = p.value()
+	}
+	return
+}
+{{	if def "generics"}}
+// {{id "p"}}arseAs is like p.ParseValue, but returns the value as a T,
+// failing, if it is not a T.
+func {{id "p"}}arseAs[T any](p *{{def "Peg"}}, ruleId ...int) (v T, err error) {
+	value, err := p.ParseValue(ruleId...)
+	if err != nil {
+		return
+	}
+	v, ok := any(value).(T)
+	if !ok {
+		err = fmt.Errorf("unexpected type %T of the semantic value", value)
+	}
+	return
+}
+{{	end}}\
+{{end}}\
+{{if tokenRules}}
+// Sync returns the first offset from pos on, at which one of the
+// given token rules matches, or the length of the buffer, if there is
+// none, e.g. to find the offset where Resume continues after an error.
+func (p *{{def "Peg"}}) Sync(pos int, rules ...int) int {
+	for ; pos < len(p.Buffer); pos++ {
+		for _, rule := range rules {
+			if _, ok := p.matchToken(rule, pos); ok {
+				return pos
+			}
+		}
+	}
+	return len(p.Buffer)
+}
+{{end}}\
+{{if def "parsefile"}}
+/*
+ParseFile parses the contents of the named file, starting with
+rule ruleId, or {{id "s"}}tartRule, if ruleId is omitted. The
+buffer refers to a memory mapping of the file, if possible. It
+stays valid, together with all strings derived from it, until
+ReleaseFile, or ParseFile again, is called.
+*/
+func (p *{{def "Peg"}}) ParseFile(path string, ruleId ...int) (err error) {
+	if err = p.ReleaseFile(); err != nil {
+		return
+	}
+	data, release, err := peg.MapFile(path)
+	if err != nil {
+		return
+	}
+	p.releaseFile = release
+	p.Buffer = data
+	p.Init()
+	return p.Parse(ruleId...)
+}
+
+// ReleaseFile releases the file that has been loaded by ParseFile.
+func (p *{{def "Peg"}}) ReleaseFile() (err error) {
+	if p.releaseFile != nil {
+		p.Buffer = ""
+		err = p.releaseFile()
+		p.releaseFile = nil
+	}
+	return
+}
+{{end}}\
+{{with tokenRules}}
+// A {{id "t"}}oken is an item of the input found by a {{id "s"}}canner.
+// Kind is the id of the token's rule, or -1, if no token rule matches
+// at Begin, in which case the token covers a single byte.
+type {{id "t"}}oken struct {
+	Kind       int
+	Begin, End int
+	Text       string
+}
+
+// A {{id "s"}}canner splits a text into the tokens described by the
+// rules marked with @token, without parsing it according to the
+// whole grammar, e.g. for highlighting. Actions are not executed.
+type {{id "s"}}canner struct {
+	p   {{def "Peg"}}
+	pos int
+}
+
+// {{id "n"}}ewScanner returns a scanner of the tokens of text.
+func {{id "n"}}ewScanner(text string) *{{id "s"}}canner {
+	s := new({{id "s"}}canner)
+	s.p.Buffer = text
+	s.p.Init()
+	return s
+}
+
+// Next returns the next token of the text; ok is false at its end.
+// At each position, the token rules are tried in the order of their
+// definition, and the first one matching a non-empty text is taken.
+func (s *{{id "s"}}canner) Next() (tok {{id "t"}}oken, ok bool) {
+	if s.pos >= len(s.p.Buffer) {
+		return
+	}
+	tok = {{id "t"}}oken{Kind: -1, Begin: s.pos, End: s.pos + 1}
+	for _, kind := range [...]int{ {{range $i, $r := .}}{{if $i}}, {{end}}rule{{$r.GoString}}{{end}} } {
+		if end, ok := s.p.matchToken(kind, s.pos); ok && end > s.pos {
+			tok.Kind, tok.End = kind, end
+			break
+		}
+	}
+	tok.Text = s.p.Buffer[tok.Begin:tok.End]
+	s.pos = tok.End
+	return tok, true
+}
+{{end}}
+// An {{id "e"}}rrPos is a position within the input; Line and Pos,
+// the byte offset within the line, count from 1.
 type {{id "e"}}rrPos struct {
 	Line, Pos int
 }
@@ -44,150 +708,645 @@ func	(e *{{id "e"}}rrPos) String() string {
 	return fmt.Sprintf("%d:%d", e.Line, e.Pos)
 }
 
+// The Rules fields of the error types contain the ids of the rules
+// that have been active at the error position, outermost first.
+// They are only recorded if the parser has been generated
+// with the "rulestack" option.
+
+// An {{id "u"}}nexpectedCharError is returned by Parse if the character
+// at position At does not match; After is the position reached by the
+// last commit.
 type {{id "u"}}nexpectedCharError struct {
 	After, At	{{id "e"}}rrPos
 	Char	byte
+	Rules	[]int
 }
 
 func (e *{{id "u"}}nexpectedCharError) Error() string {
-	return fmt.Sprintf("%v: unexpected character '%c'", &e.At, e.Char)
+	return fmt.Sprintf("%v: unexpected character '%c'", &e.At, e.Char) + ruleChain(e.Rules)
 }
 
+// An {{id "u"}}nexpectedEOFError is returned by Parse if the input ended
+// before the rule has been matched completely.
 type {{id "u"}}nexpectedEOFError struct {
 	After {{id "e"}}rrPos
+	Rules	[]int
 }
 
 func (e *{{id "u"}}nexpectedEOFError) Error() string {
-	return fmt.Sprintf("%v: unexpected end of file", &e.After)
+	return fmt.Sprintf("%v: unexpected end of file", &e.After) + ruleChain(e.Rules)
+}
+
+// ruleChain formats a list of rule ids like " in A > B > C".
+func ruleChain(ids []int) (s string) {
+	for i, id := range ids {
+		if i == 0 {
+			s = " in "
+		} else {
+			s += " > "
+		}
+		s += {{id "r"}}uleName(id)
+	}
+	return
+}
+
+// errBuffer returns the input as it has been passed to Init or
+// ResetBuffer, and the positions Min and Max translated into offsets
+// within it, according to the table returned by Normalize.
+func (p *{{def "Peg"}}) errBuffer() (buf string, min, max int) {
+	if p.posMap == nil {
+		return p.Buffer, p.Min, p.Max
+	}
+	orig := func(pos int) int {
+		if pos < len(p.posMap) {
+			return p.posMap[pos]
+		}
+		return len(p.original)
+	}
+	return p.original, orig(p.Min), orig(p.Max)
 }
 
 func (p *{{def "Peg"}}) parseErr() (err error) {
+	buf, min, max := p.errBuffer()
 	var pos, after {{id "e"}}rrPos
 	pos.Line = 1
-	for i, c := range p.Buffer[0:] {
+	for i, c := range buf[0:] {
+{{if def "bom"}}\
+		if i == 0 && c == '\uFEFF' {
+			continue
+		}
+{{end}}\
 		if c == '\n' {
 			pos.Line++
 			pos.Pos = 0
+{{if def "crlf"}}\
+		} else if c == '\r' && i+1 < len(buf) && buf[i+1] == '\n' {
+			// counted as part of the following newline
+{{end}}\
 		} else {
 			pos.Pos++
 		}
-		if i == p.Min {
-			if p.Min != p.Max {
+		if i == min {
+			if min != max {
 				after = pos
 			} else {
 				break
 			}
-		} else if i == p.Max {
+		} else if i == max {
 			break
 		}
 	}
-	if p.Max >= len(p.Buffer) {
-		err = &{{id "u"}}nexpectedEOFError{after}
+	var rules []int
+	if len(p.failStack) != 0 {
+		rules = append(rules, p.failStack...)
+	}
+	if max >= len(buf) {
+		err = &{{id "u"}}nexpectedEOFError{after, rules}
 	} else {
-		err = &{{id "u"}}nexpectedCharError{after, pos, p.Buffer[p.Max]}
+		err = &{{id "u"}}nexpectedCharError{after, pos, buf[max], rules}
 	}
 	return
 }
 
+/*
+FprintError writes err, as returned by Parse, to w. It is followed
+by the line of the buffer where parsing failed, preceded by up to
+two lines of context, and a line with a caret pointing at the
+offending character.
+*/
+func (p *{{def "Peg"}}) FprintError(w io.Writer, err error) {
+	if err == nil {
+		return
+	}
+	var on, off, mark string
+	if p.ErrorColor {
+		on, off, mark = "\x1b[1;31m", "\x1b[0m", "\x1b[1;32m"
+	}
+	if p.ErrorVerbosity == {{id "e"}}rrorTerse {
+		switch e := err.(type) {
+		case *{{id "u"}}nexpectedCharError:
+			fmt.Fprintf(w, "%s%v%s\n", on, &e.At, off)
+		case *{{id "u"}}nexpectedEOFError:
+			fmt.Fprintf(w, "%s%v%s\n", on, &e.After, off)
+		default:
+			fmt.Fprintf(w, "%s%v%s\n", on, err, off)
+		}
+		return
+	}
+	fmt.Fprintf(w, "%s%v%s\n", on, err, off)
+
+	buf, _, pos := p.errBuffer()
+	if pos > len(buf) {
+		pos = len(buf)
+	}
+	line := pos
+	for line > 0 && buf[line-1] != '\n' {
+		line--
+	}
+	context := line
+	for n := 0; context > 0; context-- {
+		if buf[context-1] == '\n' {
+			if n == 2 {
+				break
+			}
+			n++
+		}
+	}
+{{if def "bom"}}\
+	if len(buf) >= 3 && buf[:3] == "\xef\xbb\xbf" {
+		if line == 0 {
+			line = 3
+		}
+		if context == 0 {
+			context = 3
+		}
+	}
+{{end}}\
+	eol := pos
+	for eol < len(buf) && buf[eol] != '\n' {
+		eol++
+	}
+{{if def "crlf"}}\
+	if eol > pos && buf[eol-1] == '\r' {
+		eol--
+	}
+{{end}}\
+	caret := make([]byte, 0, pos-line+1)
+	for i := line; i < pos; i++ {
+		switch c := buf[i]; {
+		case c == '\t':
+			caret = append(caret, '\t')
+		case c&0xC0 != 0x80:
+			caret = append(caret, ' ')
+		}
+	}
+	fmt.Fprintf(w, "%s\n%s%s^%s\n", buf[context:eol], caret, mark, off)
+
+	if p.ErrorVerbosity == {{id "e"}}rrorVerbose && len(p.expected) != 0 {
+		fmt.Fprintf(w, "expected")
+		for i, e := range p.expected {
+			if i != 0 {
+				fmt.Fprintf(w, ",")
+			}
+			fmt.Fprintf(w, " %v", e)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// Init prepares the parser for parsing Buffer. It must be called again,
+// if Buffer is assigned a new text, or ResetBuffer may be used instead.
 func (p *{{def "Peg"}}) Init() {
 	var position int
+{{if def "iterative"}}\
+	var calls []int // stack of the rules' variables, and call sites, see run
+{{end}}\
+	p.metrics = {{id "m"}}etrics{}
+{{if def "metrics"}}\
+	p.profile = yyProfile{}
+{{end}}\
+{{if def "ambiguity"}}\
+	p.overlaps = make(map[[3]int]int)
+{{end}}\
+{{with def "maxdepth"}}\
+	if p.MaxDepth == 0 {
+		p.MaxDepth = {{.}}
+	}
+{{end}}\
+{{if hasIndentation}}\
+	// stack of indentation columns, see %indent
+	indents := []struct{ col, parent int }{{"{"}}{0, -1}}
+	indentTop := 0
+{{end}}\
+{{if def "state"}}\
+	p.states, p.stateTop = append(p.states[:0], yyStateEntry{parent: -1}), 0
+{{end}}\
+{{if def "undo"}}\
+	p.undo = p.undo[:0]
+{{end}}\
+	if p.Normalize != nil {
+		p.original = p.Buffer
+		p.Buffer, p.posMap = p.Normalize(p.Buffer)
+	}
+{{if def "bom"}}\
+	if len(p.Buffer) >= 3 && p.Buffer[:3] == "\xef\xbb\xbf" {
+		position = 3 // skip a UTF-8 byte order mark
+		p.Min, p.Max = 3, 3
+	}
+{{end}}\
 {{if nvar}}\
 	var yyp int
 	var yy {{def "yystype"}}
-	var yyval = make([]{{def "yystype"}}, 256)
+	var yyval = make([]{{def "yystype"}}, {{def "values"}})
+	p.metrics.ValuesCap = len(yyval)
+	p.value = func() {{def "yystype"}} { return yy }
+{{end}}\
+{{if readsVariables}}\
+	// yyvalue returns the value of the variable at offset within the
+	// values of the current rule, as assigned at the last commit, for
+	// predicates, immediate, and error actions, or a zero value, if no
+	// values have been pushed yet
+	yyvalue := func(offset int) {{def "yystype"}} {
+		if i := yyp + offset; i >= 0 {
+			return yyval[i]
+		}
+		var v {{def "yystype"}}
+		return v
+	}
 {{end}}\
 
-{{if .Actions}}\
+{{if thunks}}\
+{{	if .Actions}}\
+{{/* begin is quoted, so that a prefix does not rename the name used by actions */}}\
 	actions := [...]func(string, int){
-{{	range .Actions}}		/* {{.GetId}} {{.GetRule}} */
-		func(yytext string, _ int) {
-{{.Code}}		},
+{{	range .Actions}}		{{actionName .}}: func(yytext string, {{"begin"}} int) {
+{{code .}}		},
 {{	end}}
 {{	if nvar}}\
 		/* yyPush */
 		func(_ string, count int) {
 			yyp += count
+			if yyp > p.metrics.Values {
+				p.metrics.Values = yyp
+			}
 			if yyp >= len(yyval) {
-				s := make([]{{def "yystype"}}, cap(yyval)+256)
+				s := make([]{{def "yystype"}}, 2*yyp)
 				copy(s, yyval)
 				yyval = s
+				p.metrics.ValuesCap = len(yyval)
 			}
 		},
 		/* yyPop */
 		func(_ string, count int) {
 			yyp -= count
+{{		if valueKind}}\
+			for i := yyp; i < yyp+count; i++ {
+				yyval[i] = nil // so that the value may be garbage collected
+			}
+{{		end}}\
 		},
 		/* yySet */
 		func(_ string, count int) {
 			yyval[yyp+count] = yy
 		},
+{{		with yyspan}}\
+		/* yyPos */
+		func(s string, from int) {
+{{			if eq valueKind "pointer"}}\
+			if yy == nil {
+				return
+			}
+{{			end}}\
+			yy.{{index . 0}}, yy.{{index . 1}} = from, from+len(s)
+		},
+{{		end}}\
 	}
 	const (
 		yyPush = {{len .Actions}} + iota
 		yyPop
 		yySet
+{{		if yyspan}}\
+		yyPos
+{{		end}}\
 	)
 {{	else}}\
 	}
 {{	end}}\
+{{	end}}\
 {{	with $bits := actionBits}}
 	type thunk struct {
-		action uint{{$bits}}
-		begin, end int
+		action   uint{{$bits}}
+		from, to int
+{{		if def "spans"}}\
+		spanRule int // rule id + 1, if the thunk records a span
+{{		end}}\
 	}
 	var thunkPosition, begin, end int
-	thunks := make([]thunk, 32)
+	thunks := make([]thunk, {{def "thunks"}})
+	p.metrics.ThunksCap = len(thunks)
+{{		if eq (def "commit") "nested"}}\
+	// thunks[0] is the thunk at thunkPosition thunkBase, previous
+	// ones have been executed by commit already
+	thunkBase := 0
+	doarg := func(action uint{{$bits}}, arg int) {
+		if thunkPosition < thunkBase {
+			thunkBase = thunkPosition // backtracked across a commit
+		}
+		i := thunkPosition - thunkBase
+{{		else}}\
 	doarg := func(action uint{{$bits}}, arg int) {
-		if thunkPosition == len(thunks) {
+		i := thunkPosition
+{{		end}}\
+		if i == len(thunks) {
 			newThunks := make([]thunk, 2*len(thunks))
 			copy(newThunks, thunks)
 			thunks = newThunks
+			p.metrics.ThunksCap = len(thunks)
 		}
-		t := &thunks[thunkPosition]
+		if i >= p.metrics.Thunks {
+			p.metrics.Thunks = i + 1
+		}
+		t := &thunks[i]
 		thunkPosition++
 		t.action = action
 		if arg != 0 {
-			t.begin = arg // use begin to store an argument
+			t.from = arg // use from to store an argument
 		} else {
-			t.begin = begin
+			t.from = begin
 		}
-		t.end = end
+		t.to = end
+{{		if def "spans"}}\
+		t.spanRule = 0
+{{		end}}\
 	}
+{{		if $.Actions}}\
 	do := func(action uint{{$bits}}) {
 		doarg(action, 0)
 	}
+{{		end}}\
+{{	if and nvar yyspan}}\
+	dopos := func(from, to int) {
+		doarg(yyPos, 0)
+		t := &thunks[thunkPosition-1{{thunkOffset}}]
+		t.from, t.to = from, to
+	}
+{{	end}}\
+{{	if def "spans"}}\
+	dospan := func(id, from, to int) {
+		doarg(0, 0)
+		t := &thunks[thunkPosition-1{{thunkOffset}}]
+		t.from, t.to, t.spanRule = from, to, id+1
+	}
+{{	end}}\
+{{	if hasErrorActions}}\
+	doerr := func(action uint{{$bits}}) {
+{{if def "ambiguity"}}\
+		if p.probing != 0 {
+			return
+		}
+{{end}}\
+		s := ""
+		if begin >= 0 && begin <= end && end <= len(p.Buffer) {
+			s = p.Buffer[begin:end]
+		}
+		actions[action](s, 0)
+	}
+{{	end}}\
 {{	end}}
+{{end}}\
+{{if def "memo"}}\
+
+	// The results of rules are memoized, including the thunks
+	// they have queued, unless a commit happened meanwhile.
+	type memoKey struct{ rule, position int }
+	type memoEntry struct {
+{{	if thunks}}\
+		key     memoKey
+		ok      bool
+		next    int    // position after the rule
+		capture [2]int // begin and end after the rule
+		queued  []thunk
+{{	else}}\
+		key  memoKey
+		ok   bool
+		next int // position after the rule
+{{	end}}\
+	}
+	memo := make(map[memoKey]*list.Element)
+	var memoList list.List // most recently used entries first
+{{	if hasCommit}}\
+	commits := 0
+{{	end}}\
+
+{{end}}\
 	p.ResetBuffer = func(s string) (old string) {
 		if position < len(p.Buffer) {
 			old = p.Buffer[position:]
 		}
 		p.Buffer = s
+		p.posMap = nil
+		if p.Normalize != nil {
+			p.original = s
+			p.Buffer, p.posMap = p.Normalize(s)
+		}
+{{if thunks}}\
 		thunkPosition = 0
+{{end}}\
+{{if and thunks (eq (def "commit") "nested")}}\
+		thunkBase = 0
+{{end}}\
 		position = 0
 		p.Min = 0
 		p.Max = 0
+		p.expected = p.expected[:0]
+		p.ruleStack = p.ruleStack[:0]
+		p.failStack = p.failStack[:0]
+{{if def "iterative"}}\
+		calls = calls[:0]
+{{end}}\
+{{if def "spans"}}\
+		p.Spans = p.Spans[:0]
+{{end}}\
+{{if def "captures"}}\
+		p.Captures = p.Captures[:0]
+{{end}}\
+{{if hasIndentation}}\
+		indents, indentTop = indents[:1], 0
+{{end}}\
+{{if def "state"}}\
+		p.states, p.stateTop = p.states[:1], 0
+{{end}}\
+{{if def "undo"}}\
+		p.undo = p.undo[:0]
+{{end}}\
+{{if def "memo"}}\
+		for key := range memo {
+			delete(memo, key)
+		}
+		memoList.Init()
+{{end}}\
+		p.metrics.Thunks, p.metrics.Values, p.metrics.MemoEntries, p.metrics.MemoPeak = 0, 0, 0, 0
+{{if thunks}}\
 		end = 0
+{{end}}\
+{{if def "bom"}}\
+		if len(p.Buffer) >= 3 && p.Buffer[:3] == "\xef\xbb\xbf" {
+			position = 3
+			p.Min, p.Max = 3, 3
+		}
+{{end}}\
 		return
 	}
-{{	if hasCommit}}
+	p.seek = func(pos int) {
+		position = pos
+{{if thunks}}\
+		thunkPosition = 0
+{{end}}\
+{{if and thunks (eq (def "commit") "nested")}}\
+		thunkBase = 0
+{{end}}\
+		p.Min, p.Max = pos, pos
+		p.expected = p.expected[:0]
+		p.ruleStack = p.ruleStack[:0]
+		p.failStack = p.failStack[:0]
+{{if def "iterative"}}\
+		calls = calls[:0]
+{{end}}\
+{{if hasIndentation}}\
+		indents, indentTop = indents[:1], 0
+{{end}}\
+{{if def "state"}}\
+		p.states, p.stateTop = p.states[:1], 0
+{{end}}\
+{{if def "undo"}}\
+		p.undo = p.undo[:0]
+{{end}}\
+{{if def "memo"}}\
+		for key := range memo {
+			delete(memo, key)
+		}
+		memoList.Init()
+{{end}}\
+	}
+{{if def "recognize"}}\
+	p.offset = func() int { return position }
+{{end}}\
+{{if tokenRules}}\
+	// matchToken applies a token rule at pos, returning the position
+	// following the match; actions are dropped
+	p.matchToken = func(rule, pos int) (int, bool) {
+		position = pos
+{{if thunks}}\
+		thunkPosition = 0
+{{end}}\
+{{if and thunks (eq (def "commit") "nested")}}\
+		thunkBase = 0
+{{end}}\
+		ok := p.rules[rule]()
+{{if thunks}}\
+		thunkPosition = 0
+{{end}}\
+		return position, ok
+	}
+{{end}}\
+{{if hasCommit}}
+{{		if eq (def "commit") "nested"}}\
+	// commit executes all thunks queued since the previous commit,
+	// even within nested rules, i.e. if thunks preceding the current
+	// rule are pending
+	commit := func(int) bool {
+{{if def "ambiguity"}}\
+		if p.probing != 0 {
+			return true // actions are not executed for probed branches
+		}
+{{end}}\
+		if thunkPosition < thunkBase {
+			thunkBase = thunkPosition // backtracked across a commit
+		}
+{{if $.Actions}}\
+		s := ""
+{{end}}\
+		for _, t := range thunks[:thunkPosition-thunkBase] {
+{{		else}}\
 	commit := func(thunkPosition0 int) bool {
-		if thunkPosition0 == 0 {
-			s := ""
-			for _, t := range thunks[:thunkPosition] {
-				b := t.begin
-				if b >= 0 && b <= t.end {
-					s = p.Buffer[b:t.end]
-				}
-				magic := b
-				actions[t.action](s, magic)
+		if thunkPosition0 != 0 {
+			return false
+		}
+{{if def "ambiguity"}}\
+		if p.probing != 0 {
+			return true // actions are not executed for probed branches
+		}
+{{end}}\
+{{if $.Actions}}\
+		s := ""
+{{end}}\
+		for _, t := range thunks[:thunkPosition] {
+{{		end}}\
+{{		if def "spans"}}\
+			if t.spanRule != 0 {
+				p.Spans = append(p.Spans, {{id "s"}}pan{Rule: t.spanRule - 1, Begin: t.from, End: t.to})
+				continue
 			}
-			p.Min = position
-			thunkPosition = 0
-			return true
+{{		end}}\
+{{		if $.Actions}}\
+			b := t.from
+			if b >= 0 && b <= t.to {
+				s = p.Buffer[b:t.to]
+			}
+			magic := b
+			actions[t.action](s, magic)
+{{		end}}\
 		}
-		return false
+		p.Min = position
+{{		if def "memo"}}\
+		commits++
+{{		end}}\
+{{		if eq (def "commit") "nested"}}\
+		thunkBase = thunkPosition
+{{		else}}\
+		thunkPosition = 0
+{{		end}}\
+		return true
 	}
+{{end}}\
+{{if finalCommit}}\
+	p.finish = func() { commit(0) }
+{{end}}\
+{{if def "memo"}}
+	memoize := func() {
+		for id, rule := range p.rules {
+			if rule == nil {
+				continue
+			}
+			id, rule := id, rule
+			p.rules[id] = func() bool {
+				key := memoKey{id, position}
+				if el, ok := memo[key]; ok {
+					memoList.MoveToFront(el)
+					m := el.Value.(*memoEntry)
+{{	if thunks}}\
+					for _, t := range m.queued {
+						doarg(0, 0)
+						thunks[thunkPosition-1{{thunkOffset}}] = t
+					}
+					position, begin, end = m.next, m.capture[0], m.capture[1]
+{{	else}}\
+					position = m.next
 {{	end}}\
+					return m.ok
+				}
+{{	if not thunks}}\
+				ok := rule()
+				m := &memoEntry{key: key, ok: ok, next: position}
+{{	else}}\
+{{		if hasCommit}}\
+				thunkPosition0, commits0 := thunkPosition, commits
+				ok := rule()
+				if commits != commits0 {
+					return ok
+				}
+{{		else}}\
+				thunkPosition0 := thunkPosition
+				ok := rule()
+{{		end}}\
+				m := &memoEntry{key: key, ok: ok, next: position, capture: [2]int{begin, end}}
+				if ok {
+					m.queued = append([]thunk(nil), thunks[thunkPosition0{{thunkOffset}}:thunkPosition{{thunkOffset}}]...)
+				}
+{{	end}}\
+				memo[key] = memoList.PushFront(m)
+				if p.MemoLimit > 0 && memoList.Len() > p.MemoLimit {
+					el := memoList.Back()
+					delete(memo, el.Value.(*memoEntry).key)
+					memoList.Remove(el)
+				}
+				if p.metrics.MemoEntries = len(memo); p.metrics.MemoEntries > p.metrics.MemoPeak {
+					p.metrics.MemoPeak = p.metrics.MemoEntries
+				}
+				return ok
+			}
+		}
+	}
 {{end}}\
 {{with stats}}\
 {{if .Match.Dot}}\
@@ -196,7 +1355,7 @@ func (p *{{def "Peg"}}) Init() {
 			position++
 			return true
 		} else if position >= p.Max {
-			p.Max = position
+			p.expect(position, yyExpected{kind: '.'})
 		}
 		return false
 	}
@@ -207,7 +1366,7 @@ func (p *{{def "Peg"}}) Init() {
 			position++
 			return true
 		} else if position >= p.Max {
-			p.Max = position
+			p.expect(position, yyExpected{kind: '\'', s: string(c)})
 		}
 		return false
 	}
@@ -225,30 +1384,131 @@ func (p *{{def "Peg"}}) Init() {
 			position = next
 			return true
 		} else if position >= p.Max {
-			p.Max = position
+			p.expect(position, yyExpected{kind: '"', s: s})
+		}
+		return false
+	}
+{{end}}
+{{if keywordTables}}\
+	// the literals of the alternates of keywords, in the order of the
+	// alternatives, and by their first byte
+	keywords := [...]struct {
+		all     []string
+		byFirst [256][]string
+	}{
+{{range keywordTables}}		{{.}},
+{{end}}\
+	}
+	matchKeywords := func(set int) bool {
+		if position < len(p.Buffer) {
+			for _, s := range keywords[set].byFirst[p.Buffer[position]] {
+				if next := position + len(s); next <= len(p.Buffer) && p.Buffer[position:next] == s {
+					position = next
+					return true
+				}
+			}
+		}
+		if position >= p.Max {
+			for _, s := range keywords[set].all {
+				p.expect(position, yyExpected{kind: '"', s: s})
+			}
+		}
+		return false
+	}
+
+{{end}}\
+{{if .Match.Bytes}}\
+	matchBytes := func(n int) bool {
+		if n >= 0 && n <= len(p.Buffer)-position {
+			position += n
+			return true
+		} else if len(p.Buffer) >= p.Max {
+			p.expect(len(p.Buffer), yyExpected{kind: '.'})
 		}
 		return false
 	}
 {{end}}
+{{if or .Indent.Push .Indent.Same}}\
+	indentColumn := func() int {
+		i := strings.LastIndexByte(p.Buffer[:position], '\n') + 1
+{{if def "bom"}}\
+		if i == 0 && strings.HasPrefix(p.Buffer, "\xef\xbb\xbf") {
+			i = 3
+		}
+{{end}}\
+		return position - i
+	}
+{{end}}\
+{{if .Indent.Push}}\
+	pushIndent := func() bool {
+		col := indentColumn()
+		if col <= indents[indentTop].col {
+			return false
+		}
+		indents = append(indents, struct{ col, parent int }{col, indentTop})
+		indentTop = len(indents) - 1
+		return true
+	}
+{{end}}\
+{{if .Indent.Pop}}\
+	popIndent := func() bool {
+		if indentTop == 0 {
+			return false
+		}
+		indentTop = indents[indentTop].parent
+		return true
+	}
+{{end}}\
+{{if .Indent.Same}}\
+	sameIndent := func() bool {
+		return indentColumn() == indents[indentTop].col
+	}
+{{end}}\
+{{if .WordBoundary}}\
+	atWordBoundary := func() bool {
+		isWord := func(i int) bool {
+			if i < 0 || i >= len(p.Buffer) {
+				return false
+			}
+			c := p.Buffer[i]
+			return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+		}
+		return isWord(position-1) != isWord(position)
+	}
+{{end}}
 {{	if len $.Classes}}\
+{{		if classStrings}}\
+	// the bitmaps of the classes, 32 bytes each
+	const classes =\
+{{range $i, $text := classTexts}}{{if $i}} +{{end}}
+		// {{classIndex $text}}: {{classComment $text}}
+		"{{range (index $.Classes $text).Class}}{{printf "\\x%02x" .}}{{end}}"{{end}}
+	inClass := func(class uint) bool {
+		c := p.Buffer[position]
+		return classes[class<<5|uint(c>>3)]&(1<<(c&7)) != 0
+	}
+{{		else}}\
 	classes := [...][32]uint8{
-{{range $.Classes}}	{{.Index}}:	{{"{"}}{{range $i, $b := .Class}}{{if $i}}, {{end}}{{$b | printf "%d"}}{{end}}{{"}"}},
+{{range $text := classTexts}}{{$c := index $.Classes $text}}	// {{classComment $text}}
+	{{$c.Index}}:	{{"{"}}{{range $i, $b := $c.Class}}{{if $i}}, {{end}}{{$b | printf "%d"}}{{end}}{{"}"}},
 {{end}}\
 	}
+	inClass := func(class uint) bool {
+		return (classes[class][p.Buffer[position]>>3] & (1 << (p.Buffer[position] & 7))) != 0
+	}
+{{		end}}\
 	matchClass := func(class uint) bool {
-		if (position < len(p.Buffer)) &&
-			((classes[class][p.Buffer[position]>>3] & (1 << (p.Buffer[position] & 7))) != 0) {
+		if position < len(p.Buffer) && inClass(class) {
 			position++
 			return true
 		} else if position >= p.Max {
-			p.Max = position
+			p.expect(position, yyExpected{kind: '[', class: class})
 		}
 		return false
 	}
 {{if .Peek.Class}}\
 	peekClass := func(class uint) bool {
-		if (position < len(p.Buffer)) &&
-			((classes[class][p.Buffer[position]>>3] & (1 << (p.Buffer[position] & 7))) != 0) {
+		if position < len(p.Buffer) && inClass(class) {
 			return true
 		}
 		return false
@@ -256,7 +1516,9 @@ func (p *{{def "Peg"}}) Init() {
 {{end}}
 {{	end}}
 {{end}}\
+{{if not (or split (def "iterative"))}}\
 	p.rules = [...]func() bool{
+{{end}}\
 `, "\\\n", "", -1)
 
 // used as template function `len'
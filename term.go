@@ -0,0 +1,17 @@
+package peg
+
+import (
+	"io"
+	"os"
+)
+
+// IsTerminal reports whether w is a file referring to a terminal. It
+// may be used to decide about the ErrorColor field of a generated parser.
+func IsTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+)
+
+// the captures recorded for each input, or nil, if it is rejected
+var tests = []struct {
+	in       string
+	captures []Capture
+}{
+	{"a, 12 ,bc", []Capture{
+		{ruleName, "a", 0, 1}, {ruleNumber, "12", 3, 5}, {ruleName, "bc", 7, 9},
+	}},
+	{" 7", []Capture{{ruleNumber, "7", 1, 2}}},
+	{"a,", nil},
+}
+
+func main() {
+	failed := false
+	for _, test := range tests {
+		p := &yyParser{Buffer: test.in}
+		p.Init()
+		err := p.Parse()
+		switch {
+		case test.captures == nil && err == nil:
+			fmt.Printf("%q: accepted\n", test.in)
+		case test.captures != nil && err != nil:
+			fmt.Printf("%q: rejected: %v\n", test.in, err)
+		case err == nil && !reflect.DeepEqual(p.Captures, test.captures):
+			fmt.Printf("%q: captures %v, want %v\n", test.in, p.Captures, test.captures)
+		default:
+			continue
+		}
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+func main() {
+	deep := strings.Repeat("(", 50) + "x" + strings.Repeat(")", 50)
+	in := deep + ";x;(x;((x));"
+
+	// the offsets of the semicolons following the errors
+	want := []int{len(deep), len(deep) + 5}
+
+	p := &yyParser{Buffer: in}
+	p.Init()
+	var syncs []int
+	err := p.Parse()
+	if err != ErrTooDeep {
+		fmt.Printf("%v, want %v\n", err, ErrTooDeep)
+		os.Exit(1)
+	}
+	for ; err != nil && len(syncs) < len(want); err = p.Resume(syncs[len(syncs)-1] + 1) {
+		syncs = append(syncs, p.Sync(p.Max, ruleSemi))
+	}
+	if err != nil || !reflect.DeepEqual(syncs, want) {
+		fmt.Printf("errors before %v, want %v, last error: %v\n", syncs, want, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+)
+
+// the spans recorded for each input, and whether it is accepted;
+// if it is rejected, they are those committed before the error
+var tests = []struct {
+	in    string
+	ok    bool
+	spans []Span
+}{
+	{"a=1", true, []Span{
+		{ruleKey, 0, 1}, {rulePair, 0, 1}, {ruleValue, 2, 3}, {ruleValue, 2, 3}, {rulePair, 0, 3},
+		{ruleStart, 0, 3},
+	}},
+	{"ab=12 c=3", true, []Span{
+		{ruleKey, 0, 2}, {rulePair, 0, 2}, {ruleValue, 3, 5}, {ruleValue, 3, 5}, {rulePair, 0, 5},
+		{ruleKey, 6, 7}, {rulePair, 6, 7}, {ruleValue, 8, 9}, {ruleValue, 8, 9}, {rulePair, 6, 9},
+		{ruleStart, 0, 9},
+	}},
+	{"a=1 b=", false, []Span{
+		{ruleKey, 0, 1}, {rulePair, 0, 1}, {ruleValue, 2, 3}, {ruleValue, 2, 3}, {rulePair, 0, 3},
+	}},
+	{"a=", false, nil},
+}
+
+func main() {
+	failed := false
+	for _, test := range tests {
+		p := &yyParser{Buffer: test.in}
+		p.Init()
+		err := p.Parse()
+		switch {
+		case !test.ok && err == nil:
+			fmt.Printf("%q: accepted\n", test.in)
+		case test.ok && err != nil:
+			fmt.Printf("%q: rejected: %v\n", test.in, err)
+		case !reflect.DeepEqual(p.Spans, test.spans) && len(p.Spans)+len(test.spans) != 0:
+			fmt.Printf("%q: spans %v, want %v\n", test.in, p.Spans, test.spans)
+		default:
+			continue
+		}
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+)
+
+// the spans recorded for each input, which are those of the tokens,
+// or nil, if it is rejected
+var tests = []struct {
+	in    string
+	spans []Span
+}{
+	{"if x < 10 then y", []Span{
+		{ruleKeyword, 0, 2}, {ruleIdent, 3, 4}, {ruleOp, 5, 6}, {ruleNumber, 7, 9},
+		{ruleKeyword, 10, 14}, {ruleIdent, 15, 16},
+	}},
+	{"iff = elsewhere", []Span{{ruleIdent, 0, 3}, {ruleOp, 4, 5}, {ruleIdent, 6, 15}}},
+	{"", []Span{}},
+	{"x ? y", nil},
+}
+
+func main() {
+	failed := false
+	for _, test := range tests {
+		p := &yyParser{Buffer: test.in}
+		p.Init()
+		err := p.Parse()
+		switch {
+		case test.spans == nil && err == nil:
+			fmt.Printf("%q: accepted\n", test.in)
+		case test.spans != nil && err != nil:
+			fmt.Printf("%q: rejected: %v\n", test.in, err)
+		case err == nil && !reflect.DeepEqual(p.Spans, test.spans) && len(p.Spans)+len(test.spans) != 0:
+			fmt.Printf("%q: spans %v, want %v\n", test.in, p.Spans, test.spans)
+		default:
+			continue
+		}
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -12,7 +12,27 @@ Possible optimizations:
 		first item of `case' sections it is already known what the
 		first character is. Otherwise the case branch would not have
 		been entered. This patch makes use of this information and
-		avoids testing for the same conditions again.
+		avoids testing for the same conditions again, which also
+		applies to the first repetition of a character, or class,
+		like in [0-9]+.
+
+	c	Encode the bitmaps of character classes as a string constant,
+		instead of a composite literal of byte arrays, which has to
+		be initialized by each call of Init, and bloats the code of
+		grammars using many classes.
+
+	g	Compare the first byte of a string before calling matchString,
+		so that most mismatches, e.g. of keywords, don't cost a call
+		of a closure.
+
+	h	If all alternatives of an alternate end with the same action,
+		execute it once after the alternate, so that the generated
+		code contains it only once.
+
+	k	Match alternates of at least keywordCases literals, like
+		"if" | "import" | "int" | "while", using a table of the
+		literals by their first byte, so that only those starting
+		with the current byte are compared.
 
 	l	Inline leaf rules, if they contain only one element of Dot, Char,
 		Class or Predicate type, or such an element embedded in a
@@ -30,19 +50,30 @@ Possible optimizations:
 	s	if a sequence starts with one or more `!Char'
 		(PeekNot for Character), insert a switch expression
 
+	t	Dispatch the unordered alternates of at least tableCases
+		branches, built by the `switch' optimization, through a
+		table mapping each byte to the index of its branch, which
+		is smaller, and faster, than a switch statement listing
+		the bytes of each branch.
+
 Flags that are shown within braces are less effective now than they used
 to be, probably because of improvements of the Go compilers.
 */
 const (
-	AllOptimizations = "1:l:p:r:s"
+	AllOptimizations = "1:c:g:h:k:l:p:r:s:t"
 )
 
 type optiFlags struct {
 	peek               bool
+	classStrings       bool
+	stringGuard        bool
 	elimRestore        bool
 	inlineLeafs        bool
 	seqPeekNot         bool
 	unorderedFirstItem bool
+	dispatchTable      bool
+	hoistActions       bool
+	keywords           bool
 }
 
 func parseOptiFlags(flags string) (o *optiFlags) {
@@ -57,14 +88,24 @@ func parseOptiFlags(flags string) (o *optiFlags) {
 		switch f[0] {
 		case '1':
 			o.unorderedFirstItem = true
+		case 'c':
+			o.classStrings = true
 		case 'p':
 			o.peek = true
 		case 'r':
 			o.elimRestore = true
+		case 'g':
+			o.stringGuard = true
+		case 'h':
+			o.hoistActions = true
+		case 'k':
+			o.keywords = true
 		case 'l':
 			o.inlineLeafs = true
 		case 's':
 			o.seqPeekNot = true
+		case 't':
+			o.dispatchTable = true
 		}
 	}
 	return
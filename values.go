@@ -0,0 +1,53 @@
+package peg
+
+import (
+	"go/ast"
+	"go/parser"
+	gotoken "go/token"
+	"strings"
+)
+
+/*
+valueKind returns "pointer", or "interface", if the semantic values
+of the grammar may be nil, as their type, given using %YYSTYPE, is
+written like *Node, interface{ Pos() int }, any, or error, or is
+declared as a pointer, or an interface, within a header, or trailer,
+of the grammar; it returns "" otherwise. A type declared in another
+file of the package remains unknown.
+*/
+func (t *Tree) valueKind() string {
+	typ := strings.TrimSpace(t.defines["yystype"])
+	switch {
+	case strings.HasPrefix(typ, "*"):
+		return "pointer"
+	case strings.HasPrefix(typ, "interface"), typ == "any", typ == "error":
+		return "interface"
+	}
+	for _, src := range append(append([]string{}, t.Headers...), t.trailers...) {
+		f, err := parser.ParseFile(gotoken.NewFileSet(), "", src, 0)
+		if err != nil {
+			// a header without a package clause
+			if f, err = parser.ParseFile(gotoken.NewFileSet(), "", "package p\n"+src, 0); err != nil {
+				continue
+			}
+		}
+		for _, decl := range f.Decls {
+			d, ok := decl.(*ast.GenDecl)
+			if !ok || d.Tok != gotoken.TYPE {
+				continue
+			}
+			for _, spec := range d.Specs {
+				if s := spec.(*ast.TypeSpec); s.Name.Name == typ {
+					switch s.Type.(type) {
+					case *ast.StarExpr:
+						return "pointer"
+					case *ast.InterfaceType:
+						return "interface"
+					}
+					return ""
+				}
+			}
+		}
+	}
+	return ""
+}
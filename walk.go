@@ -0,0 +1,27 @@
+package peg
+
+/*
+Inspect traverses the grammar tree rooted at node in depth-first
+order, like go/ast.Inspect: It calls f(node); if f returns true,
+Inspect is called recursively for each of the children of node,
+followed by a call of f(nil). The children of a rule are its
+expression; names referring to other rules are not followed.
+*/
+func Inspect(node Node, f func(Node) bool) {
+	if node == nil || !f(node) {
+		return
+	}
+	switch n := node.(type) {
+	case Rule:
+		if e := n.GetExpression(); e != nil {
+			Inspect(e, f)
+		}
+	case List:
+		for el := n.Front(); el != nil; el = el.Next() {
+			if sub, ok := el.Value.(Node); ok {
+				Inspect(sub, f)
+			}
+		}
+	}
+	f(nil)
+}